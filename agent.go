@@ -18,6 +18,8 @@ const (
 	StepSecurityAnnotationPrefix     = "StepSecurity Harden Runner:"
 	EgressPolicyAudit                = "audit"
 	EgressPolicyBlock                = "block"
+	ICMPPolicyAllow                  = "allow" // in block mode, ICMP to non-private destinations is blocked unless allowed
+	ICMPPolicyBlock                  = "block"
 )
 
 type DNSServer interface {
@@ -50,12 +52,13 @@ type IPTables interface {
 	Insert(table, chain string, pos int, rulespec ...string) error
 	Exists(table, chain string, rulespec ...string) (bool, error)
 	ClearChain(table, chain string) error
+	ClearAndDeleteChain(table, chain string) error
 }
 
 // Run the agent
 // TODO: move all inputs into a struct
 func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
-	dockerDNSServer DNSServer, iptables *Firewall, nflog AgentNflogger,
+	dockerDNSServer DNSServer, iptables, ip6tables *Firewall, nflog AgentNflogger,
 	cmd Command, resolvdConfigPath, dockerDaemonConfigPath, tempDir string) error {
 
 	// Passed to each go routine, if anyone fails, the program fails
@@ -67,9 +70,43 @@ func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
 		return err
 	}
 
-	apiclient := &ApiClient{Client: &http.Client{Timeout: 3 * time.Second}, APIURL: config.APIURL, TelemetryURL: config.TelemetryURL, DisableTelemetry: config.DisableTelemetry, EgressPolicy: config.EgressPolicy, OneTimeKey: config.OneTimeKey}
+	// resolve the proxy before the DNS configuration of the host is changed
+	proxySettings, err := NewProxySettings(string(config.Proxy), config.NoProxy)
+	if err != nil {
+		WriteLog(fmt.Sprintf("Error initializing proxy settings: %v", err))
+	}
+
+	tlsSettings := &TLSSettings{CABundlePath: config.CABundlePath, Pins: config.TLSPins, ClientCertPath: config.ClientCertPath, ClientKeyPath: config.ClientKeyPath}
+	httpClient, err := newHTTPClient(proxySettings, tlsSettings)
+	if err != nil {
+		WriteLog(fmt.Sprintf("Error initializing http client: %v", err))
+		httpClient = &http.Client{Timeout: apiClientTimeout}
+	}
+
+	apiclient := &ApiClient{Client: httpClient, APIURL: config.APIURL, TelemetryURL: config.TelemetryURL, DisableTelemetry: config.DisableTelemetry, EgressPolicy: config.EgressPolicy, OneTimeKey: config.OneTimeKey}
+
+	// per-job key used to chain and sign telemetry and agent.log records
+	jobKey := deriveJobKey(config.OneTimeKey, config.CorrelationId)
+	apiclient.Chain = NewEventChain(jobKey)
+	InitLogChain(jobKey)
 
 	config.OneTimeKey = ""
+
+	sinks, err := newTelemetrySinks(config.TelemetrySinks, apiclient)
+	if err != nil {
+		WriteLog(fmt.Sprintf("Error initializing telemetry sinks: %v", err))
+	}
+	for _, sink := range sinks {
+		// deliver asynchronously, so DNS resolution and packet handling never wait on telemetry
+		apiclient.Sinks = append(apiclient.Sinks, NewTelemetryPipeline(sink, config.TelemetryPipeline))
+	}
+	defer apiclient.closeTelemetrySinks()
+
+	sinkEndpoints, sinkIPAddressEndpoints := telemetrySinkEndpoints(config.TelemetrySinks)
+	for _, endpoint := range sinkEndpoints {
+		config.Endpoints[endpoint.domainName] = append(config.Endpoints[endpoint.domainName], endpoint)
+	}
+
 	// TODO: pass in an iowriter/ use log library
 	WriteLog(fmt.Sprintf("read config \n %+v", config))
 	WriteLog("\n")
@@ -133,11 +170,45 @@ func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
 	go startDNSServer(&dnsProxy, hostDNSServer, errc)
 	go startDNSServer(&dnsProxy, dockerDNSServer, errc) // this is for the docker bridge
 
+	// shared by the process and network monitors, so dropped packets are attributed to the same tool chains
+	eventHandler := NewEventHandler(config.CorrelationId, config.Repo, apiclient, &dnsProxy)
+	if config.EgressPolicy == EgressPolicyAudit || config.EgressPolicy == EgressPolicyBlock {
+		eventHandler.EgressAccounting = &EgressAccounting{CorrelationId: config.CorrelationId, Repo: config.Repo, ApiClient: apiclient,
+			DNSProxy: &dnsProxy, EventHandler: eventHandler, UploadThreshold: config.EgressUploadThreshold}
+	}
+
+	// reads of credential files, writes to file commands and changes of source files are reported with the file monitor
+	var credentials []credentialFile
+	var fileCommandsDir string
+	if !config.DisableFileMonitoring {
+		runnerWorkerPid := ""
+		if pid, err := getRunnerWorkerPID(); err == nil {
+			runnerWorkerPid = fmt.Sprintf("%d", pid)
+		}
+		credentials = credentialFiles(runnerHome(runnerWorkerPid), runnerWorkerPid)
+		eventHandler.CredentialFiles = credentials
+
+		fileCommandsDir = fileCommandsDirectory(config.RunnerTemp, config.WorkingDirectory)
+		eventHandler.FileCommands = &FileCommandMonitor{Directory: fileCommandsDir}
+
+		if config.WorkingDirectory != "" {
+			eventHandler.Integrity = &IntegrityMonitor{WorkingDirectory: config.WorkingDirectory, Annotate: config.AnnotateSourceIntegrity,
+				EventHandler: eventHandler}
+		}
+	}
+
 	// start proc mon
+	var procMon *ProcessMonitor
 	if cmd == nil {
-		procMon := &ProcessMonitor{CorrelationId: config.CorrelationId, Repo: config.Repo,
-			ApiClient: apiclient, WorkingDirectory: config.WorkingDirectory, DisableFileMonitoring: config.DisableFileMonitoring, DNSProxy: &dnsProxy}
+		procMon = &ProcessMonitor{CorrelationId: config.CorrelationId, Repo: config.Repo,
+			ApiClient: apiclient, WorkingDirectory: config.WorkingDirectory, DisableFileMonitoring: config.DisableFileMonitoring, DNSProxy: &dnsProxy, EventHandler: eventHandler,
+			AuditBacklogLimit: config.AuditBacklogLimit, AuditRateLimit: config.AuditRateLimit, AuditRecordPath: config.AuditRecordPath,
+			AuditMode: config.AuditMode, Backend: config.ProcessMonitorBackend, FileWatches: config.FileWatches, CredentialFiles: credentials,
+			FileCommandsDirectory: fileCommandsDir}
+		// the audit rules of the host are restored when the job ends
+		eventHandler.ProcessMonitor = procMon
 		go procMon.MonitorProcesses(errc)
+		go eventHandler.StartProcessGC(ctx, defaultProcessGCInterval)
 		WriteLog("started process monitor")
 	}
 
@@ -151,13 +222,16 @@ func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
 
 	// hydrate dns cache
 	if config.EgressPolicy == EgressPolicyBlock {
+		// sinks configured by IP address need no resolution
+		ipAddressEndpoints = append(ipAddressEndpoints, sinkIPAddressEndpoints...)
+
 		for domainName, endpoints := range allowedEndpoints {
 			// this will cause domain, IP mapping to be cached
 			ipAddress, err := dnsProxy.getIPByDomain(domainName)
 			if err != nil {
 				WriteLog(fmt.Sprintf("Error resolving allowed domain %v", err))
 				WriteAnnotation(fmt.Sprintf("%s Reverting agent since allowed endpoint %s could not be resolved", StepSecurityAnnotationPrefix, strings.Trim(domainName, ".")))
-				RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo)
+				RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
 				return err
 			}
 			for _, endpoint := range endpoints {
@@ -171,7 +245,7 @@ func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
 	// Change DNS config on host, causes processes to use agent's DNS proxy
 	if err := dnsConfig.SetDNSServer(cmd, resolvdConfigPath, tempDir); err != nil {
 		WriteLog(fmt.Sprintf("Error setting DNS server %v", err))
-		RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo)
+		RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
 		return err
 	}
 
@@ -183,7 +257,7 @@ func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
 		// Change DNS for docker, causes process in containers to use agent's DNS proxy
 		if err := dnsConfig.SetDockerDNSServer(cmd, dockerDaemonConfigPath, tempDir); err != nil {
 			WriteLog(fmt.Sprintf("Error setting DNS server for docker %v", err))
-			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo)
+			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
 			return err
 		}
 
@@ -197,9 +271,17 @@ func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
 			Repo:            config.Repo,
 			ApiClient:       apiclient,
 			GlobalBlocklist: globalBlocklist,
+			DNSProxy:        &dnsProxy,
+			EventHandler:    eventHandler,
+			EgressLimits:    config.EgressLimits,
+			Firewall:        iptables,
+			FlowCache:       NewFlowCache(config.FlowCacheWindow, defaultFlowCacheSize),
 			Status:          "Allowed",
 		}
 
+		// its stats are reported at post_event
+		eventHandler.NetworkMonitor = &netMonitor
+
 		// Start network monitor
 		go netMonitor.MonitorNetwork(ctx, nflog, errc) // listens for NFLOG messages
 
@@ -208,7 +290,7 @@ func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
 		// Add logging to firewall, including NFLOG rules
 		if err := AddAuditRules(iptables); err != nil {
 			WriteLog(fmt.Sprintf("Error adding firewall rules %v", err))
-			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo)
+			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
 			return err
 		}
 
@@ -224,27 +306,82 @@ func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
 			Repo:            config.Repo,
 			ApiClient:       apiclient,
 			GlobalBlocklist: globalBlocklist,
+			DNSProxy:        &dnsProxy,
+			EventHandler:    eventHandler,
+			EgressLimits:    config.EgressLimits,
+			Firewall:        iptables,
+			FlowCache:       NewFlowCache(config.FlowCacheWindow, defaultFlowCacheSize),
 			Status:          "Dropped",
 		}
 
+		// its stats are reported at post_event
+		eventHandler.NetworkMonitor = &netMonitor
+
 		// Start network monitor
 		go netMonitor.MonitorNetwork(ctx, nflog, errc) // listens for NFLOG messages
 
-		if err := addBlockRulesForGitHubHostedRunner(iptables, ipAddressEndpoints); err != nil {
+		if err := addBlockRulesForGitHubHostedRunner(iptables, ipAddressEndpoints, config.ICMPPolicy == ICMPPolicyAllow); err != nil {
 			WriteLog(fmt.Sprintf("Error setting firewall for allowed domains %v", err))
-			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo)
+			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
 			return err
 		}
 
+		if proxySettings != nil && len(proxySettings.Endpoints) > 0 {
+			if err := AddAgentAllowRules(iptables, proxySettings.Endpoints); err != nil {
+				WriteLog(fmt.Sprintf("Error setting firewall for proxy %v", err))
+				RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
+				return err
+			}
+		}
+
+		if config.EnforceSNI {
+			sniGuard := &SNIGuard{CorrelationId: config.CorrelationId, Repo: config.Repo, ApiClient: apiclient, DNSProxy: &dnsProxy}
+			if err := sniGuard.Start(ctx, &NfQueuer{}); err != nil {
+				// without a listener the queue is bypassed, so only IP based rules apply
+				WriteLog(fmt.Sprintf("Error starting sni enforcement %v", err))
+			} else if err := AddSNIEnforcementRules(iptables); err != nil {
+				WriteLog(fmt.Sprintf("Error setting firewall for sni enforcement %v", err))
+				RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
+				return err
+			} else {
+				WriteLog("added sni enforcement rules")
+
+				// ip6tables may not be available, then IPv6 flows are not queued
+				if err := AddSNIEnforcementRulesIPv6(ip6tables); err != nil {
+					WriteLog(fmt.Sprintf("Error setting ip6tables firewall for sni enforcement %v", err))
+				}
+			}
+		}
+
 		go refreshDNSEntries(ctx, iptables, globalBlocklist, allowedEndpoints, &dnsProxy)
 	}
 
 	if config.EgressPolicy == EgressPolicyAudit || config.EgressPolicy == EgressPolicyBlock {
+		if err := AddServerNameLogRules(iptables); err != nil {
+			WriteLog(fmt.Sprintf("Error adding server name logging rules %v", err))
+			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
+			return err
+		}
+
 		if err := AddGlobalBlockRules(iptables, globalBlocklist); err != nil {
 			WriteLog(fmt.Sprintf("Error adding global blocklist firewall rules %v", err))
-			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo)
+			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
+			return err
+		}
+
+		// ip6tables may not be available, IPv4 rules still apply
+		blockICMP := config.EgressPolicy == EgressPolicyBlock && config.ICMPPolicy != ICMPPolicyAllow
+		if err := AddICMPv6Rules(ip6tables, blockICMP); err != nil {
+			WriteLog(fmt.Sprintf("Error adding ICMPv6 rules %v", err))
+		}
+
+		if err := AddEgressLimitRules(iptables, config.EgressLimits, config.EgressPolicy == EgressPolicyBlock); err != nil {
+			WriteLog(fmt.Sprintf("Error adding egress limit rules %v", err))
+			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
 			return err
 		}
+
+		go eventHandler.EgressAccounting.Start(ctx)
 	}
 
 	if IsArmourEnabled() {
@@ -279,6 +416,19 @@ func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
 				WriteLog("[armour] Custom detection rules enabled")
 			}
 		}
+
+		if config.BlockCredentialAccess {
+			if err := InitCredentialArmour(ctx, blockedCredentialFiles(credentials), conf.ApiConf); err != nil {
+				WriteLog(fmt.Sprintf("[armour] Blocking reads of runner credentials failed %v", err))
+			} else {
+				if CredentialArmour != nil {
+					defer CredentialArmour.Detach()
+				}
+				WriteLog("[armour] Blocking reads of runner credentials")
+			}
+		}
+	} else if config.BlockCredentialAccess {
+		WriteLog("Armour is not enabled, reads of credential files are reported but not blocked")
 	}
 
 	if config.DisableSudoAndContainers {
@@ -307,10 +457,11 @@ func Run(ctx context.Context, configFilePath string, hostDNSServer DNSServer,
 	for {
 		select {
 		case <-ctx.Done():
+			revertAuditRules(procMon)
 			return nil
 		case e := <-errc:
 			WriteLog(fmt.Sprintf("Error in Initialization %v", e))
-			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo)
+			RevertChanges(iptables, nflog, cmd, resolvdConfigPath, dockerDaemonConfigPath, dnsConfig, sudo, procMon)
 			return e
 
 		}
@@ -435,7 +586,7 @@ func addImplicitEndpoints(endpoints map[string][]Endpoint, disableTelemetry bool
 }
 
 func RevertChanges(iptables *Firewall, nflog AgentNflogger,
-	cmd Command, resolvdConfigPath, dockerDaemonConfigPath string, dnsConfig DnsConfig, sudo Sudo) {
+	cmd Command, resolvdConfigPath, dockerDaemonConfigPath string, dnsConfig DnsConfig, sudo Sudo, procMon *ProcessMonitor) {
 	err := RevertFirewallChanges(iptables)
 	if err != nil {
 		WriteLog(fmt.Sprintf("Error in RevertChanges %v", err))
@@ -452,9 +603,20 @@ func RevertChanges(iptables *Firewall, nflog AgentNflogger,
 	if err != nil {
 		WriteLog(fmt.Sprintf("Error in reverting sudo changes %v", err))
 	}
+	revertAuditRules(procMon)
 	WriteLog("Reverted changes")
 }
 
+// revertAuditRules restores the audit rules of the host, if the agent started the process monitor.
+func revertAuditRules(procMon *ProcessMonitor) {
+	if procMon == nil {
+		return
+	}
+	if err := procMon.RevertAuditRules(); err != nil {
+		WriteLog(fmt.Sprintf("Error in reverting audit rules %v", err))
+	}
+}
+
 func writeStatus(message string) error {
 	dir := "/home/agent"
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"sync"
 	"time"
 )
 
@@ -40,6 +41,17 @@ type NetworkConnection struct {
 	Status        string    `json:"status,omitempty"`
 	MatchedPolicy string    `json:"matched_policy,omitempty"`
 	Reason        string    `json:"reason,omitempty"`
+	// host name from the TLS SNI or HTTP Host header of the connection
+	ServerName       string `json:"server_name,omitempty"`
+	ServerNameSource string `json:"server_name_source,omitempty"`
+	DomainMismatch   bool   `json:"domain_mismatch,omitempty"`
+	// account that opened the connection, from nflog
+	UID  *uint32 `json:"uid,omitempty"`
+	GID  *uint32 `json:"gid,omitempty"`
+	User string  `json:"user,omitempty"`
+	// protocol of flows that are neither TCP nor UDP, e.g. icmp, and the data of ICMP echo requests
+	Protocol      string `json:"protocol,omitempty"`
+	PayloadLength int    `json:"payload_length,omitempty"`
 }
 
 type ApiClient struct {
@@ -49,48 +61,187 @@ type ApiClient struct {
 	DisableTelemetry bool
 	EgressPolicy     string
 	OneTimeKey       string
+	Sinks            []TelemetrySink
+	Chain            *EventChain
+	telemetryMutex   sync.Mutex          // links and enqueues events in the same order
+	telemetryDrops   []telemetryDropLink // drops not reported to the API yet
+	dropsMutex       sync.Mutex
 }
 
+// telemetryDrop is the chain record of an event a sink dropped, so the gap it leaves is accounted for.
+type telemetryDrop struct {
+	Seq  uint64 `json:"dropped_seq"`
+	Sink string `json:"sink"`
+}
+
+// telemetryDropLink is a drop with its link, as reported to the API.
+type telemetryDropLink struct {
+	telemetryDrop
+	ChainLink
+}
+
+const (
+	// drops reported with one API request, they are sent in a header
+	maxTelemetryDropsPerRequest = 10
+	// drops beyond this are only in agent.log
+	maxPendingTelemetryDrops = 1000
+)
+
 const agentApiBaseUrl = "https://apiurl/v1"
 
 func (apiclient *ApiClient) sendDNSRecord(correlationId, repo, domainName, ipAddress, matchedPolicy, reason string) error {
 
-	if !apiclient.DisableTelemetry || apiclient.EgressPolicy == EgressPolicyAudit {
-		dnsRecord := &DNSRecord{}
+	dnsRecord := &DNSRecord{}
+
+	dnsRecord.DomainName = domainName
+	dnsRecord.ResolvedIPAddress = ipAddress
+	dnsRecord.TimeStamp = time.Now().UTC()
+	dnsRecord.MatchedPolicy = matchedPolicy
+	dnsRecord.Reason = reason
+
+	return apiclient.sendTelemetry(&TelemetryEvent{Type: telemetryTypeDNS, CorrelationId: correlationId, Repo: repo, Data: dnsRecord})
+}
+
+func (apiclient *ApiClient) sendNetConnection(correlationId, repo, ipAddress, port, domainName, status, matchedPolicy, reason string, timestamp time.Time, tool Tool) error {
+
+	networkConnection := &NetworkConnection{}
+
+	networkConnection.IPAddress = ipAddress
+	networkConnection.Port = port
+	networkConnection.DomainName = domainName
+	networkConnection.Status = status
+	networkConnection.TimeStamp = timestamp
+	networkConnection.Tool = tool
+	networkConnection.MatchedPolicy = matchedPolicy
+	networkConnection.Reason = reason
+
+	return apiclient.sendNetworkConnection(correlationId, repo, networkConnection)
+}
+
+func (apiclient *ApiClient) sendNetworkConnection(correlationId, repo string, networkConnection *NetworkConnection) error {
+	return apiclient.sendTelemetry(&TelemetryEvent{Type: telemetryTypeNetworkConnection, CorrelationId: correlationId, Repo: repo, Data: networkConnection})
+}
+
+func (apiclient *ApiClient) sendServerName(correlationId, repo, ipAddress, port, domainName, serverName, source string, mismatch bool, status string, timestamp time.Time) error {
+
+	networkConnection := &NetworkConnection{}
+
+	networkConnection.IPAddress = ipAddress
+	networkConnection.Port = port
+	networkConnection.DomainName = domainName
+	networkConnection.Status = status
+	networkConnection.TimeStamp = timestamp
+	networkConnection.Tool = Tool{Name: Unknown, SHA256: Unknown}
+	networkConnection.ServerName = serverName
+	networkConnection.ServerNameSource = source
+	networkConnection.DomainMismatch = mismatch
+
+	return apiclient.sendNetworkConnection(correlationId, repo, networkConnection)
+}
+
+func (apiclient *ApiClient) sendRawSocket(correlationId, repo string, rawSocket *RawSocket) error {
+	return apiclient.sendTelemetry(&TelemetryEvent{Type: telemetryTypeRawSocket, CorrelationId: correlationId, Repo: repo, Data: rawSocket})
+}
+
+// sendTelemetry chains the event to the previous one and hands it to every configured sink.
+// Without configured sinks the event goes to the StepSecurity API, as before sinks existed.
+// Events are linked and enqueued under one lock, so sinks receive them in chain order.
+func (apiclient *ApiClient) sendTelemetry(event *TelemetryEvent) error {
+	apiclient.telemetryMutex.Lock()
+	defer apiclient.telemetryMutex.Unlock()
+
+	if apiclient.Chain != nil && !localTelemetryTypes[event.Type] {
+		if record, err := json.Marshal(event); err == nil {
+			link := apiclient.Chain.Append(record)
+			event.Chain = &link
+		}
+	}
 
-		dnsRecord.DomainName = domainName
-		dnsRecord.ResolvedIPAddress = ipAddress
-		dnsRecord.TimeStamp = time.Now().UTC()
-		dnsRecord.MatchedPolicy = matchedPolicy
-		dnsRecord.Reason = reason
+	sinks := apiclient.Sinks
+	if len(sinks) == 0 {
+		sinks = []TelemetrySink{&ApiTelemetrySink{ApiClient: apiclient}}
+	}
 
-		url := fmt.Sprintf("%s/github/%s/actions/jobs/%s/dns", apiclient.TelemetryURL, repo, correlationId)
+	var sinkError error
+	for _, sink := range sinks {
+		if err := sink.Send(event); err != nil {
+			if err == errTelemetryQueueFull || err == errTelemetryPipelineClosed {
+				apiclient.recordTelemetryDrop(event, sink.Name())
+			}
+			sinkError = fmt.Errorf("telemetry sink %s: %v", sink.Name(), err)
+		}
+	}
+
+	return sinkError
+}
 
-		return apiclient.sendApiRequest("POST", url, dnsRecord)
+// recordTelemetryDrop appends the drop of event to the chain, writes the link to agent.log and queues it
+// for the next API request, so the backend can tell a dropped event from a removed one. Callers must hold telemetryMutex.
+func (apiclient *ApiClient) recordTelemetryDrop(event *TelemetryEvent, sinkName string) {
+	if apiclient.Chain == nil || event.Chain == nil {
+		return
 	}
-	return nil
+
+	drop := telemetryDrop{Seq: event.Chain.Seq, Sink: sinkName}
+	record, err := json.Marshal(drop)
+	if err != nil {
+		return
+	}
+	link := apiclient.Chain.Append(record)
+
+	WriteLog(fmt.Sprintf("[Telemetry] dropped: %s, seq: %d, hash: %s, signature: %s", record, link.Seq, link.Hash, link.Signature))
+
+	apiclient.dropsMutex.Lock()
+	defer apiclient.dropsMutex.Unlock()
+
+	if len(apiclient.telemetryDrops) >= maxPendingTelemetryDrops {
+		apiclient.telemetryDrops = apiclient.telemetryDrops[1:]
+	}
+	apiclient.telemetryDrops = append(apiclient.telemetryDrops, telemetryDropLink{telemetryDrop: drop, ChainLink: link})
 }
 
-func (apiclient *ApiClient) sendNetConnection(correlationId, repo, ipAddress, port, domainName, status, matchedPolicy, reason string, timestamp time.Time, tool Tool) error {
+// pendingTelemetryDrops returns the oldest drops that were not reported to the API yet.
+func (apiclient *ApiClient) pendingTelemetryDrops() []telemetryDropLink {
+	apiclient.dropsMutex.Lock()
+	defer apiclient.dropsMutex.Unlock()
+
+	drops := apiclient.telemetryDrops
+	if len(drops) > maxTelemetryDropsPerRequest {
+		drops = drops[:maxTelemetryDropsPerRequest]
+	}
+	return append([]telemetryDropLink{}, drops...)
+}
 
-	if !apiclient.DisableTelemetry || apiclient.EgressPolicy == EgressPolicyAudit {
-		networkConnection := &NetworkConnection{}
+// reportedTelemetryDrops removes the drops the API received.
+func (apiclient *ApiClient) reportedTelemetryDrops(drops []telemetryDropLink) {
+	if len(drops) == 0 {
+		return
+	}
 
-		networkConnection.IPAddress = ipAddress
-		networkConnection.Port = port
-		networkConnection.DomainName = domainName
-		networkConnection.Status = status
-		networkConnection.TimeStamp = timestamp
-		networkConnection.Tool = tool
-		networkConnection.MatchedPolicy = matchedPolicy
-		networkConnection.Reason = reason
+	apiclient.dropsMutex.Lock()
+	defer apiclient.dropsMutex.Unlock()
 
-		url := fmt.Sprintf("%s/github/%s/actions/jobs/%s/networkconnection", apiclient.TelemetryURL, repo, correlationId)
+	last := drops[len(drops)-1].ChainLink.Seq
+	for len(apiclient.telemetryDrops) > 0 && apiclient.telemetryDrops[0].ChainLink.Seq <= last {
+		apiclient.telemetryDrops = apiclient.telemetryDrops[1:]
+	}
+}
 
-		return apiclient.sendApiRequest("POST", url, networkConnection)
+// flushTelemetrySinks delivers the events the sinks queued, e.g. at the end of the job.
+func (apiclient *ApiClient) flushTelemetrySinks() {
+	for _, sink := range apiclient.Sinks {
+		if pipeline, ok := sink.(*TelemetryPipeline); ok {
+			pipeline.Flush()
+		}
 	}
-	return nil
+}
 
+func (apiclient *ApiClient) closeTelemetrySinks() {
+	for _, sink := range apiclient.Sinks {
+		if err := sink.Close(); err != nil {
+			WriteLog(fmt.Sprintf("Error closing telemetry sink %s: %v", sink.Name(), err))
+		}
+	}
 }
 
 func (apiclient *ApiClient) getSubscriptionStatus(repo string) bool {
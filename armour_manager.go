@@ -29,3 +29,35 @@ func InitArmour(ctx context.Context, conf *armour.Config) error {
 
 	return nil
 }
+
+// CredentialArmour blocks reads of the runner credentials. It is separate from GlobalArmour,
+// so its read block does not apply to the files GlobalArmour protects, e.g. resolv.conf.
+// NOTE: before usage, make sure to nil check
+var CredentialArmour *armour.Armour = nil
+
+func InitCredentialArmour(ctx context.Context, files []string, apiConf *armour.ApiConf) error {
+	if len(files) == 0 {
+		return fmt.Errorf("no runner credentials found")
+	}
+
+	conf := &armour.Config{
+		Pids:             getPidsOfInterest(),
+		Files:            files,
+		EnforceReadBlock: true,
+		ApiConf:          apiConf,
+	}
+
+	CredentialArmour = armour.NewArmour(ctx, conf)
+	err := CredentialArmour.Init()
+	if err != nil {
+		CredentialArmour = nil
+		return err
+	}
+
+	// the runner reads its own credentials
+	if runnerWorkerPID, err := getRunnerWorkerPID(); err == nil {
+		CredentialArmour.SetRunnerWorkerPID(runnerWorkerPID)
+	}
+
+	return nil
+}
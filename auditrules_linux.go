@@ -0,0 +1,136 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/elastic/go-libaudit/v2"
+	"github.com/elastic/go-libaudit/v2/rule"
+	"github.com/pkg/errors"
+)
+
+// auditRulesBackupPath has the rules of the host in auditctl format, they can be loaded with auditctl -R
+// if the agent does not restore them. Changed in tests.
+var auditRulesBackupPath = "/home/agent/audit.rules"
+
+// auditRuleClient is the part of libaudit.AuditClient that manages rules.
+type auditRuleClient interface {
+	GetRules() ([][]byte, error)
+	AddRule(rule []byte) error
+	DeleteRule(rule []byte) error
+}
+
+// snapshotAuditRules saves the rules of the host before the agent changes them.
+func (p *ProcessMonitor) snapshotAuditRules(client auditRuleClient) error {
+	rules, err := client.GetRules()
+	if err != nil {
+		return errors.Wrap(err, "failed to get audit rules")
+	}
+
+	var backup strings.Builder
+	for _, wireFormat := range rules {
+		if commandLine, err := rule.ToCommandLine(wireFormat, false); err == nil {
+			backup.WriteString(commandLine + "\n")
+		}
+	}
+
+	p.mutex.Lock()
+	p.auditRuleSnapshot = rules
+	p.mutex.Unlock()
+
+	if len(rules) > 0 {
+		if err := os.WriteFile(auditRulesBackupPath, []byte(backup.String()), 0600); err != nil {
+			WriteLog(fmt.Sprintf("failed to back up audit rules %v", err))
+		}
+	}
+
+	return nil
+}
+
+// restoreAuditRules deletes the rules of the agent, which have its key, and adds the rules of the snapshot
+// that are missing, e.g. because they were deleted in exclusive mode.
+func (p *ProcessMonitor) restoreAuditRules(client auditRuleClient) error {
+	rules, err := client.GetRules()
+	if err != nil {
+		return errors.Wrap(err, "failed to get audit rules")
+	}
+
+	var remaining [][]byte
+	for _, wireFormat := range rules {
+		if isAgentAuditRule(wireFormat) {
+			if err := client.DeleteRule(wireFormat); err != nil {
+				return errors.Wrap(err, "failed to delete audit rule")
+			}
+			continue
+		}
+		remaining = append(remaining, wireFormat)
+	}
+
+	p.mutex.RLock()
+	snapshot := p.auditRuleSnapshot
+	p.mutex.RUnlock()
+
+	restored := 0
+	for _, wireFormat := range snapshot {
+		found := false
+		for _, existing := range remaining {
+			if bytes.Equal(existing, wireFormat) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			if err := client.AddRule(wireFormat); err != nil {
+				return errors.Wrap(err, "failed to restore audit rule")
+			}
+			restored++
+		}
+	}
+
+	WriteLog(fmt.Sprintf("audit rules reverted, %d rules of the host restored", restored))
+	return nil
+}
+
+// isAgentAuditRule returns if a rule was added by the agent, its key starts with agentAuditKeyPrefix.
+func isAgentAuditRule(wireFormat []byte) bool {
+	commandLine, err := rule.ToCommandLine(wireFormat, false)
+	if err != nil {
+		return false
+	}
+
+	arguments := strings.Fields(commandLine)
+	for i, argument := range arguments {
+		key := ""
+		if argument == "-k" && i+1 < len(arguments) {
+			key = arguments[i+1]
+		} else if value, found := strings.CutPrefix(argument, "key="); found {
+			key = value
+		}
+		if strings.HasPrefix(key, agentAuditKeyPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RevertAuditRules removes the audit rules of the agent and restores those of the host.
+func (p *ProcessMonitor) RevertAuditRules() error {
+	client, err := libaudit.NewAuditClient(nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create audit client")
+	}
+	defer client.Close()
+
+	return p.restoreAuditRules(client)
+}
+
+// auditdRunning returns if another process, e.g. auditd, receives the audit events.
+func auditdRunning(status *libaudit.AuditStatus) bool {
+	return status != nil && status.PID != 0 && int(status.PID) != os.Getpid() && processExists(fmt.Sprint(status.PID))
+}
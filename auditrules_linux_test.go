@@ -0,0 +1,127 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elastic/go-libaudit/v2/rule"
+	"github.com/elastic/go-libaudit/v2/rule/flags"
+)
+
+// fakeAuditRuleClient keeps rules like the kernel.
+type fakeAuditRuleClient struct {
+	rules [][]byte
+}
+
+func (client *fakeAuditRuleClient) GetRules() ([][]byte, error) {
+	return append([][]byte{}, client.rules...), nil
+}
+
+func (client *fakeAuditRuleClient) AddRule(wireFormat []byte) error {
+	client.rules = append(client.rules, wireFormat)
+	return nil
+}
+
+func (client *fakeAuditRuleClient) DeleteRule(wireFormat []byte) error {
+	for i, existing := range client.rules {
+		if bytes.Equal(existing, wireFormat) {
+			client.rules = append(client.rules[:i], client.rules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("rule not found")
+}
+
+func buildAuditRule(t *testing.T, commandLine string) []byte {
+	r, err := flags.Parse(commandLine)
+	if err != nil {
+		t.Fatalf("flags.Parse(%q) error = %v", commandLine, err)
+	}
+	wireFormat, err := rule.Build(r)
+	if err != nil {
+		t.Fatalf("rule.Build(%q) error = %v", commandLine, err)
+	}
+	return wireFormat
+}
+
+func Test_isAgentAuditRule(t *testing.T) {
+	tests := []struct {
+		commandLine string
+		want        bool
+	}{
+		{commandLine: fmt.Sprintf("-a exit,always -S connect -k %s", auditKey(netMonitorTag)), want: true},
+		{commandLine: fmt.Sprintf("-w /home/agent -p w -k %s", auditKey(fileMonitorTag)), want: true},
+		{commandLine: "-a exit,always -S execve -k exec"},
+		{commandLine: "-w /etc/passwd -p wa -k identity"},
+		{commandLine: "-a exit,always -S unlink"},
+	}
+
+	for _, tt := range tests {
+		if got := isAgentAuditRule(buildAuditRule(t, tt.commandLine)); got != tt.want {
+			t.Errorf("isAgentAuditRule(%q) = %v, want %v", tt.commandLine, got, tt.want)
+		}
+	}
+}
+
+func TestProcessMonitor_restoreAuditRules(t *testing.T) {
+	defer func(path string) { auditRulesBackupPath = path }(auditRulesBackupPath)
+	auditRulesBackupPath = filepath.Join(t.TempDir(), "audit.rules")
+
+	hostRules := [][]byte{
+		buildAuditRule(t, "-w /etc/passwd -p wa -k identity"),
+		buildAuditRule(t, "-a exit,always -S execve -k exec"),
+	}
+	agentRules := [][]byte{
+		buildAuditRule(t, fmt.Sprintf("-a exit,always -S connect -k %s", auditKey(netMonitorTag))),
+		buildAuditRule(t, fmt.Sprintf("-a exit,always -S execve -k %s", auditKey(processMonitorTag))),
+	}
+
+	tests := []struct {
+		name      string
+		auditMode string
+	}{
+		{name: "exclusive", auditMode: AuditModeExclusive},
+		{name: "coexist", auditMode: AuditModeCoexist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeAuditRuleClient{rules: append([][]byte{}, hostRules...)}
+			processMonitor := &ProcessMonitor{AuditMode: tt.auditMode}
+
+			if err := processMonitor.snapshotAuditRules(client); err != nil {
+				t.Fatalf("snapshotAuditRules() error = %v", err)
+			}
+
+			// the process monitor deletes the rules of the host in exclusive mode only
+			if tt.auditMode == AuditModeExclusive {
+				client.rules = nil
+			}
+			client.rules = append(client.rules, agentRules...)
+
+			if err := processMonitor.restoreAuditRules(client); err != nil {
+				t.Fatalf("restoreAuditRules() error = %v", err)
+			}
+
+			if len(client.rules) != len(hostRules) {
+				t.Fatalf("expected %d rules of the host, got %d", len(hostRules), len(client.rules))
+			}
+			for i := range hostRules {
+				if !bytes.Equal(client.rules[i], hostRules[i]) {
+					t.Fatalf("expected rule %d of the host to be restored", i)
+				}
+			}
+
+			backup, _ := os.ReadFile(auditRulesBackupPath)
+			if !bytes.Contains(backup, []byte("-k identity")) {
+				t.Fatalf("expected rules of the host in the backup, got %s", backup)
+			}
+		})
+	}
+}
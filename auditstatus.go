@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditBacklogLimit = 8192
+	auditStatusInterval      = 10 * time.Second
+	// parse errors are logged for the first records only, a malformed stream would flood the log
+	maxLoggedAuditParseErrors = 10
+)
+
+// auditHealth tracks the events the kernel dropped since the process monitor started, when the backlog
+// overflows or the rate limit is hit, and the records the process monitor could not read.
+type auditHealth struct {
+	initialized   bool
+	baseline      uint32 // lost count of the kernel when monitoring started, it counts since boot
+	lost          uint32
+	annotated     bool
+	backlogWarned bool
+	parseErrors   uint64
+	mutex         sync.Mutex
+}
+
+// AuditHealthStats are the counters of the audit stream of a ProcessMonitor.
+type AuditHealthStats struct {
+	Lost        uint32
+	ParseErrors uint64
+}
+
+// reportAuditStatus logs when the kernel lost more events since the last status, and annotates the first loss
+// as telemetry of the job is incomplete from then on. It also warns once when the backlog nears its limit.
+func (p *ProcessMonitor) reportAuditStatus(lost, backlog, backlogLimit uint32) {
+	health := &p.auditHealth
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if !health.initialized || lost < health.baseline+health.lost {
+		// the first status, or the counter was reset
+		health.initialized = true
+		health.baseline = lost - health.lost
+		return
+	}
+
+	if newlyLost := lost - health.baseline - health.lost; newlyLost > 0 {
+		health.lost += newlyLost
+		WriteLog(fmt.Sprintf("audit lost %d events, %d in total, backlog: %d/%d", newlyLost, health.lost, backlog, backlogLimit))
+
+		if !health.annotated {
+			health.annotated = true
+			WriteAnnotation(fmt.Sprintf("%s Kernel audit events were dropped, process, file and network telemetry may be incomplete", StepSecurityAnnotationPrefix))
+		}
+	}
+
+	if backlogLimit > 0 && backlog >= backlogLimit/10*9 {
+		if !health.backlogWarned {
+			health.backlogWarned = true
+			WriteLog(fmt.Sprintf("audit backlog is almost full: %d/%d", backlog, backlogLimit))
+		}
+	} else {
+		health.backlogWarned = false
+	}
+}
+
+// recordParseError counts a record the process monitor could not parse, monitoring continues with the next one.
+func (p *ProcessMonitor) recordParseError(err error) {
+	health := &p.auditHealth
+	health.mutex.Lock()
+	health.parseErrors++
+	parseErrors := health.parseErrors
+	health.mutex.Unlock()
+
+	if parseErrors <= maxLoggedAuditParseErrors {
+		WriteLog(fmt.Sprintf("failed to parse audit record %v", err))
+	}
+}
+
+func (p *ProcessMonitor) AuditHealthStats() AuditHealthStats {
+	health := &p.auditHealth
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	return AuditHealthStats{Lost: health.lost, ParseErrors: health.parseErrors}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestProcessMonitor_reportAuditStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		lost          []uint32
+		expectedLost  uint32
+		expectedNoted bool
+	}{
+		{name: "no loss", lost: []uint32{0, 0, 0}},
+		{name: "lost before monitoring", lost: []uint32{500, 500}},
+		{name: "lost while monitoring", lost: []uint32{500, 520, 600}, expectedLost: 100, expectedNoted: true},
+		{name: "counter reset", lost: []uint32{500, 520, 10, 15}, expectedLost: 25, expectedNoted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			processMonitor := &ProcessMonitor{}
+			for _, lost := range tt.lost {
+				processMonitor.reportAuditStatus(lost, 0, defaultAuditBacklogLimit)
+			}
+
+			if stats := processMonitor.AuditHealthStats(); stats.Lost != tt.expectedLost {
+				t.Fatalf("expected %d lost events, got %d", tt.expectedLost, stats.Lost)
+			}
+			if processMonitor.auditHealth.annotated != tt.expectedNoted {
+				t.Fatalf("expected annotated %v", tt.expectedNoted)
+			}
+		})
+	}
+}
+
+func TestProcessMonitor_reportAuditStatus_Backlog(t *testing.T) {
+	processMonitor := &ProcessMonitor{}
+
+	for _, backlog := range []uint32{100, 8000, 8100} {
+		processMonitor.reportAuditStatus(0, backlog, defaultAuditBacklogLimit)
+	}
+	if !processMonitor.auditHealth.backlogWarned {
+		t.Fatalf("expected a warning when the backlog is almost full")
+	}
+
+	processMonitor.reportAuditStatus(0, 100, defaultAuditBacklogLimit)
+	if processMonitor.auditHealth.backlogWarned {
+		t.Fatalf("expected the warning to be reset when the backlog drains")
+	}
+}
+
+func TestProcessMonitor_recordParseError(t *testing.T) {
+	processMonitor := &ProcessMonitor{}
+
+	for i := 0; i < 2*maxLoggedAuditParseErrors; i++ {
+		processMonitor.recordParseError(fmt.Errorf("invalid record"))
+	}
+
+	if stats := processMonitor.AuditHealthStats(); stats.ParseErrors != 2*maxLoggedAuditParseErrors {
+		t.Fatalf("expected %d parse errors, got %d", 2*maxLoggedAuditParseErrors, stats.ParseErrors)
+	}
+}
@@ -0,0 +1,115 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/elastic/go-libaudit/v2"
+	"github.com/elastic/go-libaudit/v2/auparse"
+	"github.com/pkg/errors"
+)
+
+// AuditReceiver is the source of raw audit records, the kernel or a recorded stream.
+type AuditReceiver interface {
+	Receive(nonBlocking bool) (*libaudit.RawAuditMessage, error)
+}
+
+// auditRecorder writes the records it receives to a file in the log format of auditd, e.g.
+// "type=SYSCALL msg=audit(1700000000.100:100): ...", so the stream can be replayed with auditReplayer.
+type auditRecorder struct {
+	AuditReceiver
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func newAuditRecorder(receiver AuditReceiver, path string) (*auditRecorder, error) {
+	// the records have the arguments of every process, which can have secrets
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open audit record file")
+	}
+	// an existing file keeps its mode
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "failed to set mode of audit record file")
+	}
+
+	return &auditRecorder{AuditReceiver: receiver, file: file}, nil
+}
+
+func (recorder *auditRecorder) Receive(nonBlocking bool) (*libaudit.RawAuditMessage, error) {
+	message, err := recorder.AuditReceiver.Receive(nonBlocking)
+	if err != nil {
+		return message, err
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	data := strings.TrimRight(string(message.Data), "\x00\n")
+	if _, err := fmt.Fprintf(recorder.file, "type=%s msg=%s\n", message.Type, data); err != nil {
+		WriteLog(fmt.Sprintf("failed to record audit message %v", err))
+	}
+
+	return message, nil
+}
+
+func (recorder *auditRecorder) Close() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	return recorder.file.Close()
+}
+
+// auditReplayer returns the records of a file written by auditRecorder, or an auditd log, and then io.EOF.
+// Empty lines and lines starting with # are skipped.
+type auditReplayer struct {
+	file    *os.File
+	scanner *bufio.Scanner
+}
+
+func newAuditReplayer(path string) (*auditReplayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open audit record file")
+	}
+
+	return &auditReplayer{file: file, scanner: bufio.NewScanner(file)}, nil
+}
+
+func (replayer *auditReplayer) Receive(nonBlocking bool) (*libaudit.RawAuditMessage, error) {
+	for replayer.scanner.Scan() {
+		line := strings.TrimSpace(replayer.scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		typeName, data, found := strings.Cut(strings.TrimPrefix(line, "type="), " msg=")
+		if !found {
+			return nil, errors.Errorf("invalid audit record %q", line)
+		}
+
+		recordType, err := auparse.GetAuditMessageType(typeName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid audit record type %q", typeName)
+		}
+
+		return &libaudit.RawAuditMessage{Type: recordType, Data: []byte(data)}, nil
+	}
+
+	if err := replayer.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (replayer *auditReplayer) Close() error {
+	return replayer.file.Close()
+}
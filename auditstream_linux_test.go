@@ -0,0 +1,230 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// replayAuditStream replays a recorded audit stream through the process monitor and returns the event handler
+// and the network connections it reported. setup configures the event handler before the replay.
+func replayAuditStream(t *testing.T, path string, setup ...func(*EventHandler)) (*EventHandler, []NetworkConnection) {
+	replayer, err := newAuditReplayer(path)
+	if err != nil {
+		t.Fatalf("newAuditReplayer() error = %v", err)
+	}
+	defer replayer.Close()
+
+	telemetryPath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+	fileSink, err := NewFileTelemetrySink(telemetryPath)
+	if err != nil {
+		t.Fatalf("NewFileTelemetrySink() error = %v", err)
+	}
+	apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{fileSink}}
+	dnsProxy := &DNSProxy{ReverseIPLookup: make(map[string]string)}
+	eventHandler := NewEventHandler("123", "owner/repo", apiclient, dnsProxy)
+	for _, f := range setup {
+		f(eventHandler)
+	}
+	processMonitor := &ProcessMonitor{CorrelationId: "123", Repo: "owner/repo", ApiClient: apiclient, EventHandler: eventHandler}
+
+	if err := processMonitor.receive(replayer); errors.Cause(err) != io.EOF {
+		t.Fatalf("receive() error = %v", err)
+	}
+	processMonitor.pending.Wait()
+	apiclient.closeTelemetrySinks()
+
+	if stats := processMonitor.AuditHealthStats(); stats.ParseErrors != 0 {
+		t.Fatalf("expected no parse errors, got %d", stats.ParseErrors)
+	}
+
+	data, _ := os.ReadFile(telemetryPath)
+	var connections []NetworkConnection
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var event struct {
+			Type string            `json:"type"`
+			Data NetworkConnection `json:"data"`
+		}
+		if json.Unmarshal(line, &event) == nil && event.Type == telemetryTypeNetworkConnection {
+			connections = append(connections, event.Data)
+		}
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].IPAddress < connections[j].IPAddress })
+
+	return eventHandler, connections
+}
+
+func TestProcessMonitor_Replay(t *testing.T) {
+	type connection struct {
+		ipAddress string
+		port      string
+		tool      string
+	}
+
+	tests := []struct {
+		name        string
+		stream      string
+		processes   map[string][]string
+		connections []connection
+	}{
+		{
+			name:   "npm install",
+			stream: "npm-install.log",
+			processes: map[string][]string{
+				"3900100": {"node", "/usr/local/bin/npm", "install"},
+				"3900101": {"sh", "-c", "node install.js"},
+				"3900102": {"node", "install.js"},
+			},
+			// DNS to the local resolver is not reported
+			connections: []connection{
+				{ipAddress: "104.16.1.34", port: "443", tool: "node"},
+				{ipAddress: "45.33.32.156", port: "8080", tool: "node"},
+			},
+		},
+		{
+			name:   "docker build",
+			stream: "docker-build.log",
+			processes: map[string][]string{
+				"3900200": {"docker", "build", "-t", "app", "."},
+				"3900210": {"/bin/sh", "-c", "apk add curl"},
+				"3900211": {"apk", "add", "curl"},
+			},
+			// the docker socket is not a network connection
+			connections: []connection{
+				{ipAddress: "151.101.2.132", port: "443", tool: "apk"},
+				{ipAddress: "54.227.20.253", port: "443", tool: "dockerd"},
+			},
+		},
+		{
+			name:      "source overwrite",
+			stream:    "source-overwrite.log",
+			processes: map[string][]string{},
+		},
+		{
+			// recorded from the kernel, the others are written by hand
+			name:   "captured git commit and sed",
+			stream: "captured-git-sed.log",
+			processes: map[string][]string{
+				"31956": {"sh", "-c", "cd /home/runner/work/repo/repo && printf 'package main\\n' > src/main.go && git init -q && git add . && git -c user.name=runner -c user.email=runner@example.com commit -qm init && sed -i s/main/app/ src/main.go"},
+				"31957": {"git", "init", "-q"},
+				"31958": {"git", "add", "."},
+				"31959": {"git", "-c", "user.name=runner", "-c", "user.email=runner@example.com", "commit", "-qm", "init"},
+				"31961": {"/usr/lib/git-core/git", "maintenance", "run", "--auto", "--quiet"},
+				"31962": {"sed", "-i", "s/main/app/", "src/main.go"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eventHandler, connections := replayAuditStream(t, filepath.Join("testfiles", "audit", tt.stream))
+
+			if len(eventHandler.ProcessMap) != len(tt.processes) {
+				t.Fatalf("expected %d processes, got %d", len(tt.processes), len(eventHandler.ProcessMap))
+			}
+			for pid, arguments := range tt.processes {
+				process, found := eventHandler.ProcessMap[pid]
+				if !found || len(process.Arguments) != len(arguments) {
+					t.Fatalf("expected process %s with arguments %v, got %+v", pid, arguments, process)
+				}
+				for i := range arguments {
+					if process.Arguments[i] != arguments[i] {
+						t.Fatalf("expected process %s with arguments %v, got %v", pid, arguments, process.Arguments)
+					}
+				}
+			}
+
+			if len(connections) != len(tt.connections) {
+				t.Fatalf("expected %d connections, got %+v", len(tt.connections), connections)
+			}
+			for i, expected := range tt.connections {
+				if connections[i].IPAddress != expected.ipAddress || connections[i].Port != expected.port || connections[i].Tool.Name != expected.tool {
+					t.Fatalf("expected connection %+v, got %+v", expected, connections[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProcessMonitor_Replay_SourceOverwrite(t *testing.T) {
+	eventHandler, _ := replayAuditStream(t, filepath.Join("testfiles", "audit", "source-overwrite.log"), func(eventHandler *EventHandler) {
+		eventHandler.Integrity = &IntegrityMonitor{WorkingDirectory: "/home/runner/work/repo/repo", EventHandler: eventHandler}
+	})
+
+	// git, sed and python wrote the file, in whichever order the events were handled one of them is the last writer
+	writer, found := eventHandler.Integrity.writers["src/main.go"]
+	if !found {
+		t.Fatalf("expected a writer of src/main.go, got %v", eventHandler.Integrity.writers)
+	}
+	switch writer.Exe {
+	case "/usr/bin/git", "/usr/bin/sed", "/usr/bin/python3.10":
+	default:
+		t.Fatalf("unexpected writer %s", writer.Exe)
+	}
+}
+
+func TestAuditRecorder(t *testing.T) {
+	source := filepath.Join("testfiles", "audit", "npm-install.log")
+	replayer, err := newAuditReplayer(source)
+	if err != nil {
+		t.Fatalf("newAuditReplayer() error = %v", err)
+	}
+	defer replayer.Close()
+
+	recordPath := filepath.Join(t.TempDir(), "audit.log")
+	recorder, err := newAuditRecorder(replayer, recordPath)
+	if err != nil {
+		t.Fatalf("newAuditRecorder() error = %v", err)
+	}
+
+	received := 0
+	for {
+		if _, err := recorder.Receive(false); err != nil {
+			if err != io.EOF {
+				t.Fatalf("Receive() error = %v", err)
+			}
+			break
+		}
+		received++
+	}
+	recorder.Close()
+
+	info, err := os.Stat(recordPath)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the recording to be readable by its owner only, got %v, %v", info, err)
+	}
+
+	// the recording replays to the same records
+	rereplayer, err := newAuditReplayer(recordPath)
+	if err != nil {
+		t.Fatalf("newAuditReplayer() error = %v", err)
+	}
+	defer rereplayer.Close()
+
+	expected, _ := newAuditReplayer(source)
+	defer expected.Close()
+
+	for i := 0; i < received; i++ {
+		recorded, err := rereplayer.Receive(false)
+		if err != nil {
+			t.Fatalf("Receive() error = %v", err)
+		}
+		original, _ := expected.Receive(false)
+		if recorded.Type != original.Type || string(recorded.Data) != string(original.Data) {
+			t.Fatalf("expected record %s %s, got %s %s", original.Type, original.Data, recorded.Type, recorded.Data)
+		}
+	}
+	if _, err := rereplayer.Receive(false); err != io.EOF {
+		t.Fatalf("expected %d records, got more", received)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
@@ -25,6 +26,28 @@ type config struct {
 	DisableSudoAndContainers bool
 	DisableFileMonitoring    bool
 	Private                  bool
+	TelemetrySinks           []TelemetrySinkConfig
+	TelemetryPipeline        TelemetryPipelineConfig
+	Proxy                    redactedURL
+	NoProxy                  string
+	CABundlePath             string
+	TLSPins                  map[string][]string
+	ClientCertPath           string
+	ClientKeyPath            string
+	EnforceSNI               bool
+	EgressUploadThreshold    uint64
+	EgressLimits             *EgressLimits
+	FlowCacheWindow          time.Duration
+	ICMPPolicy               string
+	AuditBacklogLimit        uint32
+	AuditRateLimit           uint32
+	AuditRecordPath          string
+	AuditMode                string
+	ProcessMonitorBackend    string
+	FileWatches              []FileWatch
+	BlockCredentialAccess    bool
+	RunnerTemp               string
+	AnnotateSourceIntegrity  bool
 }
 
 type Endpoint struct {
@@ -33,20 +56,42 @@ type Endpoint struct {
 }
 
 type configFile struct {
-	Repo                     string `json:"repo"`
-	CorrelationId            string `json:"correlation_id"`
-	RunId                    string `json:"run_id"`
-	WorkingDirectory         string `json:"working_directory"`
-	APIURL                   string `json:"api_url"`
-	TelemetryURL             string `json:"telemetry_url"`
-	OneTimeKey               string `json:"one_time_key"`
-	AllowedEndpoints         string `json:"allowed_endpoints"`
-	EgressPolicy             string `json:"egress_policy"`
-	DisableTelemetry         bool   `json:"disable_telemetry"`
-	DisableSudo              bool   `json:"disable_sudo"`
-	DisableSudoAndContainers bool   `json:"disable_sudo_and_containers"`
-	DisableFileMonitoring    bool   `json:"disable_file_monitoring"`
-	Private                  bool   `json:"private"`
+	Repo                     string                  `json:"repo"`
+	CorrelationId            string                  `json:"correlation_id"`
+	RunId                    string                  `json:"run_id"`
+	WorkingDirectory         string                  `json:"working_directory"`
+	APIURL                   string                  `json:"api_url"`
+	TelemetryURL             string                  `json:"telemetry_url"`
+	OneTimeKey               string                  `json:"one_time_key"`
+	AllowedEndpoints         string                  `json:"allowed_endpoints"`
+	EgressPolicy             string                  `json:"egress_policy"`
+	DisableTelemetry         bool                    `json:"disable_telemetry"`
+	DisableSudo              bool                    `json:"disable_sudo"`
+	DisableSudoAndContainers bool                    `json:"disable_sudo_and_containers"`
+	DisableFileMonitoring    bool                    `json:"disable_file_monitoring"`
+	Private                  bool                    `json:"private"`
+	TelemetrySinks           []TelemetrySinkConfig   `json:"telemetry_sinks"`
+	TelemetryPipeline        TelemetryPipelineConfig `json:"telemetry_pipeline"`
+	Proxy                    string                  `json:"proxy"`
+	NoProxy                  string                  `json:"no_proxy"`
+	CABundlePath             string                  `json:"ca_bundle_path"`
+	TLSPins                  map[string][]string     `json:"tls_pins"`
+	ClientCertPath           string                  `json:"client_cert_path"`
+	ClientKeyPath            string                  `json:"client_key_path"`
+	EnforceSNI               bool                    `json:"enforce_sni"`
+	EgressUploadThreshold    uint64                  `json:"egress_upload_threshold"`
+	EgressLimits             *EgressLimits           `json:"egress_limits"`
+	FlowCacheWindowSeconds   int                     `json:"flow_cache_window_seconds"`
+	ICMPPolicy               string                  `json:"icmp_policy"`
+	AuditBacklogLimit        uint32                  `json:"audit_backlog_limit"`
+	AuditRateLimit           uint32                  `json:"audit_rate_limit"`
+	AuditRecordPath          string                  `json:"audit_record_path"`
+	AuditMode                string                  `json:"audit_mode"`
+	ProcessMonitorBackend    string                  `json:"process_monitor_backend"`
+	FileWatches              []FileWatch             `json:"file_watches"`
+	BlockCredentialAccess    bool                    `json:"block_credential_access"` // needs Armour
+	RunnerTemp               string                  `json:"runner_temp"`
+	AnnotateSourceIntegrity  bool                    `json:"annotate_source_integrity"`
 }
 
 // init reads the config file for the agent and initializes config settings
@@ -79,6 +124,40 @@ func (c *config) init(configFilePath string) error {
 	c.DisableFileMonitoring = configFile.DisableFileMonitoring
 	c.Private = configFile.Private
 	c.OneTimeKey = configFile.OneTimeKey
+	c.TelemetrySinks = configFile.TelemetrySinks
+	c.TelemetryPipeline = configFile.TelemetryPipeline
+	c.Proxy = redactedURL(configFile.Proxy)
+	c.NoProxy = configFile.NoProxy
+	c.CABundlePath = configFile.CABundlePath
+	c.TLSPins = configFile.TLSPins
+	c.ClientCertPath = configFile.ClientCertPath
+	c.ClientKeyPath = configFile.ClientKeyPath
+	c.EnforceSNI = configFile.EnforceSNI
+	c.EgressUploadThreshold = configFile.EgressUploadThreshold
+	c.EgressLimits = configFile.EgressLimits
+	c.FlowCacheWindow = time.Duration(configFile.FlowCacheWindowSeconds) * time.Second
+	c.ICMPPolicy = configFile.ICMPPolicy
+	if c.ICMPPolicy != ICMPPolicyAllow {
+		c.ICMPPolicy = ICMPPolicyBlock
+	}
+	c.AuditBacklogLimit = configFile.AuditBacklogLimit
+	c.AuditRateLimit = configFile.AuditRateLimit
+	c.AuditRecordPath = configFile.AuditRecordPath
+	c.AuditMode = configFile.AuditMode
+	if c.AuditMode != AuditModeCoexist && c.AuditMode != AuditModeMulticast {
+		c.AuditMode = AuditModeExclusive
+	}
+	c.ProcessMonitorBackend = configFile.ProcessMonitorBackend
+	if c.ProcessMonitorBackend != ProcessMonitorBackendEBPF {
+		c.ProcessMonitorBackend = ProcessMonitorBackendAudit
+	}
+	c.FileWatches = configFile.FileWatches
+	c.BlockCredentialAccess = configFile.BlockCredentialAccess
+	c.RunnerTemp = configFile.RunnerTemp
+	c.AnnotateSourceIntegrity = configFile.AnnotateSourceIntegrity
+	if c.ClientKeyPath == "" {
+		c.ClientKeyPath = c.ClientCertPath
+	}
 	return nil
 }
 
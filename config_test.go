@@ -25,6 +25,11 @@ func Test_config_init(t *testing.T) {
 				configFilePath: "./testfiles/agent.json",
 			},
 			wantErr: false},
+		{name: "valid config with telemetry sinks",
+			args: args{
+				configFilePath: "./testfiles/agent-telemetry-sinks.json",
+			},
+			wantErr: false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
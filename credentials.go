@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const defaultRunnerHomeDirectory = "/home/runner"
+
+// interpreters run scripts that are the actual tools, e.g. npm is npm-cli.js run by node
+var interpreters = map[string]bool{"node": true, "python": true, "python3": true, "ruby": true, "perl": true}
+
+// credentialFile is a file or directory with credentials on the runner. Reads of it are reported,
+// and annotated if the reading process is not one of AllowedTools.
+type credentialFile struct {
+	Path         string
+	AllowedTools []string // names of exes or of scripts run by an interpreter, patterns of filepath.Match
+	runnerOnly   bool     // only the runner reads it, so Armour can block everyone else
+}
+
+// runnerHome returns the home directory of the user the runner runs as, which is not
+// /home/runner on self-hosted runners.
+func runnerHome(runnerWorkerPid string) string {
+	if runnerWorkerPid == "" {
+		return defaultRunnerHomeDirectory
+	}
+	uid, err := getProcessUID(runnerWorkerPid)
+	if err != nil {
+		return defaultRunnerHomeDirectory
+	}
+	u, err := user.LookupId(uid)
+	if err != nil || u.HomeDir == "" {
+		return defaultRunnerHomeDirectory
+	}
+	return u.HomeDir
+}
+
+// credentialFiles returns the built-in list of credential files, those of the runner are found
+// next to the Runner.Worker executable if runnerWorkerPid is set.
+func credentialFiles(home, runnerWorkerPid string) []credentialFile {
+	files := []credentialFile{
+		{Path: filepath.Join(home, ".ssh"), AllowedTools: []string{"ssh", "scp", "sftp", "ssh-add", "ssh-agent", "ssh-keygen", "ssh-keyscan"}},
+		{Path: filepath.Join(home, ".docker", "config.json"), AllowedTools: []string{"docker", "docker-buildx", "docker-compose", "docker-credential-*"}},
+		{Path: filepath.Join(home, ".npmrc"), AllowedTools: []string{"npm", "npm-cli.js", "npx", "npx-cli.js", "yarn", "yarn.js", "yarn.cjs", "pnpm", "pnpm.cjs"}},
+		{Path: filepath.Join(home, ".aws", "credentials"), AllowedTools: []string{"aws"}},
+	}
+
+	if runnerWorkerPid == "" {
+		return files
+	}
+
+	runnerTools := []string{"Runner.Listener", "Runner.Worker"}
+
+	// the executable is in the bin directory of the runner
+	if exe, err := getProcessExe(runnerWorkerPid); err == nil {
+		runnerRoot := filepath.Dir(filepath.Dir(exe))
+		for _, name := range []string{".credentials", ".credentials_rsaparams"} {
+			files = append(files, credentialFile{Path: filepath.Join(runnerRoot, name), AllowedTools: runnerTools, runnerOnly: true})
+		}
+	}
+
+	files = append(files, credentialFile{Path: fmt.Sprintf("/proc/%s/environ", runnerWorkerPid), AllowedTools: runnerTools, runnerOnly: true})
+
+	return files
+}
+
+// credentialAccessRules are the audit rules for reads of files, reads by the agent are not audited.
+func credentialAccessRules(files []credentialFile, agentPid int) []string {
+	var rules []string
+	for _, file := range files {
+		field := "path"
+		if info, err := os.Stat(file.Path); err == nil && info.IsDir() {
+			field = "dir"
+		}
+		rules = append(rules, fmt.Sprintf("-a always,exit -F %s=%s -F perm=r -F pid!=%d -k %s", field, file.Path, agentPid, auditKey(credentialMonitorTag)))
+	}
+	return rules
+}
+
+// blockedCredentialFiles are the files Armour can block reads of, only the runner reads them.
+// Other credential files are read by allowed tools that Armour does not know of, they are only reported.
+func blockedCredentialFiles(files []credentialFile) []string {
+	var blocked []string
+	for _, file := range files {
+		if file.runnerOnly {
+			blocked = append(blocked, file.Path)
+		}
+	}
+	return blocked
+}
+
+// findCredentialFile returns the credential file of fileName, which is the file or in the directory.
+func findCredentialFile(files []credentialFile, fileName string) (credentialFile, bool) {
+	for _, file := range files {
+		if fileName == file.Path || strings.HasPrefix(fileName, file.Path+"/") {
+			return file, true
+		}
+	}
+	return credentialFile{}, false
+}
+
+// isAllowed returns if the reading process is an allowed tool. It has to be the tool itself, a process
+// started by the tool is not allowed, e.g. a postinstall script is node started by npm.
+func (file credentialFile) isAllowed(names []string) bool {
+	for _, allowedTool := range file.AllowedTools {
+		for _, name := range names {
+			if matched, _ := filepath.Match(allowedTool, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// processNames returns the name of the exe of a process and, if it is an interpreter, the name of the script it runs.
+func (eventHandler *EventHandler) processNames(pid, exe string) []string {
+	names := []string{filepath.Base(exe)}
+	if !interpreters[names[0]] {
+		return names
+	}
+
+	eventHandler.procMutex.RLock()
+	process, found := eventHandler.ProcessMap[pid]
+	var arguments []string
+	// a process that execs another exe keeps the arguments of the first one
+	found = found && process.Exe == exe
+	if found {
+		arguments = process.Arguments
+	}
+	eventHandler.procMutex.RUnlock()
+
+	if !found {
+		arguments, _ = getProcessArguments(pid)
+	}
+
+	// the first argument that is not an option of the interpreter
+	for i := 1; i < len(arguments); i++ {
+		if !strings.HasPrefix(arguments[i], "-") {
+			return append(names, filepath.Base(arguments[i]))
+		}
+	}
+	return names
+}
+
+// formatToolChain returns the names of tool and its parents, starting with the oldest parent.
+func formatToolChain(tool *Tool) string {
+	var names []string
+	for ; tool != nil; tool = tool.Parent {
+		names = append([]string{tool.Name}, names...)
+	}
+	return strings.Join(names, " > ")
+}
+
+func (eventHandler *EventHandler) handleCredentialAccessEvent(event *Event) {
+	if !strings.HasPrefix(event.FileName, "/") {
+		event.FileName = path.Join(event.Path, event.FileName)
+	}
+
+	file, found := findCredentialFile(eventHandler.CredentialFiles, event.FileName)
+	if !found {
+		return
+	}
+
+	cacheKey := fmt.Sprintf("%s|%s|credential", event.Exe, event.FileName)
+
+	eventHandler.fileMutex.Lock()
+	_, found = eventHandler.ProcessFileMap[cacheKey]
+	if !found && len(eventHandler.ProcessFileMap) < maxWatchedFileReports {
+		eventHandler.ProcessFileMap[cacheKey] = true
+	}
+	eventHandler.fileMutex.Unlock()
+
+	if found {
+		return
+	}
+
+	names := eventHandler.processNames(event.Pid, event.Exe)
+	toolChain := formatToolChain(eventHandler.GetToolChain(event.PPid, event.Exe))
+	allowed := file.isAllowed(names)
+
+	WriteLog(fmt.Sprintf("[Credential file read] file: %s, syscall: %s, exe: %s, pid: %s, tool chain: %s, allowed: %t, result: %s",
+		event.FileName, event.Syscall, event.Exe, event.Pid, toolChain, allowed, event.Status))
+
+	if !allowed {
+		WriteAnnotation(fmt.Sprintf("%s Credential file %s was read by %s (%s)", StepSecurityAnnotationPrefix, event.FileName, strings.Join(names, " "), toolChain))
+	}
+
+	eventHandler.submitFileEvent(event)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/elastic/go-libaudit/v2/rule"
+	"github.com/elastic/go-libaudit/v2/rule/flags"
+)
+
+func Test_credentialAccessRules(t *testing.T) {
+	home := t.TempDir()
+	os.Mkdir(filepath.Join(home, ".ssh"), 0700)
+
+	files := credentialFiles(home, "")
+	rules := credentialAccessRules(files, 42)
+
+	if len(rules) != len(files) {
+		t.Fatalf("expected %d rules, got %v", len(files), rules)
+	}
+	if want := fmt.Sprintf("-a always,exit -F dir=%s/.ssh -F perm=r -F pid!=42 -k stepsecurity-credaccess", home); rules[0] != want {
+		t.Fatalf("expected %s, got %s", want, rules[0])
+	}
+	if want := fmt.Sprintf("-a always,exit -F path=%s/.npmrc -F perm=r -F pid!=42 -k stepsecurity-credaccess", home); rules[2] != want {
+		t.Fatalf("expected %s, got %s", want, rules[2])
+	}
+
+	for _, commandLine := range rules {
+		r, err := flags.Parse(commandLine)
+		if err != nil {
+			t.Fatalf("flags.Parse(%q) error = %v", commandLine, err)
+		}
+		if _, err := rule.Build(r); err != nil {
+			t.Fatalf("rule.Build(%q) error = %v", commandLine, err)
+		}
+	}
+
+	// without the runner only files read by other tools, Armour has nothing to block
+	if blocked := blockedCredentialFiles(files); len(blocked) != 0 {
+		t.Fatalf("expected no blocked files, got %v", blocked)
+	}
+}
+
+func Test_credentialFile_isAllowed(t *testing.T) {
+	files := credentialFiles("/home/runner", "")
+
+	tests := []struct {
+		fileName string
+		names    []string
+		found    bool
+		allowed  bool
+	}{
+		{fileName: "/home/runner/.ssh/id_rsa", names: []string{"ssh"}, found: true, allowed: true},
+		{fileName: "/home/runner/.ssh/id_rsa", names: []string{"curl"}, found: true, allowed: false},
+		{fileName: "/home/runner/.docker/config.json", names: []string{"docker-credential-ecr-login"}, found: true, allowed: true},
+		{fileName: "/home/runner/.aws/credentials", names: []string{"python3", "aws"}, found: true, allowed: true},
+		{fileName: "/home/runner/.aws/credentials", names: []string{"python3", "steal.py"}, found: true, allowed: false},
+		{fileName: "/home/runner/.npmrc", names: []string{"node", "npm"}, found: true, allowed: true},
+		{fileName: "/home/runner/.npmrc", names: []string{"node", "install.js"}, found: true, allowed: false},
+		{fileName: "/home/runner/.npmrc", names: []string{"node"}, found: true, allowed: false},
+		{fileName: "/home/runner/.sshd", names: []string{"cat"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fileName+" "+strings.Join(tt.names, " "), func(t *testing.T) {
+			file, found := findCredentialFile(files, tt.fileName)
+			if found != tt.found {
+				t.Fatalf("findCredentialFile() found = %v, want %v", found, tt.found)
+			}
+			if found && file.isAllowed(tt.names) != tt.allowed {
+				t.Fatalf("isAllowed() = %v, want %v", !tt.allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestEventHandler_processNames(t *testing.T) {
+	eventHandler := NewEventHandler("123", "owner/repo", nil, nil)
+	eventHandler.ProcessMap["39004200"] = &Process{PID: "39004200", Exe: "/usr/local/bin/node", Arguments: []string{"node", "--max-old-space-size=4096", "/usr/local/bin/npm", "ci"}}
+	// npm ran the postinstall script
+	eventHandler.ProcessMap["39004201"] = &Process{PID: "39004201", PPid: "39004200", Exe: "/usr/local/bin/node", Arguments: []string{"node", "install.js"}}
+	eventHandler.ProcessMap["39004202"] = &Process{PID: "39004202", Exe: "/usr/bin/env", Arguments: []string{"/usr/bin/env", "node", "/usr/local/bin/npm"}}
+
+	tests := []struct {
+		pid  string
+		exe  string
+		want []string
+	}{
+		{pid: "39004200", exe: "/usr/local/bin/node", want: []string{"node", "npm"}},
+		{pid: "39004201", exe: "/usr/local/bin/node", want: []string{"node", "install.js"}},
+		{pid: "39004200", exe: "/usr/bin/cat", want: []string{"cat"}},
+		// the process execed node after env, its arguments are not known
+		{pid: "39004202", exe: "/usr/local/bin/node", want: []string{"node"}},
+	}
+
+	for _, tt := range tests {
+		if got := eventHandler.processNames(tt.pid, tt.exe); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("processNames(%s, %s) = %v, want %v", tt.pid, tt.exe, got, tt.want)
+		}
+	}
+}
+
+func TestEventHandler_handleCredentialAccessEvent(t *testing.T) {
+	eventHandler := NewEventHandler("123", "owner/repo", nil, nil)
+	eventHandler.CredentialFiles = credentialFiles("/home/runner", "")
+	eventHandler.ProcessMap["39004100"] = &Process{PID: "39004100", PPid: "39004000", Exe: "/usr/bin/bash"}
+
+	for i := 0; i < 2; i++ {
+		eventHandler.HandleEvent(&Event{EventType: credentialMonitorTag, FileName: ".aws/credentials", Path: "/home/runner", Syscall: "openat",
+			Exe: "/usr/bin/cat", Pid: "39004101", PPid: "39004100"})
+	}
+	eventHandler.HandleEvent(&Event{EventType: credentialMonitorTag, FileName: "/home/runner/work/repo/.npmrc", Path: "/home/runner", Syscall: "openat",
+		Exe: "/usr/bin/cat", Pid: "39004101", PPid: "39004100"})
+
+	// reported once per exe and file, reads of other files with the same name are not credential reads
+	if len(eventHandler.ProcessFileMap) != 1 || !eventHandler.ProcessFileMap["/usr/bin/cat|/home/runner/.aws/credentials|credential"] {
+		t.Fatalf("unexpected reported reads %v", eventHandler.ProcessFileMap)
+	}
+}
+
+func Test_formatToolChain(t *testing.T) {
+	tool := &Tool{Name: "cat", Parent: &Tool{Name: "bash", Parent: &Tool{Name: "Runner.Worker"}}}
+	if got := formatToolChain(tool); got != "Runner.Worker > bash > cat" {
+		t.Fatalf("formatToolChain() = %s", got)
+	}
+}
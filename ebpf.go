@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// kinds of the records the eBPF programs write to the ring buffer
+	ebpfRecordExecArg    = 1 // an argument of an execve, they come before its ebpfRecordExec
+	ebpfRecordExec       = 2 // the file of an execve, Index is the number of arguments
+	ebpfRecordExecResult = 3 // the return value of an execve, with the credentials after it
+	ebpfRecordConnect    = 4
+	ebpfRecordSendto     = 5
+	ebpfRecordSendmsg    = 6
+	ebpfRecordOpen       = 7 // a file opened for writing, relative files come after the records of the working directory
+	ebpfRecordOpenat     = 8
+	ebpfRecordCwd        = 9 // a directory of the working directory, from the working directory up, Index is its depth
+
+	ebpfRecordSize     = 296 // of ebpfRecord
+	ebpfRecordDataSize = 256 // longer arguments and file names are cut
+	ebpfMaxExecArgs    = 32  // arguments after it are not reported
+	atFdCwd            = -100
+	sockaddrMaxSize    = 28 // of sockaddr_in6
+
+	// families of the sockaddrs of linux
+	afInet  = 2
+	afInet6 = 10
+)
+
+// ebpfRecord is a record of the ring buffer, the programs write it in the byte order of the host.
+type ebpfRecord struct {
+	Kind  uint32
+	Pid   uint32 // tgid of the process
+	PPid  uint32
+	Euid  uint32
+	Index uint32
+	Cwd   uint32 // 1 if the working directory records before it are complete
+	Arg0  uint64 // flags of an open, length of a sockaddr or return value of an execve
+	Arg1  uint64 // directory fd of an open
+	Data  [ebpfRecordDataSize]byte
+}
+
+func decodeEBPFRecord(data []byte, record *ebpfRecord) error {
+	return binary.Read(bytes.NewReader(data), binary.NativeEndian, record)
+}
+
+func (record *ebpfRecord) data() string {
+	if end := bytes.IndexByte(record.Data[:], 0); end != -1 {
+		return string(record.Data[:end])
+	}
+	return string(record.Data[:])
+}
+
+// ebpfExec is an execve whose result was not read yet.
+type ebpfExec struct {
+	fileName  string
+	arguments []string
+	cwd       string
+}
+
+// handleEBPFRecord returns the Event of a record, or nil if the record is part of an execve
+// or not reported. It is called from one goroutine only.
+func (p *ProcessMonitor) handleEBPFRecord(record *ebpfRecord) *Event {
+	pid := fmt.Sprint(record.Pid)
+	event := &Event{Pid: pid, PPid: fmt.Sprint(record.PPid), Euid: fmt.Sprint(record.Euid), Timestamp: time.Now().UTC(),
+		SentForProcessing: true}
+
+	switch record.Kind {
+	case ebpfRecordCwd:
+		if record.Index == 0 {
+			// directories of syscalls whose record is lost are dropped
+			if len(p.ebpfCwds) >= maxPendingAuditEvents {
+				p.ebpfCwds = make(map[uint32][]string)
+			}
+			p.ebpfCwds[record.Pid] = nil
+		}
+		p.ebpfCwds[record.Pid] = append(p.ebpfCwds[record.Pid], record.data())
+		return nil
+
+	case ebpfRecordExecArg, ebpfRecordExec:
+		exec, found := p.ebpfExecs[record.Pid]
+		if !found || record.Index == 0 {
+			// execs whose result is lost, e.g. as the process was killed, are dropped
+			if len(p.ebpfExecs) >= maxPendingAuditEvents {
+				p.ebpfExecs = make(map[uint32]*ebpfExec)
+			}
+			exec = &ebpfExec{}
+			p.ebpfExecs[record.Pid] = exec
+		}
+		if record.Kind == ebpfRecordExec {
+			exec.fileName = record.data()
+			exec.cwd = p.ebpfCwd(record)
+		} else if int(record.Index) == len(exec.arguments) {
+			exec.arguments = append(exec.arguments, record.data())
+		}
+		return nil
+
+	case ebpfRecordExecResult:
+		exec, found := p.ebpfExecs[record.Pid]
+		delete(p.ebpfExecs, record.Pid)
+		if !found || int64(record.Arg0) != 0 {
+			return nil
+		}
+
+		event.EventType = processMonitorTag
+		event.Syscall = "execve"
+		event.Status = "success"
+		event.Path = exec.cwd
+		event.ProcessArguments = exec.arguments
+		if len(event.ProcessArguments) == 0 {
+			event.ProcessArguments = []string{exec.fileName}
+		}
+		event.Exe = ebpfExe(pid, exec)
+		return event
+
+	case ebpfRecordConnect, ebpfRecordSendto, ebpfRecordSendmsg:
+		length := record.Arg0
+		if length > sockaddrMaxSize {
+			length = sockaddrMaxSize
+		}
+		ipAddress, port, found := decodeSockaddr(record.Data[:length])
+		if !found {
+			return nil
+		}
+
+		event.EventType = netMonitorTag
+		event.Syscall = map[uint32]string{ebpfRecordConnect: "connect", ebpfRecordSendto: "sendto", ebpfRecordSendmsg: "sendmsg"}[record.Kind]
+		event.IPAddress = ipAddress
+		event.Port = port
+		event.Exe, _ = getProcessExe(pid)
+		event.Path, _ = getProcessCwd(pid)
+		return event
+
+	case ebpfRecordOpen, ebpfRecordOpenat:
+		cwd := p.ebpfCwd(record)
+		fileName := record.data()
+		if !filepath.IsAbs(fileName) {
+			directory := cwd
+			if dfd := int32(record.Arg1); dfd != atFdCwd {
+				directory, _ = getProcessFile(pid, int(dfd))
+			}
+			if directory == "" {
+				return nil
+			}
+			fileName = filepath.Join(directory, fileName)
+		}
+
+		tag, severity, found := p.ebpfFiles.match(filepath.Clean(fileName))
+		if !found {
+			return nil
+		}
+
+		event.EventType = tag
+		event.Severity = severity
+		event.Syscall = map[uint32]string{ebpfRecordOpen: "open", ebpfRecordOpenat: "openat"}[record.Kind]
+		event.FileName = filepath.Clean(fileName)
+		event.Path = cwd
+		event.Exe, _ = getProcessExe(pid)
+		return event
+	}
+
+	return nil
+}
+
+// ebpfCwd returns the working directory of the process of a record from the records of its directories before it,
+// or from proc if they are incomplete.
+func (p *ProcessMonitor) ebpfCwd(record *ebpfRecord) string {
+	directories := p.ebpfCwds[record.Pid]
+	delete(p.ebpfCwds, record.Pid)
+
+	if record.Cwd == 0 {
+		cwd, _ := getProcessCwd(fmt.Sprint(record.Pid))
+		return cwd
+	}
+
+	cwd := "/"
+	for _, directory := range directories {
+		cwd = filepath.Join("/", directory, cwd)
+	}
+	return cwd
+}
+
+// ebpfExe returns the executable of a process after an execve. It is the file of the execve if the process exited.
+func ebpfExe(pid string, exec *ebpfExec) string {
+	if exe, err := getProcessExe(pid); err == nil {
+		return exe
+	}
+	if filepath.IsAbs(exec.fileName) || exec.cwd == "" {
+		return exec.fileName
+	}
+	return filepath.Join(exec.cwd, exec.fileName)
+}
+
+// decodeSockaddr returns the address and port of an IPv4 or IPv6 sockaddr.
+func decodeSockaddr(data []byte) (string, string, bool) {
+	if len(data) < 2 {
+		return "", "", false
+	}
+
+	switch binary.NativeEndian.Uint16(data) {
+	case afInet:
+		if len(data) < 8 {
+			return "", "", false
+		}
+		return net.IP(data[4:8]).String(), fmt.Sprint(binary.BigEndian.Uint16(data[2:4])), true
+	case afInet6:
+		if len(data) < 24 {
+			return "", "", false
+		}
+		return net.IP(data[8:24]).String(), fmt.Sprint(binary.BigEndian.Uint16(data[2:4])), true
+	}
+
+	return "", "", false
+}
+
+// ebpfFileFilter selects the file writes the eBPF backend reports, in the order of the audit rules of the audit backend.
+type ebpfFileFilter struct {
+	fileCommandsDirectory string
+	watches               []FileWatch
+	workingDirectory      string // empty if file monitoring is disabled or the working directory is watched
+	hasAccessWatches      bool   // watches of reads or execs, they are not reported
+}
+
+func (p *ProcessMonitor) newEBPFFileFilter() *ebpfFileFilter {
+	filter := &ebpfFileFilter{fileCommandsDirectory: p.FileCommandsDirectory}
+	if p.DisableFileMonitoring {
+		return filter
+	}
+
+	workingDirectory := p.WorkingDirectory
+	if len(workingDirectory) == 0 {
+		workingDirectory = "/home/runner"
+	}
+
+	if _, err := fileWatchRules(p.FileWatches, workingDirectory); err != nil {
+		WriteLog(fmt.Sprintf("invalid file watches %v", err))
+	} else {
+		filter.watches = p.FileWatches
+	}
+
+	for _, watch := range filter.watches {
+		if strings.ContainsAny(watch.Permissions, "rx") {
+			filter.hasAccessWatches = true
+		}
+	}
+
+	if !hasFileWatch(filter.watches, workingDirectory) {
+		filter.workingDirectory = workingDirectory
+	}
+
+	return filter
+}
+
+// match returns the tag and severity of the events of writes to fileName, or false if they are not reported.
+func (filter *ebpfFileFilter) match(fileName string) (string, string, bool) {
+	if filter == nil {
+		return "", "", false
+	}
+
+	if isInDirectory(fileName, filter.fileCommandsDirectory) {
+		return fileCmdMonitorTag, "", true
+	}
+
+	for _, watch := range filter.watches {
+		path := filepath.Clean(watch.Path)
+		for _, exclude := range watch.Exclude {
+			excludePath := filepath.Clean(exclude)
+			if !filepath.IsAbs(excludePath) {
+				excludePath = filepath.Join(path, exclude)
+			}
+			if isInDirectory(fileName, excludePath) {
+				return "", "", false
+			}
+		}
+	}
+
+	for _, watch := range filter.watches {
+		permissions := watch.Permissions
+		if permissions == "" {
+			permissions = defaultFileWatchPermissions
+		}
+		if keepPermissions(permissions, "wa") != "" && isInDirectory(fileName, filepath.Clean(watch.Path)) {
+			return fileMonitorTag, watch.Severity, true
+		}
+	}
+
+	if isInDirectory(fileName, filter.workingDirectory) || isInDirectory(fileName, "/home/agent") ||
+		fileName == dockerDaemonConfigPath || fileName == resolvedConfigPath {
+		return fileMonitorTag, "", true
+	}
+
+	return "", "", false
+}
+
+// isInDirectory returns if fileName is directory or in it, like the dir field of audit rules.
+func isInDirectory(fileName, directory string) bool {
+	if directory == "" {
+		return false
+	}
+	return fileName == directory || strings.HasPrefix(fileName, strings.TrimSuffix(directory, "/")+"/")
+}
@@ -0,0 +1,745 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/pkg/errors"
+)
+
+const (
+	capSysAdmin = 21
+	capBPF      = 39
+
+	ebpfRingBufferSize = 4 << 20
+	ebpfMaxCwdDepth    = 24 // deeper working directories are read from proc
+
+	// opens with these flags are reported, like the audit rules with perm=w
+	openWriteFlags = syscall.O_WRONLY | syscall.O_RDWR | syscall.O_CREAT | syscall.O_TRUNC
+
+	// the programs build the record on their stack, below it are a scratch slot for pointers and the root of the process
+	ebpfRecordStack     = -ebpfRecordSize
+	ebpfScratchStack    = ebpfRecordStack - 8
+	ebpfRootDentryStack = ebpfScratchStack - 8
+	ebpfRootMountStack  = ebpfRootDentryStack - 8
+)
+
+// btfPath is the BTF of the running kernel, the offsets of the structs the programs read are in it. Changed in tests.
+var btfPath = "/sys/kernel/btf/vmlinux"
+
+// kernelOffsets are the offsets of the fields the programs read from the task of the current process.
+type kernelOffsets struct {
+	realParent    uint32 // task_struct
+	tgid          uint32 // task_struct
+	cred          uint32 // task_struct
+	euid          uint32 // cred
+	fs            uint32 // task_struct
+	root          uint32 // fs_struct
+	pwd           uint32 // fs_struct
+	pathMount     uint32 // path
+	pathDentry    uint32 // path
+	dentryParent  uint32 // dentry
+	dentryName    uint32 // dentry
+	qstrName      uint32 // qstr
+	mountRoot     uint32 // vfsmount
+	mountParent   uint32 // mount
+	mountPoint    uint32 // mount
+	mountVfsmount uint32 // mount, the vfsmount of the mount is embedded in it
+}
+
+// ebpfMonitor has the programs of the eBPF backend attached.
+type ebpfMonitor struct {
+	events *ebpf.Map // ring buffer of ebpfRecords
+	lost   *ebpf.Map // records that did not fit into the ring buffer
+	links  []link.Link
+	reader *ringbuf.Reader
+}
+
+// ebpfReader reads the records of the ring buffer.
+type ebpfReader interface {
+	Read() (ringbuf.Record, error)
+}
+
+// ebpfPrograms are the programs of the eBPF backend and the syscall tracepoints they are attached to.
+var ebpfPrograms = []struct {
+	name     string
+	optional bool // the syscall does not exist on some architectures, e.g. open on arm64
+	program  func(*ebpfProgramBuilder) asm.Instructions
+}{
+	{name: "sys_enter_execve", program: (*ebpfProgramBuilder).execEnter},
+	{name: "sys_exit_execve", program: (*ebpfProgramBuilder).execExit},
+	{name: "sys_enter_connect", program: (*ebpfProgramBuilder).connect},
+	{name: "sys_enter_sendto", program: (*ebpfProgramBuilder).sendto},
+	{name: "sys_enter_sendmsg", program: (*ebpfProgramBuilder).sendmsg},
+	{name: "sys_enter_openat", program: (*ebpfProgramBuilder).openat},
+	{name: "sys_enter_open", optional: true, program: (*ebpfProgramBuilder).open},
+}
+
+// checkEBPFSupport returns why the eBPF backend cannot run on this kernel, or nil. It needs BTF,
+// the BPF ring buffer of kernel 5.8 and CAP_BPF or CAP_SYS_ADMIN.
+func checkEBPFSupport() error {
+	if _, err := os.Stat(btfPath); err != nil {
+		return errors.Wrap(err, "kernel BTF is not available")
+	}
+
+	release, err := os.ReadFile(filepath.Join(procRoot, "sys", "kernel", "osrelease"))
+	if err != nil {
+		return errors.Wrap(err, "failed to read kernel release")
+	}
+	major, minor, err := parseKernelRelease(string(release))
+	if err != nil {
+		return err
+	}
+	if major < 5 || major == 5 && minor < 8 {
+		return errors.Errorf("kernel %d.%d has no BPF ring buffer", major, minor)
+	}
+
+	capabilities, err := effectiveCapabilities()
+	if err != nil {
+		return err
+	}
+	if capabilities&(1<<capBPF) == 0 && capabilities&(1<<capSysAdmin) == 0 {
+		return errors.New("agent has neither CAP_BPF nor CAP_SYS_ADMIN")
+	}
+
+	return nil
+}
+
+// parseKernelRelease returns the version of a release like 6.5.0-1025-azure.
+func parseKernelRelease(release string) (int, int, error) {
+	parts := strings.SplitN(strings.TrimSpace(release), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, errors.Errorf("invalid kernel release %q", release)
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid kernel release %q", release)
+	}
+	// the minor version may have a suffix, e.g. 5.8-rc1
+	if end := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }); end != -1 {
+		parts[1] = parts[1][:end]
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid kernel release %q", release)
+	}
+
+	return major, minor, nil
+}
+
+// effectiveCapabilities returns the CapEff mask of the agent.
+func effectiveCapabilities() (uint64, error) {
+	status, err := os.ReadFile(filepath.Join(procRoot, "self", "status"))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read process status")
+	}
+
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, found := strings.CutPrefix(line, "CapEff:"); found {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+
+	return 0, errors.New("CapEff not found in process status")
+}
+
+// loadKernelOffsets reads the offsets of the fields the programs need from the BTF of the kernel,
+// so the programs do not depend on the layout of the kernel they were built for.
+func loadKernelOffsets(spec *btf.Spec) (kernelOffsets, error) {
+	var offsets kernelOffsets
+	fields := []struct {
+		structName string
+		member     string
+		offset     *uint32
+	}{
+		{"task_struct", "real_parent", &offsets.realParent},
+		{"task_struct", "tgid", &offsets.tgid},
+		{"task_struct", "cred", &offsets.cred},
+		{"cred", "euid", &offsets.euid},
+		{"task_struct", "fs", &offsets.fs},
+		{"fs_struct", "root", &offsets.root},
+		{"fs_struct", "pwd", &offsets.pwd},
+		{"path", "mnt", &offsets.pathMount},
+		{"path", "dentry", &offsets.pathDentry},
+		{"dentry", "d_parent", &offsets.dentryParent},
+		{"dentry", "d_name", &offsets.dentryName},
+		{"qstr", "name", &offsets.qstrName},
+		{"vfsmount", "mnt_root", &offsets.mountRoot},
+		{"mount", "mnt_parent", &offsets.mountParent},
+		{"mount", "mnt_mountpoint", &offsets.mountPoint},
+		{"mount", "mnt", &offsets.mountVfsmount},
+	}
+
+	for _, field := range fields {
+		typ, err := spec.AnyTypeByName(field.structName)
+		if err != nil {
+			return offsets, errors.Wrapf(err, "failed to find %s in kernel BTF", field.structName)
+		}
+		offset, found := memberOffset(typ, field.member)
+		if !found {
+			return offsets, errors.Errorf("%s has no member %s", field.structName, field.member)
+		}
+		*field.offset = offset
+	}
+
+	return offsets, nil
+}
+
+// memberOffset returns the offset of a member of a struct in bytes, it may be in an anonymous struct or union.
+func memberOffset(typ btf.Type, name string) (uint32, bool) {
+	var members []btf.Member
+	switch composite := btf.UnderlyingType(typ).(type) {
+	case *btf.Struct:
+		members = composite.Members
+	case *btf.Union:
+		members = composite.Members
+	default:
+		return 0, false
+	}
+
+	for _, member := range members {
+		if member.Name == name {
+			return member.Offset.Bytes(), true
+		}
+		if member.Name == "" {
+			if offset, found := memberOffset(member.Type, name); found {
+				return member.Offset.Bytes() + offset, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// ebpfProgramBuilder builds the programs. They write ebpfRecords to the events ring buffer
+// and count the records that do not fit in lost.
+type ebpfProgramBuilder struct {
+	offsets  kernelOffsets
+	agentPid int32 // syscalls of the agent are not traced
+	events   int   // fd of the ring buffer
+	lost     int   // fd of the lost counter
+	labels   int
+}
+
+func (b *ebpfProgramBuilder) label(name string) string {
+	b.labels++
+	return fmt.Sprintf("%s_%d", name, b.labels)
+}
+
+// prologue saves the context in R6 and the task in R7, zeroes the stack and sets the kind of the record,
+// the process and its parent and euid. It returns for syscalls of the agent.
+func (b *ebpfProgramBuilder) prologue(kind int64) asm.Instructions {
+	insns := asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}
+	for offset := ebpfRootMountStack; offset < 0; offset += 8 {
+		insns = append(insns, asm.StoreImm(asm.RFP, int16(offset), 0, asm.DWord))
+	}
+
+	insns = append(insns,
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.JEq.Imm(asm.R0, b.agentPid, "exit"),
+		asm.StoreMem(asm.RFP, ebpfRecordStack+4, asm.R0, asm.Word),
+		asm.StoreImm(asm.RFP, ebpfRecordStack, kind, asm.Word),
+		asm.FnGetCurrentTask.Call(),
+		asm.Mov.Reg(asm.R7, asm.R0),
+	)
+	// task->real_parent->tgid and task->cred->euid
+	insns = append(insns, b.readTaskField(b.offsets.realParent, b.offsets.tgid, ebpfRecordStack+8)...)
+	insns = append(insns, b.readTaskField(b.offsets.cred, b.offsets.euid, ebpfRecordStack+12)...)
+
+	return insns
+}
+
+// readTaskField reads the 4 byte field at fieldOffset of the struct the task in R7 points to at pointerOffset.
+func (b *ebpfProgramBuilder) readTaskField(pointerOffset, fieldOffset uint32, stackOffset int16) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, ebpfScratchStack),
+		asm.Mov.Imm(asm.R2, 8),
+		asm.Mov.Reg(asm.R3, asm.R7),
+		asm.Add.Imm(asm.R3, int32(pointerOffset)),
+		asm.FnProbeReadKernel.Call(),
+		asm.LoadMem(asm.R3, asm.RFP, ebpfScratchStack, asm.DWord),
+		asm.Add.Imm(asm.R3, int32(fieldOffset)),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, int32(stackOffset)),
+		asm.Mov.Imm(asm.R2, 4),
+		asm.FnProbeReadKernel.Call(),
+	}
+}
+
+// readPointer loads the pointer at offset of the kernel memory src points to into dst, it is 0 if the read fails.
+func (b *ebpfProgramBuilder) readPointer(dst, src asm.Register, offset uint32) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, ebpfScratchStack),
+		asm.Mov.Imm(asm.R2, 8),
+		asm.Mov.Reg(asm.R3, src),
+		asm.Add.Imm(asm.R3, int32(offset)),
+		asm.FnProbeReadKernel.Call(),
+		asm.LoadMem(dst, asm.RFP, ebpfScratchStack, asm.DWord),
+	}
+}
+
+// readUserString reads the string R3 points to into the data of the record.
+func (b *ebpfProgramBuilder) readUserString() asm.Instructions {
+	read := b.label("read")
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, ebpfRecordStack+40),
+		asm.Mov.Imm(asm.R2, ebpfRecordDataSize),
+		asm.FnProbeReadUserStr.Call(),
+		asm.JSGT.Imm(asm.R0, 0, read),
+		// the data may have the string of the last record
+		asm.StoreImm(asm.RFP, ebpfRecordStack+40, 0, asm.Byte),
+		asm.Mov.Imm(asm.R0, 0).WithSymbol(read),
+	}
+}
+
+// emit writes the record to the ring buffer, or counts it as lost if the ring buffer is full.
+func (b *ebpfProgramBuilder) emit() asm.Instructions {
+	done := b.label("emitted")
+	return asm.Instructions{
+		asm.LoadMapPtr(asm.R1, b.events),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, ebpfRecordStack),
+		asm.Mov.Imm(asm.R3, ebpfRecordSize),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.FnRingbufOutput.Call(),
+		asm.JEq.Imm(asm.R0, 0, done),
+		asm.StoreImm(asm.RFP, ebpfScratchStack, 0, asm.Word),
+		asm.LoadMapPtr(asm.R1, b.lost),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, ebpfScratchStack),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, done),
+		asm.Mov.Imm(asm.R1, 1),
+		asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+		asm.Mov.Imm(asm.R0, 0).WithSymbol(done),
+	}
+}
+
+func (b *ebpfProgramBuilder) epilogue() asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("exit"),
+		asm.Return(),
+	}
+}
+
+// cwd writes a record per directory of the working directory of the task in R7, from the working directory
+// up to the root of the process, and marks the record as having the complete working directory. The directories
+// are read from the dentries and mounts like d_path does, as the process may be gone when the records are read.
+// It uses R7 to R9, the caller sets the kind of the record after it.
+func (b *ebpfProgramBuilder) cwd() asm.Instructions {
+	offsets := b.offsets
+	directory := func(depth int) string { return fmt.Sprintf("cwd_%d", depth) }
+
+	// R7 is the dentry of the directory and R8 its vfsmount
+	insns := b.readPointer(asm.R9, asm.R7, offsets.fs)
+	insns = append(insns, b.readPointer(asm.R1, asm.R9, offsets.root+offsets.pathMount)...)
+	insns = append(insns, asm.StoreMem(asm.RFP, ebpfRootMountStack, asm.R1, asm.DWord))
+	insns = append(insns, b.readPointer(asm.R1, asm.R9, offsets.root+offsets.pathDentry)...)
+	insns = append(insns, asm.StoreMem(asm.RFP, ebpfRootDentryStack, asm.R1, asm.DWord))
+	insns = append(insns, b.readPointer(asm.R8, asm.R9, offsets.pwd+offsets.pathMount)...)
+	insns = append(insns, b.readPointer(asm.R7, asm.R9, offsets.pwd+offsets.pathDentry)...)
+	insns = append(insns,
+		asm.StoreImm(asm.RFP, ebpfRecordStack, ebpfRecordCwd, asm.Word),
+		asm.StoreImm(asm.RFP, ebpfRecordStack+16, 0, asm.Word),
+	)
+
+	for depth := 0; depth < ebpfMaxCwdDepth; depth++ {
+		notRoot, component := b.label("not_root"), b.label("component")
+		insns = append(insns,
+			asm.JEq.Imm(asm.R7, 0, "cwd_done").WithSymbol(directory(depth)),
+			asm.LoadMem(asm.R1, asm.RFP, ebpfRootDentryStack, asm.DWord),
+			asm.JNE.Reg(asm.R7, asm.R1, notRoot),
+			asm.LoadMem(asm.R1, asm.RFP, ebpfRootMountStack, asm.DWord),
+			asm.JEq.Reg(asm.R8, asm.R1, "cwd_complete"),
+		)
+
+		// the root of a mount, the directory is its mountpoint in the parent mount
+		readRoot := b.readPointer(asm.R1, asm.R8, offsets.mountRoot)
+		readRoot[0] = readRoot[0].WithSymbol(notRoot)
+		insns = append(insns, readRoot...)
+		insns = append(insns, asm.JNE.Reg(asm.R7, asm.R1, component))
+		insns = append(insns, b.readPointer(asm.R9, asm.R8, offsets.mountParent-offsets.mountVfsmount)...)
+		insns = append(insns,
+			asm.Mov.Reg(asm.R1, asm.R8),
+			asm.Add.Imm(asm.R1, -int32(offsets.mountVfsmount)),
+			asm.JEq.Reg(asm.R9, asm.R1, "cwd_complete"),
+		)
+		insns = append(insns, b.readPointer(asm.R7, asm.R8, offsets.mountPoint-offsets.mountVfsmount)...)
+		insns = append(insns,
+			asm.Mov.Reg(asm.R8, asm.R9),
+			asm.Add.Imm(asm.R8, int32(offsets.mountVfsmount)),
+			asm.Ja.Label(directory(depth+1)),
+		)
+
+		// a directory, the root of a file system is its own parent
+		readParent := b.readPointer(asm.R9, asm.R7, offsets.dentryParent)
+		readParent[0] = readParent[0].WithSymbol(component)
+		insns = append(insns, readParent...)
+		insns = append(insns, asm.JEq.Reg(asm.R9, asm.R7, "cwd_complete"))
+		insns = append(insns, b.readPointer(asm.R3, asm.R7, offsets.dentryName+offsets.qstrName)...)
+		insns = append(insns,
+			asm.Mov.Reg(asm.R1, asm.RFP),
+			asm.Add.Imm(asm.R1, ebpfRecordStack+40),
+			asm.Mov.Imm(asm.R2, ebpfRecordDataSize),
+			asm.FnProbeReadKernelStr.Call(),
+		)
+		insns = append(insns, b.emit()...)
+		insns = append(insns,
+			asm.LoadMem(asm.R1, asm.RFP, ebpfRecordStack+16, asm.Word),
+			asm.Add.Imm(asm.R1, 1),
+			asm.StoreMem(asm.RFP, ebpfRecordStack+16, asm.R1, asm.Word),
+			asm.Mov.Reg(asm.R7, asm.R9),
+		)
+	}
+
+	return append(insns,
+		asm.Ja.Label("cwd_done").WithSymbol(directory(ebpfMaxCwdDepth)),
+		asm.StoreImm(asm.RFP, ebpfRecordStack+20, 1, asm.Word).WithSymbol("cwd_complete"),
+		asm.StoreImm(asm.RFP, ebpfRecordStack+16, 0, asm.Word).WithSymbol("cwd_done"),
+	)
+}
+
+// execEnter writes the working directory and a record per argument of an execve, then one with its file.
+func (b *ebpfProgramBuilder) execEnter() asm.Instructions {
+	insns := b.prologue(ebpfRecordCwd)
+	insns = append(insns, b.cwd()...)
+	insns = append(insns,
+		asm.StoreImm(asm.RFP, ebpfRecordStack, ebpfRecordExecArg, asm.Word),
+		asm.LoadMem(asm.R8, asm.R6, 24, asm.DWord), // argv
+	)
+
+	for i := 0; i < ebpfMaxExecArgs; i++ {
+		insns = append(insns,
+			asm.StoreImm(asm.RFP, ebpfRecordStack+16, int64(i), asm.Word),
+			asm.Mov.Reg(asm.R1, asm.RFP),
+			asm.Add.Imm(asm.R1, ebpfScratchStack),
+			asm.Mov.Imm(asm.R2, 8),
+			asm.Mov.Reg(asm.R3, asm.R8),
+			asm.Add.Imm(asm.R3, int32(8*i)),
+			asm.FnProbeReadUser.Call(),
+			asm.JNE.Imm(asm.R0, 0, "exec"),
+			asm.LoadMem(asm.R3, asm.RFP, ebpfScratchStack, asm.DWord),
+			asm.JEq.Imm(asm.R3, 0, "exec"),
+		)
+		insns = append(insns, b.readUserString()...)
+		insns = append(insns, b.emit()...)
+	}
+
+	insns = append(insns,
+		asm.StoreImm(asm.RFP, ebpfRecordStack+16, ebpfMaxExecArgs, asm.Word),
+		asm.StoreImm(asm.RFP, ebpfRecordStack, ebpfRecordExec, asm.Word).WithSymbol("exec"),
+		asm.LoadMem(asm.R3, asm.R6, 16, asm.DWord), // filename
+	)
+	insns = append(insns, b.readUserString()...)
+	insns = append(insns, b.emit()...)
+
+	return append(insns, b.epilogue()...)
+}
+
+// execExit writes the return value of an execve.
+func (b *ebpfProgramBuilder) execExit() asm.Instructions {
+	insns := b.prologue(ebpfRecordExecResult)
+	insns = append(insns,
+		asm.LoadMem(asm.R1, asm.R6, 16, asm.DWord), // ret
+		asm.StoreMem(asm.RFP, ebpfRecordStack+24, asm.R1, asm.DWord),
+	)
+	insns = append(insns, b.emit()...)
+
+	return append(insns, b.epilogue()...)
+}
+
+func (b *ebpfProgramBuilder) connect() asm.Instructions {
+	insns := b.prologue(ebpfRecordConnect)
+	insns = append(insns,
+		asm.LoadMem(asm.R9, asm.R6, 24, asm.DWord), // uservaddr
+		asm.LoadMem(asm.R2, asm.R6, 32, asm.DWord), // addrlen
+	)
+	insns = append(insns, b.readSockaddr()...)
+
+	return append(insns, b.epilogue()...)
+}
+
+func (b *ebpfProgramBuilder) sendto() asm.Instructions {
+	insns := b.prologue(ebpfRecordSendto)
+	insns = append(insns,
+		asm.LoadMem(asm.R9, asm.R6, 48, asm.DWord), // addr
+		asm.LoadMem(asm.R2, asm.R6, 56, asm.DWord), // addr_len
+	)
+	insns = append(insns, b.readSockaddr()...)
+
+	return append(insns, b.epilogue()...)
+}
+
+// sendmsg reads msg_name and msg_namelen of the user_msghdr.
+func (b *ebpfProgramBuilder) sendmsg() asm.Instructions {
+	insns := b.prologue(ebpfRecordSendmsg)
+	insns = append(insns,
+		asm.LoadMem(asm.R3, asm.R6, 24, asm.DWord), // msg
+		asm.JEq.Imm(asm.R3, 0, "exit"),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, ebpfScratchStack),
+		asm.Mov.Imm(asm.R2, 8),
+		asm.FnProbeReadUser.Call(),
+		asm.JNE.Imm(asm.R0, 0, "exit"),
+		asm.LoadMem(asm.R9, asm.RFP, ebpfScratchStack, asm.DWord),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, ebpfScratchStack),
+		asm.Mov.Imm(asm.R2, 4),
+		asm.LoadMem(asm.R3, asm.R6, 24, asm.DWord),
+		asm.Add.Imm(asm.R3, 8),
+		asm.FnProbeReadUser.Call(),
+		asm.JNE.Imm(asm.R0, 0, "exit"),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfScratchStack, asm.Word),
+	)
+	insns = append(insns, b.readSockaddr()...)
+
+	return append(insns, b.epilogue()...)
+}
+
+// readSockaddr reads the sockaddr R9 points to, R2 is its length, and writes the record.
+// Syscalls without an address, e.g. sendto on a connected socket, are skipped.
+func (b *ebpfProgramBuilder) readSockaddr() asm.Instructions {
+	read := b.label("read")
+	insns := asm.Instructions{
+		asm.JEq.Imm(asm.R9, 0, "exit"),
+		asm.Mov.Reg32(asm.R2, asm.R2),
+		asm.JEq.Imm(asm.R2, 0, "exit"),
+		asm.JLE.Imm(asm.R2, sockaddrMaxSize, read),
+		asm.Mov.Imm(asm.R2, sockaddrMaxSize),
+		asm.StoreMem(asm.RFP, ebpfRecordStack+24, asm.R2, asm.DWord).WithSymbol(read),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, ebpfRecordStack+40),
+		asm.Mov.Reg(asm.R3, asm.R9),
+		asm.FnProbeReadUser.Call(),
+		asm.JNE.Imm(asm.R0, 0, "exit"),
+	}
+
+	return append(insns, b.emit()...)
+}
+
+func (b *ebpfProgramBuilder) openat() asm.Instructions {
+	insns := b.prologue(ebpfRecordOpenat)
+	insns = append(insns,
+		asm.LoadMem(asm.R1, asm.R6, 16, asm.DWord), // dfd
+		asm.StoreMem(asm.RFP, ebpfRecordStack+32, asm.R1, asm.DWord),
+	)
+
+	return append(insns, b.readOpen(ebpfRecordOpenat, 24, 32)...)
+}
+
+func (b *ebpfProgramBuilder) open() asm.Instructions {
+	insns := b.prologue(ebpfRecordOpen)
+	insns = append(insns, asm.StoreImm(asm.RFP, ebpfRecordStack+32, atFdCwd, asm.DWord))
+
+	return append(insns, b.readOpen(ebpfRecordOpen, 16, 24)...)
+}
+
+// readOpen writes the file of an open for writing, and before it the working directory if the file is relative to it.
+func (b *ebpfProgramBuilder) readOpen(kind int64, fileNameOffset, flagsOffset int16) asm.Instructions {
+	insns := asm.Instructions{
+		asm.LoadMem(asm.R1, asm.R6, flagsOffset, asm.DWord),
+		asm.StoreMem(asm.RFP, ebpfRecordStack+24, asm.R1, asm.DWord),
+		asm.And.Imm(asm.R1, openWriteFlags),
+		asm.JEq.Imm(asm.R1, 0, "exit"),
+		// files relative to another directory are resolved with proc
+		asm.LoadMem(asm.R1, asm.RFP, ebpfRecordStack+32, asm.DWord),
+		asm.JNE.Imm32(asm.R1, atFdCwd, "file"),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, ebpfScratchStack),
+		asm.Mov.Imm(asm.R2, 1),
+		asm.LoadMem(asm.R3, asm.R6, fileNameOffset, asm.DWord),
+		asm.FnProbeReadUser.Call(),
+		asm.LoadMem(asm.R1, asm.RFP, ebpfScratchStack, asm.Byte),
+		asm.JEq.Imm(asm.R1, '/', "file"),
+	}
+	insns = append(insns, b.cwd()...)
+	insns = append(insns,
+		asm.StoreImm(asm.RFP, ebpfRecordStack, kind, asm.Word),
+		asm.LoadMem(asm.R3, asm.R6, fileNameOffset, asm.DWord).WithSymbol("file"),
+	)
+	insns = append(insns, b.readUserString()...)
+	insns = append(insns, b.emit()...)
+
+	return append(insns, b.epilogue()...)
+}
+
+// newEBPFMonitor loads the programs and attaches them to their tracepoints. Syscalls of agentPid are not traced.
+func newEBPFMonitor(agentPid int) (*ebpfMonitor, error) {
+	if err := checkEBPFSupport(); err != nil {
+		return nil, err
+	}
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, errors.Wrap(err, "failed to remove memlock limit")
+	}
+
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load kernel BTF")
+	}
+	offsets, err := loadKernelOffsets(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	monitor := &ebpfMonitor{}
+	monitor.events, err = ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.RingBuf, MaxEntries: ebpfRingBufferSize})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create ring buffer")
+	}
+	monitor.lost, err = ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Array, KeySize: 4, ValueSize: 8, MaxEntries: 1})
+	if err != nil {
+		monitor.Close()
+		return nil, errors.Wrap(err, "failed to create lost counter")
+	}
+
+	builder := &ebpfProgramBuilder{offsets: offsets, agentPid: int32(agentPid), events: monitor.events.FD(), lost: monitor.lost.FD()}
+	for _, programSpec := range ebpfPrograms {
+		program, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Name:         strings.TrimPrefix(programSpec.name, "sys_"),
+			Type:         ebpf.TracePoint,
+			License:      "GPL",
+			Instructions: programSpec.program(builder),
+		})
+		if err != nil {
+			monitor.Close()
+			return nil, errors.Wrapf(err, "failed to load program %s", programSpec.name)
+		}
+
+		// the link keeps the program attached
+		programLink, err := link.Tracepoint("syscalls", programSpec.name, program, nil)
+		program.Close()
+		if err != nil {
+			if programSpec.optional {
+				continue
+			}
+			monitor.Close()
+			return nil, errors.Wrapf(err, "failed to attach program %s", programSpec.name)
+		}
+		monitor.links = append(monitor.links, programLink)
+	}
+
+	monitor.reader, err = ringbuf.NewReader(monitor.events)
+	if err != nil {
+		monitor.Close()
+		return nil, errors.Wrap(err, "failed to read ring buffer")
+	}
+
+	return monitor, nil
+}
+
+// Close detaches the programs, a Read in progress returns ringbuf.ErrClosed.
+func (monitor *ebpfMonitor) Close() {
+	for _, programLink := range monitor.links {
+		programLink.Close()
+	}
+	if monitor.reader != nil {
+		monitor.reader.Close()
+	}
+	if monitor.lost != nil {
+		monitor.lost.Close()
+	}
+	if monitor.events != nil {
+		monitor.events.Close()
+	}
+}
+
+// monitorProcessesEBPF traces execve, connect, sendto, sendmsg and opens for writing with eBPF programs and hands
+// the same Events to the EventHandler as the audit backend, until the agent exits. It returns an error if the
+// backend cannot run, then the caller falls back to audit.
+func (p *ProcessMonitor) monitorProcessesEBPF() error {
+	monitor, err := newEBPFMonitor(os.Getpid())
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+
+	WriteLog(fmt.Sprintf("eBPF process monitor attached %d programs", len(monitor.links)))
+
+	p.ebpfFiles = p.newEBPFFileFilter()
+	if len(p.CredentialFiles) > 0 || p.ebpfFiles.hasAccessWatches {
+		WriteLog("eBPF process monitor does not report reads and execs of credential files and file watches, they need the audit backend")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go p.pollEBPFLost(done, monitor.lost)
+
+	if err = p.receiveEBPF(monitor.reader); err != nil {
+		WriteLog(fmt.Sprintf("process monitor stopped %v", err))
+	}
+	return nil
+}
+
+// pollEBPFLost reports the records that did not fit into the ring buffer until done is closed.
+func (p *ProcessMonitor) pollEBPFLost(done chan struct{}, lost *ebpf.Map) {
+	p.reportAuditStatus(0, 0, 0)
+
+	ticker := time.NewTicker(auditStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			var count uint64
+			if err := lost.Lookup(uint32(0), &count); err != nil {
+				WriteLog(fmt.Sprintf("failed to read lost eBPF records %v", err))
+				continue
+			}
+			p.reportAuditStatus(uint32(count), 0, 0)
+		}
+	}
+}
+
+func (p *ProcessMonitor) receiveEBPF(reader ebpfReader) error {
+	p.ebpfExecs = make(map[uint32]*ebpfExec)
+	p.ebpfCwds = make(map[uint32][]string)
+	eventHandler := p.EventHandler
+	if eventHandler == nil {
+		eventHandler = NewEventHandler(p.CorrelationId, p.Repo, p.ApiClient, p.DNSProxy)
+	}
+
+	for {
+		rawRecord, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return nil
+			}
+			return errors.Wrap(err, "receive failed")
+		}
+
+		var record ebpfRecord
+		if err := decodeEBPFRecord(rawRecord.RawSample, &record); err != nil {
+			p.recordParseError(err)
+			continue
+		}
+
+		if event := p.handleEBPFRecord(&record); event != nil {
+			p.pending.Add(1)
+			go func() {
+				defer p.pending.Done()
+				eventHandler.HandleEvent(event)
+			}()
+		}
+	}
+}
@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_checkEBPFSupport(t *testing.T) {
+	tests := []struct {
+		name    string
+		btf     bool
+		release string
+		capEff  string
+		wantErr bool
+	}{
+		{name: "supported as root", btf: true, release: "6.5.0-1025-azure", capEff: "000001ffffffffff"},
+		{name: "supported with CAP_BPF", btf: true, release: "5.15.0-1041-azure", capEff: "0000008000000000"},
+		{name: "no BTF", release: "6.5.0-1025-azure", capEff: "000001ffffffffff", wantErr: true},
+		{name: "no ring buffer", btf: true, release: "5.4.0-1109-azure", capEff: "000001ffffffffff", wantErr: true},
+		{name: "no capabilities", btf: true, release: "6.5.0-1025-azure", capEff: "0000000000000000", wantErr: true},
+	}
+
+	defer func(root, btf string) { procRoot, btfPath = root, btf }(procRoot, btfPath)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			procRoot = t.TempDir()
+			btfPath = filepath.Join(t.TempDir(), "vmlinux")
+			if tt.btf {
+				os.WriteFile(btfPath, []byte{}, 0644)
+			}
+			os.MkdirAll(filepath.Join(procRoot, "sys", "kernel"), 0755)
+			os.WriteFile(filepath.Join(procRoot, "sys", "kernel", "osrelease"), []byte(tt.release+"\n"), 0644)
+			os.MkdirAll(filepath.Join(procRoot, "self"), 0755)
+			os.WriteFile(filepath.Join(procRoot, "self", "status"), []byte("Name:\tagent\nCapInh:\t0000000000000000\nCapEff:\t"+tt.capEff+"\n"), 0644)
+
+			if err := checkEBPFSupport(); (err != nil) != tt.wantErr {
+				t.Fatalf("checkEBPFSupport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_parseKernelRelease(t *testing.T) {
+	tests := []struct {
+		release string
+		major   int
+		minor   int
+		wantErr bool
+	}{
+		{release: "6.5.0-1025-azure", major: 6, minor: 5},
+		{release: "5.8-rc1", major: 5, minor: 8},
+		{release: "invalid", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		major, minor, err := parseKernelRelease(tt.release)
+		if (err != nil) != tt.wantErr || major != tt.major || minor != tt.minor {
+			t.Fatalf("parseKernelRelease(%q) = %d, %d, %v", tt.release, major, minor, err)
+		}
+	}
+}
+
+// Test_newEBPFMonitor loads the programs into the running kernel, it needs root and a kernel with BTF.
+func Test_newEBPFMonitor(t *testing.T) {
+	if err := checkEBPFSupport(); err != nil {
+		t.Skipf("eBPF backend is not supported: %v", err)
+	}
+
+	// the syscalls of the test run in a child, the test binary is the agent
+	monitor, err := newEBPFMonitor(os.Getpid())
+	if err != nil {
+		t.Fatalf("newEBPFMonitor() error = %v", err)
+	}
+	defer monitor.Close()
+
+	workingDirectory := t.TempDir()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	script := "echo step > written.txt; exec 3<>/dev/tcp/127.0.0.1/" + strconv.Itoa(port)
+	cmd := exec.Command("/bin/bash", "-c", script, "stepsecurity-ebpf-test")
+	cmd.Dir = workingDirectory
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("failed to run %s: %v", script, err)
+	}
+
+	p := &ProcessMonitor{WorkingDirectory: workingDirectory, ebpfExecs: make(map[uint32]*ebpfExec), ebpfCwds: make(map[uint32][]string)}
+	p.ebpfFiles = p.newEBPFFileFilter()
+
+	var execSeen, fileSeen, connectSeen bool
+	monitor.reader.SetDeadline(time.Now().Add(5 * time.Second))
+	for !(execSeen && fileSeen && connectSeen) {
+		rawRecord, err := monitor.reader.Read()
+		if err != nil {
+			t.Fatalf("missing events, exec: %v, file: %v, connect: %v, error: %v", execSeen, fileSeen, connectSeen, err)
+		}
+
+		var record ebpfRecord
+		if err := decodeEBPFRecord(rawRecord.RawSample, &record); err != nil {
+			t.Fatal(err)
+		}
+		event := p.handleEBPFRecord(&record)
+		if event == nil || event.Pid != strconv.Itoa(cmd.Process.Pid) {
+			continue
+		}
+
+		switch event.EventType {
+		case processMonitorTag:
+			execSeen = event.Exe == "/bin/bash" || event.Exe == "/usr/bin/bash"
+			if len(event.ProcessArguments) != 4 || event.ProcessArguments[3] != "stepsecurity-ebpf-test" {
+				t.Fatalf("unexpected arguments %v", event.ProcessArguments)
+			}
+			if event.PPid != strconv.Itoa(os.Getpid()) || event.Path != workingDirectory {
+				t.Fatalf("unexpected ppid %s or cwd %s", event.PPid, event.Path)
+			}
+		case fileMonitorTag:
+			fileSeen = event.FileName == filepath.Join(workingDirectory, "written.txt") && event.Path == workingDirectory
+		case netMonitorTag:
+			connectSeen = event.IPAddress == "127.0.0.1" && event.Port == strconv.Itoa(port)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func newEBPFTestRecord(kind, pid, index uint32, data string) *ebpfRecord {
+	record := &ebpfRecord{Kind: kind, Pid: pid, Index: index}
+	// copy is the file copy of the package
+	for i := range data {
+		record.Data[i] = data[i]
+	}
+	return record
+}
+
+func TestProcessMonitor_handleEBPFRecord(t *testing.T) {
+	cwd := func(pid uint32, directories ...string) []*ebpfRecord {
+		var records []*ebpfRecord
+		for i, directory := range directories {
+			records = append(records, newEBPFTestRecord(ebpfRecordCwd, pid, uint32(i), directory))
+		}
+		return records
+	}
+	open := func(kind, pid uint32, fileName string, dfd int32) *ebpfRecord {
+		record := newEBPFTestRecord(kind, pid, 0, fileName)
+		record.Cwd = 1
+		record.Arg1 = uint64(int64(dfd))
+		return record
+	}
+
+	tests := []struct {
+		name     string
+		records  []*ebpfRecord
+		fileName string
+		path     string
+		syscall  string
+	}{
+		{
+			name:     "relative file",
+			records:  append(cwd(10, "agent", "work", "home"), open(ebpfRecordOpenat, 10, "out/build.log", atFdCwd)),
+			fileName: "/home/work/agent/out/build.log",
+			path:     "/home/work/agent",
+			syscall:  "openat",
+		},
+		{
+			name:     "absolute file",
+			records:  []*ebpfRecord{open(ebpfRecordOpen, 10, "/home/work/agent/main.go", atFdCwd)},
+			fileName: "/home/work/agent/main.go",
+			path:     "/",
+			syscall:  "open",
+		},
+		{
+			name:    "file outside of the working directory",
+			records: append(cwd(10, "tmp"), open(ebpfRecordOpenat, 10, "build.log", atFdCwd)),
+		},
+		{
+			name:     "directories of another process",
+			records:  append(cwd(11, "tmp"), open(ebpfRecordOpenat, 10, "/home/work/agent/main.go", atFdCwd)),
+			fileName: "/home/work/agent/main.go",
+			path:     "/",
+			syscall:  "openat",
+		},
+		{
+			name:    "file relative to a closed directory",
+			records: []*ebpfRecord{open(ebpfRecordOpenat, 1<<23, "main.go", 3)}, // above the largest pid of linux
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProcessMonitor{WorkingDirectory: "/home/work/agent", ebpfExecs: make(map[uint32]*ebpfExec),
+				ebpfCwds: make(map[uint32][]string)}
+			p.ebpfFiles = p.newEBPFFileFilter()
+
+			var event *Event
+			for _, record := range tt.records {
+				event = p.handleEBPFRecord(record)
+			}
+
+			if tt.fileName == "" {
+				if event != nil {
+					t.Fatalf("handleEBPFRecord() = %+v, want nil", event)
+				}
+				return
+			}
+			if event == nil || event.FileName != tt.fileName || event.Path != tt.path || event.Syscall != tt.syscall ||
+				event.EventType != fileMonitorTag {
+				t.Fatalf("handleEBPFRecord() = %+v, want %s in %s", event, tt.fileName, tt.path)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	conntrackPath                = "/proc/net/nf_conntrack"
+	conntrackAcctPath            = "/proc/sys/net/netfilter/nf_conntrack_acct"
+	defaultEgressPollInterval    = 5 * time.Second
+	defaultEgressUploadThreshold = 100 * 1024 * 1024
+	maxEgressSummariesInLog      = 20
+	telemetryTypeEgressSummary   = "egresssummary"
+	// closed flows are kept as summaries, destinations after this many are summarized together
+	maxEgressSummaries = 10000
+)
+
+// conntrackFlow is a connection from conntrack with its accounting in both directions.
+type conntrackFlow struct {
+	Protocol   string
+	SrcIP      string
+	DstIP      string
+	SrcPort    uint16
+	DstPort    uint16
+	TxBytes    uint64
+	TxPackets  uint64
+	RxBytes    uint64
+	RxPackets  uint64
+	domainName string
+	tool       Tool
+	attributed bool
+	polled     uint64 // the last poll that listed the flow
+}
+
+func (flow *conntrackFlow) key() string {
+	return fmt.Sprintf("%s %s %s", flow.Protocol, net.JoinHostPort(flow.SrcIP, strconv.Itoa(int(flow.SrcPort))), net.JoinHostPort(flow.DstIP, strconv.Itoa(int(flow.DstPort))))
+}
+
+// EgressSummary is the data sent to one domain by one tool during the job.
+type EgressSummary struct {
+	DomainName  string   `json:"domainName,omitempty"`
+	IPAddresses []string `json:"ipAddresses"`
+	Tool        Tool     `json:"tool"`
+	Flows       int      `json:"flows"`
+	TxBytes     uint64   `json:"txBytes"`
+	TxPackets   uint64   `json:"txPackets"`
+	RxBytes     uint64   `json:"rxBytes"`
+	RxPackets   uint64   `json:"rxPackets"`
+	Exceeded    bool     `json:"exceeded,omitempty"`
+}
+
+// EgressAccounting tracks bytes and packets of outbound flows from conntrack accounting
+// and reports them, aggregated by domain and tool, at the end of the job.
+type EgressAccounting struct {
+	CorrelationId   string
+	Repo            string
+	ApiClient       *ApiClient
+	DNSProxy        *DNSProxy
+	EventHandler    *EventHandler
+	UploadThreshold uint64
+	PollInterval    time.Duration
+	ConntrackPath   string
+	flows           map[string]*conntrackFlow // flows in conntrack
+	closed          map[string]*EgressSummary // flows that left conntrack, by destination and tool
+	polls           uint64
+	reported        bool
+	mutex           sync.Mutex
+}
+
+// enableConntrackAccounting turns on byte and packet counters, for connections created after it.
+func enableConntrackAccounting() error {
+	return os.WriteFile(conntrackAcctPath, []byte("1"), 0644)
+}
+
+// Start polls conntrack until ctx is done, then reports if the job end was not seen.
+func (accounting *EgressAccounting) Start(ctx context.Context) {
+	if err := enableConntrackAccounting(); err != nil {
+		WriteLog(fmt.Sprintf("Error enabling conntrack accounting %v", err))
+	}
+
+	pollInterval := accounting.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultEgressPollInterval
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			accounting.Report()
+			return
+		case <-ticker.C:
+			if err := accounting.Poll(); err != nil {
+				WriteLog(fmt.Sprintf("Error reading conntrack %v", err))
+			}
+		}
+	}
+}
+
+// readConntrack returns the conntrack table, from procfs if the kernel has it, else from the conntrack tool.
+func (accounting *EgressAccounting) readConntrack() (io.ReadCloser, error) {
+	path := accounting.ConntrackPath
+	if path == "" {
+		path = conntrackPath
+	}
+
+	f, err := os.Open(path)
+	if err == nil {
+		return f, nil
+	}
+
+	output, cmdErr := exec.Command("conntrack", "-L", "-o", "extended").Output()
+	if cmdErr != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(string(output))), nil
+}
+
+// Poll updates the counters of flows to public addresses.
+// Entries stay in conntrack for a while after a connection is closed, e.g. TIME_WAIT, so short flows are seen too.
+// Flows that left conntrack are added to the summaries of closed flows, so only open flows are kept.
+func (accounting *EgressAccounting) Poll() error {
+	r, err := accounting.readConntrack()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+
+	if accounting.flows == nil {
+		accounting.flows = make(map[string]*conntrackFlow)
+	}
+	accounting.polls++
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		flow, ok := parseConntrackLine(scanner.Text())
+		// connections to the runner have its private address as destination
+		if !ok || isPrivateIPAddress(flow.DstIP) {
+			continue
+		}
+
+		existing, found := accounting.flows[flow.key()]
+		if !found {
+			existing = flow
+			accounting.flows[flow.key()] = existing
+		} else {
+			// counters only grow while the conntrack entry exists
+			existing.TxBytes = max(existing.TxBytes, flow.TxBytes)
+			existing.TxPackets = max(existing.TxPackets, flow.TxPackets)
+			existing.RxBytes = max(existing.RxBytes, flow.RxBytes)
+			existing.RxPackets = max(existing.RxPackets, flow.RxPackets)
+		}
+		existing.polled = accounting.polls
+
+		if !existing.attributed {
+			accounting.attribute(existing)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if accounting.closed == nil {
+		accounting.closed = make(map[string]*EgressSummary)
+	}
+	for key, flow := range accounting.flows {
+		if flow.polled != accounting.polls {
+			addToSummaries(accounting.closed, flow, maxEgressSummaries)
+			delete(accounting.flows, key)
+		}
+	}
+
+	return nil
+}
+
+// attribute sets the domain and tool of a flow, while its socket is likely still open.
+func (accounting *EgressAccounting) attribute(flow *conntrackFlow) {
+	flow.attributed = true
+	flow.tool = Tool{Name: Unknown, SHA256: Unknown}
+
+	if accounting.DNSProxy != nil {
+		flow.domainName = accounting.DNSProxy.GetReverseIPLookup(flow.DstIP)
+	}
+
+	if accounting.EventHandler == nil {
+		return
+	}
+
+	pid, ppid, exe, err := findProcessBySocket(flow.Protocol, flow.SrcPort, net.ParseIP(flow.DstIP), flow.DstPort)
+	if err != nil {
+		return
+	}
+
+	if tool, _ := accounting.EventHandler.GetTool(pid, ppid, exe); tool.Name != "" {
+		flow.tool = tool
+	}
+}
+
+// parseConntrackLine parses a line of /proc/net/nf_conntrack or conntrack -o extended.
+// The first src, dst, sport, dport, packets and bytes are of the original direction, the second of the reply.
+func parseConntrackLine(line string) (*conntrackFlow, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return nil, false
+	}
+
+	flow := &conntrackFlow{Protocol: fields[2]}
+	if flow.Protocol != tcp && flow.Protocol != udp {
+		return nil, false
+	}
+
+	seen := make(map[string]int)
+	for _, field := range fields {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			continue
+		}
+		seen[key]++
+		original := seen[key] == 1
+
+		switch key {
+		case "src":
+			if original {
+				flow.SrcIP = value
+			}
+		case "dst":
+			if original {
+				flow.DstIP = value
+			}
+		case "sport", "dport":
+			if !original {
+				continue
+			}
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return nil, false
+			}
+			if key == "sport" {
+				flow.SrcPort = uint16(port)
+			} else {
+				flow.DstPort = uint16(port)
+			}
+		case "packets", "bytes":
+			count, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			switch {
+			case key == "packets" && original:
+				flow.TxPackets = count
+			case key == "bytes" && original:
+				flow.TxBytes = count
+			case key == "packets":
+				flow.RxPackets = count
+			default:
+				flow.RxBytes = count
+			}
+		}
+	}
+
+	if flow.SrcIP == "" || flow.DstIP == "" {
+		return nil, false
+	}
+
+	return flow, true
+}
+
+// Summaries aggregates the flows by domain, or IP address if the domain is not known, and tool,
+// with the largest uploads first.
+func (accounting *EgressAccounting) Summaries() []*EgressSummary {
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+
+	threshold := accounting.UploadThreshold
+	if threshold == 0 {
+		threshold = defaultEgressUploadThreshold
+	}
+
+	summaries := make(map[string]*EgressSummary)
+	for key, closed := range accounting.closed {
+		summary := *closed
+		summary.IPAddresses = append([]string{}, closed.IPAddresses...)
+		summaries[key] = &summary
+	}
+	for _, flow := range accounting.flows {
+		addToSummaries(summaries, flow, 0)
+	}
+	for _, summary := range summaries {
+		summary.Exceeded = summary.TxBytes > threshold
+	}
+
+	result := make([]*EgressSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		result = append(result, summary)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].TxBytes > result[j].TxBytes })
+
+	return result
+}
+
+// Report sends the summaries once, logs the largest uploads and annotates uploads over the threshold.
+func (accounting *EgressAccounting) Report() {
+	if err := accounting.Poll(); err != nil {
+		WriteLog(fmt.Sprintf("Error reading conntrack %v", err))
+	}
+
+	accounting.mutex.Lock()
+	if accounting.reported {
+		accounting.mutex.Unlock()
+		return
+	}
+	accounting.reported = true
+	accounting.mutex.Unlock()
+
+	summaries := accounting.Summaries()
+	for i, summary := range summaries {
+		destination := summary.DomainName
+		if destination == "" {
+			destination = strings.Join(summary.IPAddresses, ",")
+		}
+
+		if i < maxEgressSummariesInLog {
+			WriteLog(fmt.Sprintf("egress destination: %s, tool: %s, flows: %d, sent: %d bytes (%d packets), received: %d bytes (%d packets)",
+				destination, summary.Tool.Name, summary.Flows, summary.TxBytes, summary.TxPackets, summary.RxBytes, summary.RxPackets))
+		}
+
+		if summary.Exceeded {
+			WriteAnnotation(fmt.Sprintf("%s %s uploaded %d bytes to %s, which is more than the egress threshold",
+				StepSecurityAnnotationPrefix, summary.Tool.Name, summary.TxBytes, strings.TrimSuffix(destination, ".")))
+		}
+	}
+
+	if accounting.ApiClient != nil && len(summaries) > 0 {
+		accounting.ApiClient.sendTelemetry(&TelemetryEvent{Type: telemetryTypeEgressSummary, CorrelationId: accounting.CorrelationId, Repo: accounting.Repo, Data: summaries})
+	}
+}
+
+// addToSummaries adds the counters of flow to its summary by destination, or IP address if the domain
+// is not known, and tool. With limit set, flows of new destinations over the limit are added to one summary.
+func addToSummaries(summaries map[string]*EgressSummary, flow *conntrackFlow, limit int) {
+	destination := flow.domainName
+	if destination == "" {
+		destination = flow.DstIP
+	}
+	key := fmt.Sprintf("%s %s %s", destination, flow.tool.Name, flow.tool.SHA256)
+
+	summary, found := summaries[key]
+	if !found && limit > 0 && len(summaries) >= limit {
+		key = "other"
+		summary, found = summaries[key]
+		if !found {
+			summary = &EgressSummary{Tool: Tool{Name: Unknown, SHA256: Unknown}}
+			summaries[key] = summary
+		}
+	} else if !found {
+		summary = &EgressSummary{DomainName: flow.domainName, Tool: flow.tool}
+		summaries[key] = summary
+	}
+
+	if key != "other" && !contains(summary.IPAddresses, flow.DstIP) {
+		summary.IPAddresses = append(summary.IPAddresses, flow.DstIP)
+	}
+	summary.Flows++
+	summary.TxBytes += flow.TxBytes
+	summary.TxPackets += flow.TxPackets
+	summary.RxBytes += flow.RxBytes
+	summary.RxPackets += flow.RxPackets
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_parseConntrackLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want *conntrackFlow
+	}{
+		{
+			name: "tcp",
+			line: "ipv4     2 tcp      6 117 TIME_WAIT src=10.1.0.4 dst=140.82.112.3 sport=41234 dport=443 packets=12 bytes=2048 src=140.82.112.3 dst=10.1.0.4 sport=443 dport=41234 packets=10 bytes=8192 [ASSURED] mark=0 zone=0 use=2",
+			want: &conntrackFlow{Protocol: "tcp", SrcIP: "10.1.0.4", DstIP: "140.82.112.3", SrcPort: 41234, DstPort: 443, TxBytes: 2048, TxPackets: 12, RxBytes: 8192, RxPackets: 10},
+		},
+		{
+			name: "udp ipv6",
+			line: "ipv6     10 udp      17 25 src=2001:db8::4 dst=2001:db8::1 sport=5353 dport=53 packets=1 bytes=80 src=2001:db8::1 dst=2001:db8::4 sport=53 dport=5353 packets=1 bytes=120 mark=0 zone=0 use=2",
+			want: &conntrackFlow{Protocol: "udp", SrcIP: "2001:db8::4", DstIP: "2001:db8::1", SrcPort: 5353, DstPort: 53, TxBytes: 80, TxPackets: 1, RxBytes: 120, RxPackets: 1},
+		},
+		{
+			name: "icmp",
+			line: "ipv4     2 icmp     1 29 src=10.1.0.4 dst=8.8.8.8 type=8 code=0 id=1 packets=1 bytes=84 src=8.8.8.8 dst=10.1.0.4 type=0 code=0 id=1 packets=1 bytes=84 mark=0 zone=0 use=2",
+		},
+		{
+			name: "invalid port",
+			line: "ipv4     2 tcp      6 117 ESTABLISHED src=10.1.0.4 dst=140.82.112.3 sport=x dport=443",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseConntrackLine(tt.line)
+			if tt.want == nil {
+				if ok {
+					t.Fatalf("parseConntrackLine() = %+v, want no flow", got)
+				}
+				return
+			}
+			if !ok || *got != *tt.want {
+				t.Fatalf("parseConntrackLine() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEgressAccounting_Report(t *testing.T) {
+	conntrack := filepath.Join(t.TempDir(), "nf_conntrack")
+	lines := "ipv4     2 tcp      6 117 ESTABLISHED src=10.1.0.4 dst=140.82.112.3 sport=41234 dport=443 packets=12 bytes=2048 src=140.82.112.3 dst=10.1.0.4 sport=443 dport=41234 packets=10 bytes=8192 [ASSURED] mark=0 zone=0 use=2\n" +
+		"ipv4     2 tcp      6 117 ESTABLISHED src=10.1.0.4 dst=140.82.112.4 sport=41236 dport=443 packets=1000 bytes=4096 src=140.82.112.4 dst=10.1.0.4 sport=443 dport=41236 packets=5 bytes=512 [ASSURED] mark=0 zone=0 use=2\n" +
+		"ipv4     2 tcp      6 117 ESTABLISHED src=10.1.0.4 dst=1.2.3.4 sport=41238 dport=443 packets=1 bytes=100 src=1.2.3.4 dst=10.1.0.4 sport=443 dport=41238 packets=1 bytes=100 [ASSURED] mark=0 zone=0 use=2\n" +
+		// connections to the runner are not egress
+		"ipv4     2 tcp      6 117 ESTABLISHED src=168.63.129.16 dst=10.1.0.4 sport=80 dport=41240 packets=1 bytes=100 src=10.1.0.4 dst=168.63.129.16 sport=41240 dport=80 packets=1 bytes=100 [ASSURED] mark=0 zone=0 use=2\n"
+	if err := os.WriteFile(conntrack, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+	fileSink, err := NewFileTelemetrySink(filePath)
+	if err != nil {
+		t.Fatalf("NewFileTelemetrySink() error = %v", err)
+	}
+	apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{fileSink}}
+
+	dnsProxy := &DNSProxy{ReverseIPLookup: make(map[string]string)}
+	dnsProxy.SetReverseIPLookup("github.com.", "140.82.112.3")
+	dnsProxy.SetReverseIPLookup("github.com.", "140.82.112.4")
+
+	accounting := &EgressAccounting{CorrelationId: "123", Repo: "owner/repo", ApiClient: apiclient, DNSProxy: dnsProxy,
+		UploadThreshold: 5000, ConntrackPath: conntrack}
+	if err := accounting.Poll(); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+
+	// counters of a flow are updated on the next poll
+	lines = "ipv4     2 tcp      6 117 TIME_WAIT src=10.1.0.4 dst=140.82.112.3 sport=41234 dport=443 packets=20 bytes=3000 src=140.82.112.3 dst=10.1.0.4 sport=443 dport=41234 packets=10 bytes=8192 [ASSURED] mark=0 zone=0 use=2\n"
+	if err := os.WriteFile(conntrack, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	accounting.Report()
+	// the end of the job can be seen twice, the summaries are sent once
+	accounting.Report()
+	apiclient.closeTelemetrySinks()
+
+	data, _ := os.ReadFile(filePath)
+	events := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(events) != 1 {
+		t.Fatalf("expected 1 egress summary event, got %d", len(events))
+	}
+
+	var event struct {
+		Type string           `json:"type"`
+		Data []*EgressSummary `json:"data"`
+	}
+	if err := json.Unmarshal(events[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != telemetryTypeEgressSummary || len(event.Data) != 2 {
+		t.Fatalf("unexpected event %s", events[0])
+	}
+
+	github := event.Data[0]
+	if github.DomainName != "github.com." || github.Flows != 2 || len(github.IPAddresses) != 2 ||
+		github.TxBytes != 7096 || github.TxPackets != 1020 || github.RxBytes != 8704 || !github.Exceeded || github.Tool.Name != Unknown {
+		t.Fatalf("unexpected summary %+v", github)
+	}
+
+	other := event.Data[1]
+	if other.DomainName != "" || other.IPAddresses[0] != "1.2.3.4" || other.TxBytes != 100 || other.Exceeded {
+		t.Fatalf("unexpected summary %+v", other)
+	}
+}
+
+func TestEgressAccounting_Poll_PrunesClosedFlows(t *testing.T) {
+	conntrack := filepath.Join(t.TempDir(), "nf_conntrack")
+	lines := "ipv4     2 tcp      6 117 ESTABLISHED src=10.1.0.4 dst=140.82.112.3 sport=41234 dport=443 packets=12 bytes=2048 src=140.82.112.3 dst=10.1.0.4 sport=443 dport=41234 packets=10 bytes=8192 [ASSURED] mark=0 zone=0 use=2\n"
+	if err := os.WriteFile(conntrack, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	accounting := &EgressAccounting{ConntrackPath: conntrack}
+	if err := accounting.Poll(); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+
+	// the connection left conntrack
+	if err := os.WriteFile(conntrack, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounting.Poll(); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+
+	if len(accounting.flows) != 0 {
+		t.Fatalf("expected closed flows to be pruned, got %d", len(accounting.flows))
+	}
+	if summaries := accounting.Summaries(); len(summaries) != 1 || summaries[0].TxBytes != 2048 || summaries[0].Flows != 1 {
+		t.Fatalf("expected the closed flow in the summaries, got %+v", summaries)
+	}
+}
+
+func Test_addToSummaries_Limit(t *testing.T) {
+	summaries := make(map[string]*EgressSummary)
+	for _, dstIP := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"} {
+		addToSummaries(summaries, &conntrackFlow{DstIP: dstIP, TxBytes: 10}, 2)
+	}
+
+	// destinations over the limit share a summary
+	other, found := summaries["other"]
+	if len(summaries) != 3 || !found || other.Flows != 2 || other.TxBytes != 20 {
+		t.Fatalf("unexpected summaries %+v", summaries)
+	}
+}
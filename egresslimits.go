@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+)
+
+const (
+	egressLimitsChain          = "STEPSECURITY-LIMITS"
+	nflogPrefixLimit           = "stepsecurity-limit-"
+	EgressLimitMatchedPolicy   = "EGRESS_LIMIT"
+	egressLimitLogRate         = "1/sec"
+	egressLimitHashlimitExpire = "3600000" // ms, entries of the hashlimit tables live for the job
+	// the quota rules of each destination, the agent adds them when nflog reports a new destination
+	egressLimitDestinationsChain = "STEPSECURITY-LIMIT-DSTS"
+	nflogPrefixNewDestination    = "stepsecurity-new-destination"
+	maxQuotaDestinations         = 1000
+)
+
+// EgressLimits are optional limits on outbound traffic, a zero value is no limit.
+// Destination limits apply to each destination IP address.
+type EgressLimits struct {
+	ConnectionsPerSecond            uint   `json:"connections_per_second"`
+	BytesPerJob                     uint64 `json:"bytes_per_job"`
+	DestinationConnectionsPerSecond uint   `json:"destination_connections_per_second"`
+	DestinationMaxConnections       uint   `json:"destination_max_connections"`
+	DestinationBytesPerSecond       uint64 `json:"destination_bytes_per_second"`
+	DestinationBytesPerJob          uint64 `json:"destination_bytes_per_job"`
+}
+
+// egressLimit is one limit, with its own chain that logs, and in block mode drops, the packets over the limit.
+type egressLimit struct {
+	name           string
+	description    string
+	match          []string
+	perDestination bool // matched by the quota rules of each destination instead of match
+}
+
+func (limit egressLimit) chain() string {
+	// chain names are at most 28 characters
+	return "STEPSECURITY-" + strings.ToUpper(limit.name)
+}
+
+func (limit egressLimit) nflogPrefix() string {
+	return nflogPrefixLimit + limit.name
+}
+
+// rules returns the configured limits, in the order they are matched.
+func (limits *EgressLimits) rules() []egressLimit {
+	if limits == nil {
+		return nil
+	}
+
+	newConnections := []string{"-m", "conntrack", "--ctstate", "NEW"}
+	var rules []egressLimit
+
+	if limits.ConnectionsPerSecond > 0 {
+		rules = append(rules, egressLimit{
+			name:        "conn-rate",
+			description: fmt.Sprintf("%d connections per second", limits.ConnectionsPerSecond),
+			match: append(append([]string{}, newConnections...), "-m", "hashlimit",
+				"--hashlimit-above", fmt.Sprintf("%d/sec", limits.ConnectionsPerSecond),
+				"--hashlimit-burst", fmt.Sprintf("%d", limits.ConnectionsPerSecond),
+				"--hashlimit-name", "ss-conn-rate"),
+		})
+	}
+
+	if limits.DestinationConnectionsPerSecond > 0 {
+		rules = append(rules, egressLimit{
+			name:        "dst-conn-rate",
+			description: fmt.Sprintf("%d connections per second per destination", limits.DestinationConnectionsPerSecond),
+			match: append(append([]string{}, newConnections...), "-m", "hashlimit",
+				"--hashlimit-above", fmt.Sprintf("%d/sec", limits.DestinationConnectionsPerSecond),
+				"--hashlimit-burst", fmt.Sprintf("%d", limits.DestinationConnectionsPerSecond),
+				"--hashlimit-mode", "dstip",
+				"--hashlimit-htable-expire", egressLimitHashlimitExpire,
+				"--hashlimit-name", "ss-dst-conn"),
+		})
+	}
+
+	if limits.DestinationMaxConnections > 0 {
+		rules = append(rules, egressLimit{
+			name:        "dst-conn",
+			description: fmt.Sprintf("%d open connections per destination", limits.DestinationMaxConnections),
+			match: []string{protocol, tcp, "--syn", "-m", "connlimit",
+				"--connlimit-above", fmt.Sprintf("%d", limits.DestinationMaxConnections),
+				"--connlimit-mask", "32", "--connlimit-daddr"},
+		})
+	}
+
+	if limits.DestinationBytesPerSecond > 0 {
+		rules = append(rules, egressLimit{
+			name:        "dst-bandwidth",
+			description: fmt.Sprintf("%d bytes per second per destination", limits.DestinationBytesPerSecond),
+			match: []string{"-m", "hashlimit",
+				"--hashlimit-above", fmt.Sprintf("%db/s", limits.DestinationBytesPerSecond),
+				"--hashlimit-mode", "dstip",
+				"--hashlimit-htable-expire", egressLimitHashlimitExpire,
+				"--hashlimit-name", "ss-dst-bw"},
+		})
+	}
+
+	if limits.BytesPerJob > 0 {
+		rules = append(rules, egressLimit{
+			name:        "job-bytes",
+			description: fmt.Sprintf("%d bytes per job", limits.BytesPerJob),
+			// the quota matches until it is used up, inverted it matches after
+			match: []string{"-m", "quota", "!", "--quota", fmt.Sprintf("%d", limits.BytesPerJob)},
+		})
+	}
+
+	if limits.DestinationBytesPerJob > 0 {
+		rules = append(rules, egressLimit{
+			name:           "dst-bytes",
+			description:    fmt.Sprintf("%d bytes per job per destination", limits.DestinationBytesPerJob),
+			perDestination: true,
+		})
+	}
+
+	return rules
+}
+
+// egressLimitForPrefix returns the description of the limit that logged a packet.
+func (limits *EgressLimits) egressLimitForPrefix(prefix string) (string, bool) {
+	if !strings.HasPrefix(prefix, nflogPrefixLimit) {
+		return "", false
+	}
+
+	for _, limit := range limits.rules() {
+		if limit.nflogPrefix() == prefix {
+			return limit.description, true
+		}
+	}
+
+	return strings.TrimPrefix(prefix, nflogPrefixLimit), true
+}
+
+// AddEgressLimitRules sends outbound traffic through a chain that matches the limits.
+// Packets over a limit are logged to nflog at most once a second per limit, and dropped if drop is set.
+// The agent's own traffic is not limited.
+func AddEgressLimitRules(firewall *Firewall, limits *EgressLimits, drop bool) error {
+	rules := limits.rules()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var ipt IPTables
+	var err error
+	if firewall == nil {
+		ipt, err = iptables.New()
+		if err != nil {
+			return errors.Wrap(err, "new iptables failed")
+		}
+	} else {
+		ipt = firewall.IPTables
+	}
+
+	// ClearChain creates the chain if it does not exist
+	if err := ipt.ClearChain(mangleTable, egressLimitsChain); err != nil {
+		return errors.Wrap(err, "failed to create egress limits chain")
+	}
+
+	for _, limit := range rules {
+		if err := ipt.ClearChain(mangleTable, limit.chain()); err != nil {
+			return errors.Wrapf(err, "failed to create egress limit chain:%s", limit.chain())
+		}
+
+		err := ipt.Append(mangleTable, limit.chain(), "-m", "limit", "--limit", egressLimitLogRate,
+			target, nflogTarget, "--nflog-group", nflogGroup, nflogPrefix, limit.nflogPrefix())
+		if err != nil {
+			return errors.Wrapf(err, "failed to add egress limit nflog rule chain:%s", limit.chain())
+		}
+
+		if drop {
+			if err := ipt.Append(mangleTable, limit.chain(), target, "DROP"); err != nil {
+				return errors.Wrapf(err, "failed to add egress limit drop rule chain:%s", limit.chain())
+			}
+		}
+
+		jump := append(limit.match, target, limit.chain())
+		if limit.perDestination {
+			// new destinations are logged until the agent adds their quota rules
+			if err := ipt.ClearChain(mangleTable, egressLimitDestinationsChain); err != nil {
+				return errors.Wrap(err, "failed to create egress limit destinations chain")
+			}
+			err := ipt.Append(mangleTable, egressLimitDestinationsChain, "-m", "conntrack", "--ctstate", "NEW",
+				target, nflogTarget, "--nflog-group", nflogGroup, nflogPrefix, nflogPrefixNewDestination)
+			if err != nil {
+				return errors.Wrap(err, "failed to add egress limit new destination rule")
+			}
+			jump = []string{target, egressLimitDestinationsChain}
+		}
+
+		if err := ipt.Append(mangleTable, egressLimitsChain, jump...); err != nil {
+			return errors.Wrapf(err, "failed to add egress limit rule:%s", limit.name)
+		}
+	}
+
+	agentUID := fmt.Sprintf("%d", os.Getuid())
+	err = ipt.Append(mangleTable, outputChain, outbound, defaultInterface, "-m", "owner", "!", "--uid-owner", agentUID, target, egressLimitsChain)
+	if err != nil {
+		return errors.Wrap(err, "failed to add egress limits rule for default interface")
+	}
+
+	err = ipt.Append(mangleTable, forwardChain, inbound, dockerInterface, target, egressLimitsChain)
+	if err != nil {
+		return errors.Wrap(err, "failed to add egress limits rule for docker interface")
+	}
+
+	return nil
+}
+
+// revertEgressLimitRules deletes the limit chains, after the rules that jump to them are cleared.
+func revertEgressLimitRules(ipt IPTables) {
+	ipt.ClearAndDeleteChain(mangleTable, egressLimitsChain)
+	ipt.ClearAndDeleteChain(mangleTable, egressLimitDestinationsChain)
+
+	all := &EgressLimits{ConnectionsPerSecond: 1, BytesPerJob: 1, DestinationConnectionsPerSecond: 1,
+		DestinationMaxConnections: 1, DestinationBytesPerSecond: 1, DestinationBytesPerJob: 1}
+	for _, limit := range all.rules() {
+		ipt.ClearAndDeleteChain(mangleTable, limit.chain())
+	}
+}
+
+// handleEgressLimit reports a packet over a limit, once per limit and destination, and annotates the first one of each limit.
+func (netMonitor *NetworkMonitor) handleEgressLimit(ipAddress, port, prefix string, transport string, srcPort, dstPort uint16, timestamp time.Time) {
+	description, _ := netMonitor.EgressLimits.egressLimitForPrefix(prefix)
+
+	// in block mode the packets over a limit are dropped
+	status := netMonitor.Status
+
+	cacheKey := fmt.Sprintf("%s:%s", net.JoinHostPort(ipAddress, port), prefix)
+	if !netMonitor.flows().ShouldReport(cacheKey) {
+		return
+	}
+
+	// the first packet over each limit is annotated
+	netMonitor.limitsMutex.Lock()
+	if netMonitor.annotatedLimits == nil {
+		netMonitor.annotatedLimits = make(map[string]bool)
+	}
+	annotate := !netMonitor.annotatedLimits[prefix]
+	netMonitor.annotatedLimits[prefix] = true
+	netMonitor.limitsMutex.Unlock()
+
+	destination := ipAddress
+	if netMonitor.DNSProxy != nil {
+		if domainName := netMonitor.DNSProxy.GetReverseIPLookup(ipAddress); domainName != "" {
+			destination = strings.TrimSuffix(domainName, ".")
+		}
+	}
+
+	reason := fmt.Sprintf("egress limit of %s exceeded", description)
+	networkConnection := &NetworkConnection{IPAddress: ipAddress, Port: port, Status: status, TimeStamp: timestamp,
+		Tool: netMonitor.toolForPacket(transport, srcPort, net.ParseIP(ipAddress), dstPort), MatchedPolicy: EgressLimitMatchedPolicy, Reason: reason}
+	netMonitor.sendTelemetry(func() {
+		netMonitor.ApiClient.sendNetworkConnection(netMonitor.CorrelationId, netMonitor.Repo, networkConnection)
+		WriteLog(fmt.Sprintf("%s to %s, status: %s", reason, destination, status))
+		if annotate {
+			WriteAnnotation(fmt.Sprintf("%s Traffic to %s exceeded the egress limit of %s", StepSecurityAnnotationPrefix, destination, description))
+		}
+	})
+}
+
+// addDestinationQuota adds the quota rules of a destination the first time nflog reports it. Packets within
+// the quota return, the others go to the limit chain. Packets sent before the rules are added are not counted.
+func (netMonitor *NetworkMonitor) addDestinationQuota(ipAddress string) {
+	if netMonitor.EgressLimits == nil || netMonitor.EgressLimits.DestinationBytesPerJob == 0 {
+		return
+	}
+	if ip := net.ParseIP(ipAddress); ip == nil || ip.To4() == nil {
+		return
+	}
+
+	netMonitor.limitsMutex.Lock()
+	defer netMonitor.limitsMutex.Unlock()
+
+	if netMonitor.quotaDestinations == nil {
+		netMonitor.quotaDestinations = make(map[string]bool)
+	}
+	if netMonitor.quotaDestinations[ipAddress] || len(netMonitor.quotaDestinations) >= maxQuotaDestinations {
+		return
+	}
+
+	var ipt IPTables
+	var err error
+	if netMonitor.Firewall == nil {
+		ipt, err = iptables.New()
+		if err != nil {
+			WriteLog(fmt.Sprintf("failed to add egress limit quota for destination %s: new iptables failed %v", ipAddress, err))
+			return
+		}
+	} else {
+		ipt = netMonitor.Firewall.IPTables
+	}
+
+	limitChain := egressLimit{name: "dst-bytes"}.chain()
+	quota := fmt.Sprintf("%d", netMonitor.EgressLimits.DestinationBytesPerJob)
+
+	// the quota rule goes first, so a destination is not limited if adding the jump fails
+	if err := ipt.Insert(mangleTable, egressLimitDestinationsChain, 1, "-d", ipAddress, "-m", "quota", "--quota", quota, target, "RETURN"); err != nil {
+		WriteLog(fmt.Sprintf("failed to add egress limit quota for destination %s: %v", ipAddress, err))
+		return
+	}
+	if err := ipt.Insert(mangleTable, egressLimitDestinationsChain, 2, "-d", ipAddress, target, limitChain); err != nil {
+		WriteLog(fmt.Sprintf("failed to add egress limit rule for destination %s: %v", ipAddress, err))
+	}
+
+	netMonitor.quotaDestinations[ipAddress] = true
+	if len(netMonitor.quotaDestinations) == maxQuotaDestinations {
+		WriteLog(fmt.Sprintf("egress limit of bytes per destination applies to the first %d destinations only", maxQuotaDestinations))
+	}
+}
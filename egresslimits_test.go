@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/florianl/go-nflog/v2"
+	"github.com/google/gopacket/layers"
+)
+
+func TestAddEgressLimitRules(t *testing.T) {
+	limits := &EgressLimits{ConnectionsPerSecond: 50, BytesPerJob: 1 << 30, DestinationConnectionsPerSecond: 10,
+		DestinationMaxConnections: 100, DestinationBytesPerSecond: 10 << 20, DestinationBytesPerJob: 100 << 20}
+
+	tests := []struct {
+		name   string
+		limits *EgressLimits
+		drop   bool
+		rules  int
+	}{
+		{name: "no limits", limits: nil, rules: 0},
+		{name: "empty limits", limits: &EgressLimits{}, rules: 0},
+		// per limit a log rule, a drop rule and a jump, the new destination rule, then a jump from OUTPUT and FORWARD
+		{name: "block", limits: limits, drop: true, rules: 6*3 + 1 + 2},
+		{name: "audit", limits: limits, drop: false, rules: 6*2 + 1 + 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipt := &recorderIPTables{}
+			if err := AddEgressLimitRules(&Firewall{ipt}, tt.limits, tt.drop); err != nil {
+				t.Fatalf("AddEgressLimitRules() error = %v", err)
+			}
+
+			if len(ipt.appended) != tt.rules {
+				t.Fatalf("expected %d rules, got %d", tt.rules, len(ipt.appended))
+			}
+
+			drops := 0
+			for _, record := range ipt.appended {
+				if record[0] != mangleTable {
+					t.Fatalf("expected rule in mangle table, got %#v", record)
+				}
+				if insertedRuleTarget(record) == "DROP" {
+					drops++
+				}
+			}
+			if tt.drop != (drops > 0) {
+				t.Fatalf("expected drop rules %v, got %d", tt.drop, drops)
+			}
+		})
+	}
+}
+
+func TestEgressLimits_rules(t *testing.T) {
+	limits := &EgressLimits{ConnectionsPerSecond: 1, BytesPerJob: 1, DestinationConnectionsPerSecond: 1,
+		DestinationMaxConnections: 1, DestinationBytesPerSecond: 1, DestinationBytesPerJob: 1}
+
+	for _, limit := range limits.rules() {
+		if len(limit.chain()) > 28 {
+			t.Errorf("chain name %s is longer than 28 characters", limit.chain())
+		}
+		for i, arg := range limit.match {
+			if arg == "--hashlimit-name" && len(limit.match[i+1]) > 15 {
+				t.Errorf("hashlimit name %s is longer than 15 characters", limit.match[i+1])
+			}
+		}
+
+		description, found := limits.egressLimitForPrefix(limit.nflogPrefix())
+		if !found || description != limit.description {
+			t.Errorf("egressLimitForPrefix(%s) = %s, want %s", limit.nflogPrefix(), description, limit.description)
+		}
+	}
+
+	if _, found := limits.egressLimitForPrefix(nflogPrefixBlocked); found {
+		t.Errorf("expected no limit for prefix %s", nflogPrefixBlocked)
+	}
+}
+
+func TestNetworkMonitor_handlePacket_EgressLimit(t *testing.T) {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.1.0.4"), DstIP: net.ParseIP("140.82.112.3")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, ACK: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	payload := serializePacket(t, ip, tcp)
+
+	filePath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+	fileSink, err := NewFileTelemetrySink(filePath)
+	if err != nil {
+		t.Fatalf("NewFileTelemetrySink() error = %v", err)
+	}
+	apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{fileSink}}
+	limits := &EgressLimits{DestinationBytesPerSecond: 1024}
+	netMonitor := &NetworkMonitor{CorrelationId: "123", Repo: "owner/repo", ApiClient: apiclient, EgressLimits: limits, Status: "Dropped"}
+
+	prefix := limits.rules()[0].nflogPrefix()
+	netMonitor.handlePacket(nflog.Attribute{Payload: &payload, Prefix: &prefix})
+	// the limit is reported once per destination
+	netMonitor.handlePacket(nflog.Attribute{Payload: &payload, Prefix: &prefix})
+	apiclient.closeTelemetrySinks()
+
+	data, _ := os.ReadFile(filePath)
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 network connection, got %d", len(lines))
+	}
+
+	var event struct {
+		Data NetworkConnection `json:"data"`
+	}
+	json.Unmarshal(lines[0], &event)
+	if event.Data.IPAddress != "140.82.112.3" || event.Data.Status != "Dropped" || event.Data.MatchedPolicy != EgressLimitMatchedPolicy {
+		t.Fatalf("unexpected network connection %+v", event.Data)
+	}
+}
+
+func TestNetworkMonitor_handlePacket_NewDestination(t *testing.T) {
+	packet := func(dst string) []byte {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.1.0.4"), DstIP: net.ParseIP(dst)}
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		return serializePacket(t, ip, tcp)
+	}
+
+	ipt := &recorderIPTables{}
+	netMonitor := &NetworkMonitor{CorrelationId: "123", Repo: "owner/repo", EgressLimits: &EgressLimits{DestinationBytesPerJob: 1024},
+		Firewall: &Firewall{ipt}, Status: "Dropped"}
+
+	prefix := nflogPrefixNewDestination
+	for _, dst := range []string{"140.82.112.3", "140.82.112.3", "140.82.112.4"} {
+		payload := packet(dst)
+		netMonitor.handlePacket(nflog.Attribute{Payload: &payload, Prefix: &prefix})
+	}
+
+	// a quota rule and a jump to the limit chain per destination
+	if len(ipt.inserted) != 4 {
+		t.Fatalf("expected 4 rules, got %v", ipt.inserted)
+	}
+	limitChain := (&EgressLimits{DestinationBytesPerJob: 1}).rules()[0].chain()
+	if quota := ipt.inserted[0]; quota[1] != egressLimitDestinationsChain || insertedRuleTarget(quota) != "RETURN" {
+		t.Fatalf("unexpected quota rule %v", quota)
+	}
+	if jump := ipt.inserted[1]; jump[1] != egressLimitDestinationsChain || insertedRuleTarget(jump) != limitChain {
+		t.Fatalf("unexpected limit rule %v", jump)
+	}
+}
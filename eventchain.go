@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	jobKeyDerivationLabel = "stepsecurity-agent-job-key:"
+	agentLogChainPath     = "/home/agent/agent.log.chain"
+)
+
+// ChainLink makes a record tamper-evident.
+// Hash is SHA256(PrevHash || "\n" || Seq || "\n" || record) and Signature is HMAC-SHA256(job key, Hash),
+// so removing, reordering or editing a record breaks every link after it,
+// and links cannot be recomputed without the job key.
+type ChainLink struct {
+	Seq       uint64 `json:"seq"`
+	PrevHash  string `json:"prev_hash"`
+	Hash      string `json:"hash"`
+	Signature string `json:"signature"`
+}
+
+// EventChain hands out consecutive links for a sequence of records.
+type EventChain struct {
+	key      []byte
+	prevHash string
+	seq      uint64
+	mutex    sync.Mutex
+}
+
+// deriveJobKey derives the per-job signing key from the one-time key,
+// which is shared with the backend, and the job correlation id.
+// Without a one-time key a random key is used, so records are still chained
+// but can only be verified by this process.
+func deriveJobKey(oneTimeKey, correlationId string) []byte {
+	if oneTimeKey == "" {
+		key := make([]byte, sha256.Size)
+		rand.Read(key)
+		return key
+	}
+
+	mac := hmac.New(sha256.New, []byte(oneTimeKey))
+	mac.Write([]byte(jobKeyDerivationLabel + correlationId))
+	return mac.Sum(nil)
+}
+
+func NewEventChain(key []byte) *EventChain {
+	return &EventChain{key: key}
+}
+
+// Append links the record to the previous one and returns the link.
+func (chain *EventChain) Append(record []byte) ChainLink {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	chain.seq++
+	link := newChainLink(chain.key, chain.seq, chain.prevHash, record)
+	chain.prevHash = link.Hash
+
+	return link
+}
+
+// Head returns the sequence and hash of the last link.
+func (chain *EventChain) Head() (uint64, string) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	return chain.seq, chain.prevHash
+}
+
+// Sign returns the HMAC of data with the job key, hex encoded.
+func (chain *EventChain) Sign(data []byte) string {
+	mac := hmac.New(sha256.New, chain.key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newChainLink(key []byte, seq uint64, prevHash string, record []byte) ChainLink {
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("%s\n%d\n", prevHash, seq)))
+	h.Write(record)
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(hash))
+
+	return ChainLink{Seq: seq, PrevHash: prevHash, Hash: hash, Signature: hex.EncodeToString(mac.Sum(nil))}
+}
+
+// VerifyChain checks records against their links, in order.
+// It returns the number of records that verified before the first failure.
+func VerifyChain(key []byte, records [][]byte, links []ChainLink) (int, error) {
+	if len(records) != len(links) {
+		return 0, fmt.Errorf("record count %d does not match link count %d", len(records), len(links))
+	}
+
+	prevHash := ""
+	for i, record := range records {
+		link := links[i]
+		if link.Seq != uint64(i+1) {
+			return i, fmt.Errorf("record %d: unexpected sequence %d, records were removed or reordered", i, link.Seq)
+		}
+
+		expected := newChainLink(key, link.Seq, prevHash, record)
+		if link.PrevHash != prevHash || link.Hash != expected.Hash {
+			return i, fmt.Errorf("record %d: hash mismatch, record was modified", i)
+		}
+		if !hmac.Equal([]byte(link.Signature), []byte(expected.Signature)) {
+			return i, fmt.Errorf("record %d: invalid signature", i)
+		}
+
+		prevHash = link.Hash
+	}
+
+	return len(records), nil
+}
+
+// logChainEntry is one line of agent.log.chain, locating the record in agent.log.
+type logChainEntry struct {
+	Offset int64 `json:"offset"`
+	Length int   `json:"length"`
+	ChainLink
+}
+
+// logChain signs every line written to agent.log once InitLogChain is called.
+var logChain *EventChain
+
+func InitLogChain(key []byte) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	logChain = NewEventChain(key)
+}
+
+// logChainHead returns the head of the agent.log chain as "seq:hash",
+// which is sent with telemetry so the backend can detect truncation of agent.log and its chain together.
+func logChainHead() string {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	if logChain == nil {
+		return ""
+	}
+
+	seq, hash := logChain.Head()
+	return fmt.Sprintf("%d:%s", seq, hash)
+}
+
+// appendLogChain records the link for a line written at offset in agent.log.
+// Callers must hold logMutex.
+func appendLogChain(chainPath string, offset int64, line []byte) {
+	if logChain == nil {
+		return
+	}
+
+	entry := logChainEntry{Offset: offset, Length: len(line), ChainLink: logChain.Append(line)}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	// readable by the agent only, so other processes cannot read the signatures
+	f, err := os.OpenFile(chainPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	f.Write(append(data, '\n'))
+}
+
+// VerifyLogChain checks agent.log against agent.log.chain.
+// It detects edited lines, removed lines and truncation of the log after the last signed line.
+func VerifyLogChain(logPath, chainPath string, key []byte) error {
+	logFile, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	chainFile, err := os.Open(chainPath)
+	if err != nil {
+		return err
+	}
+	defer chainFile.Close()
+
+	records := [][]byte{}
+	links := []ChainLink{}
+	scanner := bufio.NewScanner(chainFile)
+	for scanner.Scan() {
+		var entry logChainEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("invalid chain entry %d: %v", len(links), err)
+		}
+
+		record := make([]byte, entry.Length)
+		if _, err := logFile.ReadAt(record, entry.Offset); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("record %d: agent.log was truncated", len(links))
+			}
+			return err
+		}
+
+		records = append(records, record)
+		links = append(links, entry.ChainLink)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	_, err = VerifyChain(key, records, links)
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestEventChain_Verify(t *testing.T) {
+	key := deriveJobKey("one-time-key", "123")
+	if !bytes.Equal(key, deriveJobKey("one-time-key", "123")) {
+		t.Fatalf("expected job key derivation to be deterministic")
+	}
+	if bytes.Equal(key, deriveJobKey("one-time-key", "456")) {
+		t.Fatalf("expected job key to depend on the correlation id")
+	}
+
+	chain := NewEventChain(key)
+	records := [][]byte{[]byte("record 1"), []byte("record 2"), []byte("record 3")}
+	links := []ChainLink{}
+	for _, record := range records {
+		links = append(links, chain.Append(record))
+	}
+
+	if n, err := VerifyChain(key, records, links); err != nil || n != 3 {
+		t.Fatalf("VerifyChain() = %d, %v", n, err)
+	}
+
+	tampered := [][]byte{records[0], []byte("record X"), records[2]}
+	if n, err := VerifyChain(key, tampered, links); err == nil || n != 1 {
+		t.Fatalf("expected modified record to fail at index 1, got %d, %v", n, err)
+	}
+
+	if _, err := VerifyChain(key, [][]byte{records[0], records[2]}, []ChainLink{links[0], links[2]}); err == nil {
+		t.Fatalf("expected removed record to fail verification")
+	}
+
+	if _, err := VerifyChain(deriveJobKey("other-key", "123"), records, links); err == nil {
+		t.Fatalf("expected verification with another key to fail")
+	}
+}
+
+func TestVerifyLogChain(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "agent.log")
+	chainPath := filepath.Join(dir, "agent.log.chain")
+	key := deriveJobKey("one-time-key", "123")
+
+	logMutex.Lock()
+	previousChain := logChain
+	logChain = NewEventChain(key)
+	offset := int64(0)
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n"} {
+		f, _ := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		f.WriteString(line)
+		f.Close()
+		appendLogChain(chainPath, offset, []byte(line))
+		offset += int64(len(line))
+	}
+	logChain = previousChain
+	logMutex.Unlock()
+
+	if err := VerifyLogChain(logPath, chainPath, key); err != nil {
+		t.Fatalf("VerifyLogChain() error = %v", err)
+	}
+	if info, err := os.Stat(chainPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the chain readable by the agent only, got %v, %v", info.Mode(), err)
+	}
+
+	// a step edits the log
+	os.WriteFile(logPath, []byte("line 1\nline X\nline 3\n"), 0644)
+	if err := VerifyLogChain(logPath, chainPath, key); err == nil {
+		t.Fatalf("expected edited log to fail verification")
+	}
+
+	// a step truncates the log
+	os.WriteFile(logPath, []byte("line 1\n"), 0644)
+	if err := VerifyLogChain(logPath, chainPath, key); err == nil {
+		t.Fatalf("expected truncated log to fail verification")
+	}
+}
+
+func TestApiClient_sendTelemetry_Chained(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+	fileSink, err := NewFileTelemetrySink(filePath)
+	if err != nil {
+		t.Fatalf("NewFileTelemetrySink() error = %v", err)
+	}
+
+	key := deriveJobKey("one-time-key", "123")
+	apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{fileSink}, Chain: NewEventChain(key)}
+	apiclient.sendDNSRecord("123", "owner/repo", "example.com.", "1.2.3.4", "", "")
+	apiclient.sendDNSRecord("123", "owner/repo", "example.org.", "5.6.7.8", "", "")
+	apiclient.closeTelemetrySinks()
+
+	data, _ := os.ReadFile(filePath)
+	records := [][]byte{}
+	links := []ChainLink{}
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var event TelemetryEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			t.Fatalf("invalid json line: %v", err)
+		}
+		if event.Chain == nil {
+			t.Fatalf("expected event to be chained")
+		}
+		links = append(links, *event.Chain)
+
+		// the link covers the event as marshaled without the chain
+		var raw map[string]json.RawMessage
+		json.Unmarshal(line, &raw)
+		unchained := &TelemetryEvent{Type: event.Type, CorrelationId: event.CorrelationId, Repo: event.Repo, Data: raw["data"]}
+		record, _ := json.Marshal(unchained)
+		records = append(records, record)
+	}
+
+	if n, err := VerifyChain(key, records, links); err != nil || n != 2 {
+		t.Fatalf("VerifyChain() = %d, %v", n, err)
+	}
+}
+
+func TestApiClient_sendTelemetry_ChainOrder(t *testing.T) {
+	pipeline := newTestPipeline(&recordingBatchSink{}, t.TempDir())
+	pipeline.queue = make(chan *TelemetryEvent, 100)
+	apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{pipeline}, Chain: NewEventChain(deriveJobKey("one-time-key", "123"))}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				apiclient.sendDNSRecord("123", "owner/repo", "example.com.", "1.2.3.4", "", "")
+			}
+		}()
+	}
+	wg.Wait()
+	close(pipeline.queue)
+
+	seq := uint64(0)
+	for event := range pipeline.queue {
+		if event.Chain.Seq != seq+1 {
+			t.Fatalf("expected seq %d, got %d", seq+1, event.Chain.Seq)
+		}
+		seq = event.Chain.Seq
+	}
+}
+
+func TestApiClient_sendTelemetry_RecordsDrops(t *testing.T) {
+	pipeline := newTestPipeline(&recordingBatchSink{}, t.TempDir())
+	pipeline.queue = make(chan *TelemetryEvent, 1)
+	key := deriveJobKey("one-time-key", "123")
+	apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{pipeline}, Chain: NewEventChain(key)}
+
+	first := &TelemetryEvent{Type: telemetryTypeDNS, CorrelationId: "123", Repo: "owner/repo", Data: &DNSRecord{DomainName: "example.com."}}
+	second := &TelemetryEvent{Type: telemetryTypeDNS, CorrelationId: "123", Repo: "owner/repo", Data: &DNSRecord{DomainName: "example.org."}}
+	if err := apiclient.sendTelemetry(first); err != nil {
+		t.Fatalf("sendTelemetry() error = %v", err)
+	}
+	if err := apiclient.sendTelemetry(second); err == nil {
+		t.Fatalf("expected the second event to be dropped")
+	}
+
+	// the drop is linked after the dropped event
+	record, _ := json.Marshal(telemetryDrop{Seq: second.Chain.Seq, Sink: pipeline.Name()})
+	expected := newChainLink(key, 3, second.Chain.Hash, record)
+	if seq, hash := apiclient.Chain.Head(); seq != expected.Seq || hash != expected.Hash {
+		t.Fatalf("expected the drop as link %d %s, got %d %s", expected.Seq, expected.Hash, seq, hash)
+	}
+
+	// and reported with the next API request
+	drops := apiclient.pendingTelemetryDrops()
+	if len(drops) != 1 || drops[0].telemetryDrop.Seq != second.Chain.Seq || drops[0].ChainLink.Hash != expected.Hash {
+		t.Fatalf("expected the drop to be pending, got %+v", drops)
+	}
+}
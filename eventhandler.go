@@ -19,32 +19,79 @@ import (
 )
 
 type EventHandler struct {
-	CorrelationId           string
-	Repo                    string
-	ApiClient               *ApiClient
-	DNSProxy                *DNSProxy
-	ProcessConnectionMap    map[string]bool
-	ProcessFileMap          map[string]bool
-	ProcessMap              map[string]*Process
-	SourceCodeMap           map[string][]*Event
-	FileOverwriteCounterMap map[string]int // to count file overwrites by an exe
-	netMutex                sync.RWMutex
-	fileMutex               sync.RWMutex
-	procMutex               sync.RWMutex
+	CorrelationId        string
+	Repo                 string
+	ApiClient            *ApiClient
+	DNSProxy             *DNSProxy
+	ProcessConnectionMap map[string]bool
+	ProcessFileMap       map[string]bool
+	ProcessMap           map[string]*Process
+	EgressAccounting     *EgressAccounting
+	CredentialFiles      []credentialFile
+	FileCommands         *FileCommandMonitor
+	Integrity            *IntegrityMonitor
+	ProcessMonitor       *ProcessMonitor
+	NetworkMonitor       *NetworkMonitor
+	netMutex             sync.RWMutex
+	fileMutex            sync.RWMutex
+	procMutex            sync.RWMutex
+}
+
+func NewEventHandler(correlationId, repo string, apiclient *ApiClient, dnsProxy *DNSProxy) *EventHandler {
+	return &EventHandler{
+		CorrelationId:        correlationId,
+		Repo:                 repo,
+		ApiClient:            apiclient,
+		DNSProxy:             dnsProxy,
+		ProcessConnectionMap: make(map[string]bool),
+		ProcessFileMap:       make(map[string]bool),
+		ProcessMap:           make(map[string]*Process),
+	}
 }
 
 var classAPrivateSubnet, classBPrivateSubnet, classCPrivateSubnet, loopBackSubnet, ipv6LinkLocalSubnet, ipv6LocalSubnet *net.IPNet
+var privateSubnetsOnce sync.Once
 
 func (eventHandler *EventHandler) handleFileEvent(event *Event) {
 
 	if !strings.HasPrefix(event.FileName, "/") {
 		event.FileName = path.Join(event.Path, event.FileName)
 	}
+	if event.SourceFileName != "" && !strings.HasPrefix(event.SourceFileName, "/") {
+		event.SourceFileName = path.Join(event.Path, event.SourceFileName)
+	}
+
+	if event.Severity != "" {
+		eventHandler.reportWatchedFile(event, "write")
+	}
+
+	if eventHandler.Integrity != nil {
+		eventHandler.Integrity.recordWrite(event)
+	}
 
 	if strings.Contains(event.FileName, "post_event.json") {
 		WriteLog("\n")
 		WriteLog("post_event called")
 
+		// report before the post step reads the log
+		if eventHandler.EgressAccounting != nil {
+			eventHandler.EgressAccounting.Report()
+		}
+		if eventHandler.Integrity != nil {
+			eventHandler.Integrity.Report()
+		}
+		if eventHandler.NetworkMonitor != nil {
+			eventHandler.NetworkMonitor.ReportStats()
+		}
+
+		// the agent is not stopped at the end of the job, so its audit rules are removed now
+		revertAuditRules(eventHandler.ProcessMonitor)
+
+		// the agent is not stopped, so the telemetry queued by the pipeline is delivered now
+		if eventHandler.ApiClient != nil {
+			eventHandler.ApiClient.flushTelemetrySinks()
+		}
+
 		// send done signal to post step
 		writeDone()
 	}
@@ -60,47 +107,21 @@ func (eventHandler *EventHandler) handleFileEvent(event *Event) {
 	// Uncomment to log file writes (only uncomment in INT env)
 	// WriteLog(fmt.Sprintf("file write %s, syscall %s", event.FileName, event.Syscall))
 
-	if isSourceCodeFile(event.FileName) {
-		eventHandler.fileMutex.Lock()
-		defer eventHandler.fileMutex.Unlock()
-
-		_, found := eventHandler.SourceCodeMap[event.FileName]
-		if !found {
-			eventHandler.SourceCodeMap[event.FileName] = append(eventHandler.SourceCodeMap[event.FileName], event)
-		} else {
-			isFromDifferentProcess := false
-			for _, writeEvent := range eventHandler.SourceCodeMap[event.FileName] {
-				if writeEvent.Pid != event.Pid {
-					isFromDifferentProcess = true
-				}
-			}
-
-			if isFromDifferentProcess {
-				eventHandler.SourceCodeMap[event.FileName] = append(eventHandler.SourceCodeMap[event.FileName], event)
-				counter, found := eventHandler.FileOverwriteCounterMap[event.Exe]
-				if !found || counter < 3 {
-					checksum, err := getProgramChecksum(event.Exe)
-					if err == nil {
-						WriteLog(fmt.Sprintf("[Source code overwritten] file: %s syscall: %s by exe: %s [%s] Timestamp: %s", event.FileName, event.Syscall, event.Exe, checksum, event.Timestamp.Format("2006-01-02T15:04:05.999999999Z")))
-						// WriteAnnotation(fmt.Sprintf("StepSecurity Harden Runner: Source code overwritten file: %s syscall: %s by exe: %s", event.FileName, event.Syscall, event.Exe))
-					}
-
-					eventHandler.FileOverwriteCounterMap[event.Exe]++
-				}
-			}
-		}
-	}
-
 	eventHandler.submitFileEvent(event)
 }
 
-func isSourceCodeFile(fileName string) bool {
-	// If it has an extension or might be a Dockerfile
-	if strings.Contains(fileName, ".") || strings.Contains(fileName, "Dockerfile") {
-		return true
+func (eventHandler *EventHandler) handleFileAccessEvent(event *Event) {
+	if !strings.HasPrefix(event.FileName, "/") {
+		event.FileName = path.Join(event.Path, event.FileName)
 	}
 
-	return false
+	access := "read"
+	if event.Syscall == "execve" || event.Syscall == "execveat" {
+		access = "exec"
+	}
+	eventHandler.reportWatchedFile(event, access)
+
+	eventHandler.submitFileEvent(event)
 }
 
 func (eventHandler *EventHandler) handleProcessEvent(event *Event) {
@@ -171,7 +192,7 @@ func (eventHandler *EventHandler) handleNetworkEvent(event *Event) {
 		// Don't send IPs having v6 for insights
 		!isIPv6(event.IPAddress) {
 
-		cacheKey := fmt.Sprintf("%s%s%s", event.Pid, event.IPAddress, event.Port)
+		cacheKey := processCacheKey(event.Pid, event.IPAddress, event.Port)
 
 		eventHandler.netMutex.Lock()
 		_, found := eventHandler.ProcessConnectionMap[cacheKey]
@@ -181,16 +202,7 @@ func (eventHandler *EventHandler) handleNetworkEvent(event *Event) {
 		eventHandler.netMutex.Unlock()
 
 		if !found {
-			tool := Tool{}
-			image := eventHandler.GetContainerByPid(event.Pid)
-			if image == "" {
-				if event.Exe != "" {
-					tool = *eventHandler.GetToolChain(event.PPid, event.Exe)
-				}
-
-			} else {
-				tool = Tool{Name: image, SHA256: image} // TODO: Set container image checksum
-			}
+			tool, image := eventHandler.GetTool(event.Pid, event.PPid, event.Exe)
 			reverseLookUp := eventHandler.DNSProxy.GetReverseIPLookup(event.IPAddress)
 			status := ""
 			matchedPolicy := ""
@@ -218,8 +230,16 @@ func (eventHandler *EventHandler) HandleEvent(event *Event) {
 		eventHandler.handleNetworkEvent(event)
 	case fileMonitorTag:
 		eventHandler.handleFileEvent(event)
+	case fileAccessMonitorTag:
+		eventHandler.handleFileAccessEvent(event)
+	case credentialMonitorTag:
+		eventHandler.handleCredentialAccessEvent(event)
+	case fileCmdMonitorTag:
+		eventHandler.handleFileCommandEvent(event)
 	case processMonitorTag:
 		eventHandler.handleProcessEvent(event)
+	case rawSocketMonitorTag:
+		eventHandler.handleRawSocketEvent(event)
 	}
 }
 
@@ -359,6 +379,22 @@ func (eventHandler *EventHandler) IsStartedByRunner(ppid, exe string) bool {
 
 }
 
+// GetTool returns the container image the process runs in, or else its tool chain.
+func (eventHandler *EventHandler) GetTool(pid, ppid, exe string) (Tool, string) {
+	tool := Tool{}
+	image := eventHandler.GetContainerByPid(pid)
+	if image == "" {
+		if exe != "" {
+			tool = *eventHandler.GetToolChain(ppid, exe)
+		}
+
+	} else {
+		tool = Tool{Name: image, SHA256: image} // TODO: Set container image checksum
+	}
+
+	return tool, image
+}
+
 func (eventHandler *EventHandler) GetToolChain(ppid, exe string) *Tool {
 	checksum, _ := getProgramChecksum(exe)
 	tool := Tool{Name: filepath.Base(exe), SHA256: checksum}
@@ -395,24 +431,15 @@ func isPrivateIPAddress(ipAddress string) bool {
 		return true
 	}
 
-	if classAPrivateSubnet == nil {
+	// events are handled concurrently
+	privateSubnetsOnce.Do(func() {
 		_, classAPrivateSubnet, _ = net.ParseCIDR(classAPrivateAddressRange)
-	}
-	if classBPrivateSubnet == nil {
 		_, classBPrivateSubnet, _ = net.ParseCIDR(classBPrivateAddressRange)
-	}
-	if classCPrivateSubnet == nil {
 		_, classCPrivateSubnet, _ = net.ParseCIDR(classCPrivateAddressRange)
-	}
-	if loopBackSubnet == nil {
 		_, loopBackSubnet, _ = net.ParseCIDR(loopBackAddressRange)
-	}
-	if ipv6LinkLocalSubnet == nil {
 		_, ipv6LinkLocalSubnet, _ = net.ParseCIDR(ipv6LinkLocalAddressRange)
-	}
-	if ipv6LocalSubnet == nil {
 		_, ipv6LocalSubnet, _ = net.ParseCIDR(ipv6LocalAddressRange)
-	}
+	})
 
 	ip := net.ParseIP(ipAddress)
 
@@ -61,7 +61,6 @@ func TestEventHandler_HandleEvent(t *testing.T) {
 				ProcessConnectionMap: tt.fields.ProcessConnectionMap,
 				ProcessFileMap:       tt.fields.ProcessFileMap,
 				ProcessMap:           tt.fields.ProcessMap,
-				SourceCodeMap:        make(map[string][]*Event),
 				DNSProxy:             proxy,
 			}
 			eventHandler.HandleEvent(tt.args.event)
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileCommandsDirectoryName = "_runner_file_commands"
+	// writes are audited when the file is opened, the content is read after the tool had time to write it
+	fileCommandScanDelay = time.Second
+	hostedToolCache      = "/opt/hostedtoolcache"
+
+	fileCommandEnv    = "GITHUB_ENV"
+	fileCommandPath   = "GITHUB_PATH"
+	fileCommandOutput = "GITHUB_OUTPUT"
+)
+
+// the runner creates a file per step and file command, named with the prefix and a guid
+var fileCommandPrefixes = map[string]string{"set_env_": fileCommandEnv, "add_path_": fileCommandPath, "set_output_": fileCommandOutput}
+
+// variables that change what later steps load or run
+var dangerousEnvironmentVariables = map[string]bool{
+	"LD_PRELOAD": true, "LD_LIBRARY_PATH": true, "LD_AUDIT": true, "NODE_OPTIONS": true, "BASH_ENV": true, "ENV": true,
+	"PATH": true, "PYTHONSTARTUP": true, "PERL5OPT": true, "RUBYOPT": true, "JAVA_TOOL_OPTIONS": true,
+}
+
+// fileCommandEntry is a variable set in GITHUB_ENV or GITHUB_OUTPUT, or a directory added in GITHUB_PATH.
+type fileCommandEntry struct {
+	Name  string
+	Value string
+}
+
+type fileCommandFile struct {
+	command     string
+	writer      *Tool
+	reported    map[fileCommandEntry]bool
+	scanPending bool // a scan is scheduled, later writes are read by it
+}
+
+// FileCommandMonitor reports what steps write to the file commands of the runner, from which
+// an untrusted step can change the environment of every later step.
+type FileCommandMonitor struct {
+	Directory string // _runner_file_commands in the temp directory of the runner
+	files     map[string]*fileCommandFile
+	mutex     sync.Mutex
+}
+
+// fileCommandsDirectory returns the directory of the file commands, in runnerTemp, or in the _temp
+// directory of the work directory that has the working directory, which is work/repo/repo.
+func fileCommandsDirectory(runnerTemp, workingDirectory string) string {
+	if runnerTemp == "" {
+		workDirectory := "/home/runner/work"
+		if workingDirectory != "" {
+			workDirectory = filepath.Dir(filepath.Dir(filepath.Clean(workingDirectory)))
+		}
+		runnerTemp = filepath.Join(workDirectory, "_temp")
+	}
+	return filepath.Join(runnerTemp, fileCommandsDirectoryName)
+}
+
+// fileCommandRules are the audit rules for writes to the file commands.
+func fileCommandRules(directory string) []string {
+	if directory == "" {
+		return nil
+	}
+	return []string{fmt.Sprintf("-a always,exit -F dir=%s -F perm=wa -k %s", directory, auditKey(fileCmdMonitorTag))}
+}
+
+// fileCommandOf returns the file command of a file the runner created for it.
+func fileCommandOf(fileName string) (string, bool) {
+	for prefix, command := range fileCommandPrefixes {
+		if strings.HasPrefix(filepath.Base(fileName), prefix) {
+			return command, true
+		}
+	}
+	return "", false
+}
+
+// parseFileCommand returns the entries of content. Variables are name=value or multiline
+// name<<delimiter, a variable whose delimiter is not written yet is not returned.
+func parseFileCommand(command, content string) []fileCommandEntry {
+	var entries []fileCommandEntry
+	lines := strings.Split(content, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if command == fileCommandPath {
+			entries = append(entries, fileCommandEntry{Name: "PATH", Value: line})
+			continue
+		}
+
+		equals := strings.Index(line, "=")
+		heredoc := strings.Index(line, "<<")
+		if heredoc > 0 && (equals < 0 || heredoc < equals) {
+			name, delimiter := line[:heredoc], line[heredoc+2:]
+			var value []string
+			complete := false
+			for i++; i < len(lines); i++ {
+				if strings.TrimSuffix(lines[i], "\r") == delimiter {
+					complete = true
+					break
+				}
+				value = append(value, lines[i])
+			}
+			if complete {
+				entries = append(entries, fileCommandEntry{Name: name, Value: strings.Join(value, "\n")})
+			}
+			continue
+		}
+
+		if equals > 0 {
+			entries = append(entries, fileCommandEntry{Name: line[:equals], Value: line[equals+1:]})
+		}
+	}
+
+	return entries
+}
+
+// isDangerousFileCommandEntry returns if entry changes what later steps load or run. Directories
+// added to the path are, unless they are in the tool cache, where setup actions install tools.
+func isDangerousFileCommandEntry(command string, entry fileCommandEntry) bool {
+	switch command {
+	case fileCommandEnv:
+		return dangerousEnvironmentVariables[entry.Name]
+	case fileCommandPath:
+		return !strings.HasPrefix(filepath.Clean(entry.Value), hostedToolCache+"/")
+	}
+	return false
+}
+
+func (eventHandler *EventHandler) handleFileCommandEvent(event *Event) {
+	if eventHandler.FileCommands == nil {
+		return
+	}
+
+	if !strings.HasPrefix(event.FileName, "/") {
+		event.FileName = path.Join(event.Path, event.FileName)
+	}
+
+	command, found := fileCommandOf(event.FileName)
+	if !found {
+		return
+	}
+
+	tool := eventHandler.GetToolChain(event.PPid, event.Exe)
+
+	fileCommands := eventHandler.FileCommands
+	fileCommands.mutex.Lock()
+	if fileCommands.files == nil {
+		fileCommands.files = make(map[string]*fileCommandFile)
+	}
+	file, found := fileCommands.files[event.FileName]
+	if !found {
+		file = &fileCommandFile{command: command, reported: make(map[fileCommandEntry]bool)}
+		fileCommands.files[event.FileName] = file
+	}
+	file.writer = tool
+	schedule := !file.scanPending
+	file.scanPending = true
+	fileCommands.mutex.Unlock()
+
+	if schedule {
+		fileName := event.FileName
+		time.AfterFunc(fileCommandScanDelay, func() {
+			fileCommands.scan(fileName)
+		})
+	}
+
+	eventHandler.submitFileEvent(event)
+}
+
+// scan reports the entries of fileName that were not reported yet, as written by its last writer.
+func (fileCommands *FileCommandMonitor) scan(fileName string) []fileCommandEntry {
+	// writes after this point schedule another scan
+	fileCommands.mutex.Lock()
+	file, found := fileCommands.files[fileName]
+	if found {
+		file.scanPending = false
+	}
+	fileCommands.mutex.Unlock()
+
+	if !found {
+		return nil
+	}
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil
+	}
+
+	fileCommands.mutex.Lock()
+
+	var entries []fileCommandEntry
+	for _, entry := range parseFileCommand(file.command, string(content)) {
+		if !file.reported[entry] {
+			file.reported[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	command, writer := file.command, file.writer
+	fileCommands.mutex.Unlock()
+
+	toolChain := formatToolChain(writer)
+	for _, entry := range entries {
+		dangerous := isDangerousFileCommandEntry(command, entry)
+
+		// values of variables may be secrets, only directories of the path are logged
+		logged := entry.Name
+		if command == fileCommandPath {
+			logged = entry.Value
+		}
+		WriteLog(fmt.Sprintf("[File command] %s: %s, tool chain: %s, dangerous: %t", command, logged, toolChain, dangerous))
+
+		if !dangerous {
+			continue
+		}
+		if command == fileCommandPath {
+			WriteAnnotation(fmt.Sprintf("%s %s was prepended to PATH in %s by %s (%s)", StepSecurityAnnotationPrefix, entry.Value, command, writer.Name, toolChain))
+		} else {
+			WriteAnnotation(fmt.Sprintf("%s %s was set in %s by %s (%s)", StepSecurityAnnotationPrefix, entry.Name, command, writer.Name, toolChain))
+		}
+	}
+
+	return entries
+}
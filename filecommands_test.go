@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_parseFileCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		content string
+		want    []fileCommandEntry
+	}{
+		{
+			name:    "variables",
+			command: fileCommandEnv,
+			content: "FOO=bar\nLD_PRELOAD=/tmp/x.so\r\n\nEMPTY=\n",
+			want:    []fileCommandEntry{{Name: "FOO", Value: "bar"}, {Name: "LD_PRELOAD", Value: "/tmp/x.so"}, {Name: "EMPTY"}},
+		},
+		{
+			name:    "multiline variable",
+			command: fileCommandEnv,
+			content: "NODE_OPTIONS<<EOF\n--require\n/tmp/hook.js\nEOF\nFOO=a<<b\n",
+			want:    []fileCommandEntry{{Name: "NODE_OPTIONS", Value: "--require\n/tmp/hook.js"}, {Name: "FOO", Value: "a<<b"}},
+		},
+		{
+			name:    "multiline variable without delimiter yet",
+			command: fileCommandOutput,
+			content: "result<<ghadelimiter_1\npartial",
+		},
+		{
+			name:    "path",
+			command: fileCommandPath,
+			content: "/opt/hostedtoolcache/node/20.0.0/x64/bin\n/tmp/bin\n",
+			want:    []fileCommandEntry{{Name: "PATH", Value: "/opt/hostedtoolcache/node/20.0.0/x64/bin"}, {Name: "PATH", Value: "/tmp/bin"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseFileCommand(tt.command, tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseFileCommand() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isDangerousFileCommandEntry(t *testing.T) {
+	tests := []struct {
+		command string
+		entry   fileCommandEntry
+		want    bool
+	}{
+		{command: fileCommandEnv, entry: fileCommandEntry{Name: "LD_PRELOAD", Value: "/tmp/x.so"}, want: true},
+		{command: fileCommandEnv, entry: fileCommandEntry{Name: "BASH_ENV", Value: "/tmp/env.sh"}, want: true},
+		{command: fileCommandEnv, entry: fileCommandEntry{Name: "NODE_VERSION", Value: "20"}, want: false},
+		{command: fileCommandOutput, entry: fileCommandEntry{Name: "PATH", Value: "/tmp"}, want: false},
+		{command: fileCommandPath, entry: fileCommandEntry{Name: "PATH", Value: "/home/runner/work/repo/repo/bin"}, want: true},
+		{command: fileCommandPath, entry: fileCommandEntry{Name: "PATH", Value: "/opt/hostedtoolcache/go/1.22.0/x64/bin"}, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isDangerousFileCommandEntry(tt.command, tt.entry); got != tt.want {
+			t.Fatalf("isDangerousFileCommandEntry(%s, %+v) = %v, want %v", tt.command, tt.entry, got, tt.want)
+		}
+	}
+}
+
+func Test_fileCommandsDirectory(t *testing.T) {
+	if got := fileCommandsDirectory("/home/runner/work/_temp", ""); got != "/home/runner/work/_temp/_runner_file_commands" {
+		t.Fatalf("fileCommandsDirectory() = %s", got)
+	}
+	if got := fileCommandsDirectory("", "/srv/runner/_work/repo/repo/"); got != "/srv/runner/_work/_temp/_runner_file_commands" {
+		t.Fatalf("fileCommandsDirectory() = %s", got)
+	}
+}
+
+func TestEventHandler_handleFileCommandEvent(t *testing.T) {
+	directory := t.TempDir()
+	envFile := filepath.Join(directory, "set_env_0f4c2a4e-1d2b-4c4e-9a55-62e4f4a7c9a1")
+	os.WriteFile(envFile, []byte("FOO=bar\n"), 0644)
+
+	eventHandler := NewEventHandler("123", "owner/repo", nil, nil)
+	eventHandler.FileCommands = &FileCommandMonitor{Directory: directory}
+	eventHandler.ProcessMap["39005100"] = &Process{PID: "39005100", PPid: "39005000", Exe: "/usr/bin/bash"}
+
+	for _, fileName := range []string{filepath.Base(envFile), filepath.Base(envFile), "step_summary_0f4c2a4e"} {
+		eventHandler.HandleEvent(&Event{EventType: fileCmdMonitorTag, FileName: fileName, Path: directory, Syscall: "openat",
+			Exe: "/usr/bin/bash", Pid: "39005101", PPid: "39005100"})
+	}
+
+	// only the files of GITHUB_ENV, GITHUB_PATH and GITHUB_OUTPUT are scanned
+	if len(eventHandler.FileCommands.files) != 1 {
+		t.Fatalf("expected 1 file command, got %v", eventHandler.FileCommands.files)
+	}
+
+	// both writes are read by one pending scan
+	eventHandler.FileCommands.mutex.Lock()
+	scanPending := eventHandler.FileCommands.files[envFile].scanPending
+	eventHandler.FileCommands.mutex.Unlock()
+	if !scanPending {
+		t.Fatalf("expected a pending scan")
+	}
+
+	if entries := eventHandler.FileCommands.scan(envFile); len(entries) != 1 {
+		t.Fatalf("expected FOO, got %v", entries)
+	}
+	if eventHandler.FileCommands.files[envFile].scanPending {
+		t.Fatalf("expected the scan to clear the pending flag")
+	}
+
+	// appended entries are reported once
+	f, _ := os.OpenFile(envFile, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("LD_PRELOAD=/tmp/x.so\n")
+	f.Close()
+
+	entries := eventHandler.FileCommands.scan(envFile)
+	if !reflect.DeepEqual(entries, []fileCommandEntry{{Name: "LD_PRELOAD", Value: "/tmp/x.so"}}) {
+		t.Fatalf("expected LD_PRELOAD, got %v", entries)
+	}
+	if entries := eventHandler.FileCommands.scan(envFile); len(entries) != 0 {
+		t.Fatalf("expected no new entries, got %v", entries)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FileWatchSeverityLow    = "low"
+	FileWatchSeverityMedium = "medium"
+	FileWatchSeverityHigh   = "high" // events are annotated
+
+	defaultFileWatchPermissions = "wa"
+	// accesses of watched files are reported once per exe, file and access
+	maxWatchedFileReports = 10000
+)
+
+// FileWatch is a path from the file_watches of agent.json that is monitored for the accesses in Permissions.
+type FileWatch struct {
+	Path        string   `json:"path"`
+	Permissions string   `json:"permissions"` // of r (read), w (write), x (exec) and a (attribute change), wa by default
+	Exclude     []string `json:"exclude"`     // directories that are not monitored, e.g. node_modules, relative to Path
+	Severity    string   `json:"severity"`    // low, medium or high
+}
+
+// fileWatchRules translates watches to audit rules. Writes and attribute changes are reported as file events,
+// reads and execs as file access events, they have separate rules. Excluded directories get never rules,
+// they come first as the kernel stops at the first matching rule. So the git index of workingDirectory
+// cannot be excluded, the source integrity snapshot is taken when it is written.
+func fileWatchRules(watches []FileWatch, workingDirectory string) ([]string, error) {
+	var excludeRules, writeRules, accessRules []string
+	gitIndex := filepath.Join(workingDirectory, gitIndexPath)
+
+	for _, watch := range watches {
+		if !filepath.IsAbs(watch.Path) {
+			return nil, errors.Errorf("file watch path %q is not absolute", watch.Path)
+		}
+		// rules are parsed as command lines, a path with whitespace would be cut
+		if hasWhitespace(watch.Path) {
+			return nil, errors.Errorf("file watch path %q has whitespace", watch.Path)
+		}
+
+		permissions := watch.Permissions
+		if permissions == "" {
+			permissions = defaultFileWatchPermissions
+		}
+		if strings.Trim(permissions, "rwxa") != "" {
+			return nil, errors.Errorf("invalid permissions %q for file watch %s", watch.Permissions, watch.Path)
+		}
+
+		switch watch.Severity {
+		case "", FileWatchSeverityLow, FileWatchSeverityMedium, FileWatchSeverityHigh:
+		default:
+			return nil, errors.Errorf("invalid severity %q for file watch %s", watch.Severity, watch.Path)
+		}
+
+		path := filepath.Clean(watch.Path)
+		field := "path"
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			field = "dir"
+		}
+
+		for _, exclude := range watch.Exclude {
+			excludePath := filepath.Clean(exclude)
+			if !filepath.IsAbs(excludePath) {
+				excludePath = filepath.Join(path, exclude)
+			}
+			if !strings.HasPrefix(excludePath, path+"/") {
+				return nil, errors.Errorf("excluded path %q is not in file watch %s", exclude, watch.Path)
+			}
+			if hasWhitespace(excludePath) {
+				return nil, errors.Errorf("excluded path %q has whitespace", exclude)
+			}
+			if workingDirectory != "" && (excludePath == gitIndex || strings.HasPrefix(gitIndex, excludePath+"/")) {
+				return nil, errors.Errorf("excluded path %q has the git index of the working directory", exclude)
+			}
+			excludeRules = append(excludeRules, fmt.Sprintf("-a never,exit -F dir=%s -F perm=%s -k %s", excludePath, permissions, auditKey(fileMonitorTag)))
+		}
+
+		if writePermissions := keepPermissions(permissions, "wa"); writePermissions != "" {
+			writeRules = append(writeRules, fmt.Sprintf("-a always,exit -F %s=%s -F perm=%s -k %s", field, path, writePermissions,
+				auditKey(severityTag(fileMonitorTag, watch.Severity))))
+		}
+		if accessPermissions := keepPermissions(permissions, "rx"); accessPermissions != "" {
+			accessRules = append(accessRules, fmt.Sprintf("-a always,exit -F %s=%s -F perm=%s -k %s", field, path, accessPermissions,
+				auditKey(severityTag(fileAccessMonitorTag, watch.Severity))))
+		}
+	}
+
+	return append(append(excludeRules, writeRules...), accessRules...), nil
+}
+
+func hasWhitespace(path string) bool {
+	return strings.IndexFunc(path, unicode.IsSpace) >= 0
+}
+
+func keepPermissions(permissions, kept string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(kept, r) {
+			return r
+		}
+		return -1
+	}, permissions)
+}
+
+// severityTag is the tag of events of a watch, it has the severity so events can be reported with it.
+func severityTag(tag, severity string) string {
+	if severity == "" {
+		return tag
+	}
+	return tag + "-" + severity
+}
+
+// hasFileWatch returns if a watch is declared for path.
+func hasFileWatch(watches []FileWatch, path string) bool {
+	for _, watch := range watches {
+		if filepath.Clean(watch.Path) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// reportWatchedFile logs an access of a watched file and annotates it if the watch has high severity.
+func (eventHandler *EventHandler) reportWatchedFile(event *Event, access string) {
+	cacheKey := fmt.Sprintf("%s|%s|%s", event.Exe, event.FileName, access)
+
+	eventHandler.fileMutex.Lock()
+	_, found := eventHandler.ProcessFileMap[cacheKey]
+	if !found && len(eventHandler.ProcessFileMap) < maxWatchedFileReports {
+		eventHandler.ProcessFileMap[cacheKey] = true
+	}
+	eventHandler.fileMutex.Unlock()
+
+	if found {
+		return
+	}
+
+	WriteLog(fmt.Sprintf("[Watched file] %s: %s, severity: %s, syscall: %s, exe: %s, pid: %s", access, event.FileName, event.Severity, event.Syscall, event.Exe, event.Pid))
+
+	if event.Severity == FileWatchSeverityHigh {
+		WriteAnnotation(fmt.Sprintf("%s Watched file %s had %s access by %s", StepSecurityAnnotationPrefix, event.FileName, access, filepath.Base(event.Exe)))
+	}
+}
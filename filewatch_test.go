@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/elastic/go-libaudit/v2/rule"
+	"github.com/elastic/go-libaudit/v2/rule/flags"
+)
+
+func Test_fileWatchRules(t *testing.T) {
+	workingDirectory := t.TempDir()
+
+	tests := []struct {
+		name    string
+		watches []FileWatch
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "working directory with exclusions",
+			watches: []FileWatch{{Path: workingDirectory, Exclude: []string{"node_modules", ".git/objects"}}},
+			want: []string{
+				fmt.Sprintf("-a never,exit -F dir=%s/node_modules -F perm=wa -k stepsecurity-filemon", workingDirectory),
+				fmt.Sprintf("-a never,exit -F dir=%s/.git/objects -F perm=wa -k stepsecurity-filemon", workingDirectory),
+				fmt.Sprintf("-a always,exit -F dir=%s -F perm=wa -k stepsecurity-filemon", workingDirectory),
+			},
+		},
+		{
+			name:    "reads and writes of a file",
+			watches: []FileWatch{{Path: "/home/runner/.npmrc", Permissions: "rw", Severity: FileWatchSeverityHigh}},
+			want: []string{
+				"-a always,exit -F path=/home/runner/.npmrc -F perm=w -k stepsecurity-filemon-high",
+				"-a always,exit -F path=/home/runner/.npmrc -F perm=r -k stepsecurity-fileaccess-high",
+			},
+		},
+		{
+			name:    "execs",
+			watches: []FileWatch{{Path: workingDirectory, Permissions: "x", Severity: FileWatchSeverityLow}},
+			want:    []string{fmt.Sprintf("-a always,exit -F dir=%s -F perm=x -k stepsecurity-fileaccess-low", workingDirectory)},
+		},
+		{name: "relative path", watches: []FileWatch{{Path: "src"}}, wantErr: true},
+		{name: "invalid permissions", watches: []FileWatch{{Path: "/etc", Permissions: "rwd"}}, wantErr: true},
+		{name: "invalid severity", watches: []FileWatch{{Path: "/etc", Severity: "urgent"}}, wantErr: true},
+		{name: "exclusion outside of watch", watches: []FileWatch{{Path: "/etc", Exclude: []string{"../tmp"}}}, wantErr: true},
+		{name: "path with whitespace", watches: []FileWatch{{Path: "/home/runner/my files"}}, wantErr: true},
+		{name: "exclusion with whitespace", watches: []FileWatch{{Path: workingDirectory, Exclude: []string{"build output"}}}, wantErr: true},
+		{name: "exclusion of the git index", watches: []FileWatch{{Path: workingDirectory, Exclude: []string{".git"}}}, wantErr: true},
+		{name: "exclusion of the working directory", watches: []FileWatch{{Path: filepath.Dir(workingDirectory), Exclude: []string{filepath.Base(workingDirectory)}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fileWatchRules(tt.watches, workingDirectory)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fileWatchRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("fileWatchRules() = %v, want %v", got, tt.want)
+			}
+
+			for _, commandLine := range got {
+				r, err := flags.Parse(commandLine)
+				if err != nil {
+					t.Fatalf("flags.Parse(%q) error = %v", commandLine, err)
+				}
+				if _, err := rule.Build(r); err != nil {
+					t.Fatalf("rule.Build(%q) error = %v", commandLine, err)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessMonitor_handleRecord_FileWatchSeverity(t *testing.T) {
+	processMonitor := &ProcessMonitor{Events: make(map[int]*Event)}
+
+	events := handleRecords(t, processMonitor, `
+		type=SYSCALL msg=audit(1700000000.100:100): arch=c000003e syscall=257 success=yes exit=3 items=1 ppid=10 pid=20 uid=1001 euid=1001 comm="cat" exe="/usr/bin/cat" key="stepsecurity-fileaccess-high"
+		type=CWD msg=audit(1700000000.100:100): cwd="/home/runner"
+		type=PATH msg=audit(1700000000.100:100): item=0 name=".npmrc" inode=11 nametype=NORMAL
+		type=EOE msg=audit(1700000000.100:100): `)
+
+	if len(events) != 1 || events[0].EventType != fileAccessMonitorTag || events[0].Severity != FileWatchSeverityHigh {
+		t.Fatalf("expected a file access event of high severity, got %+v", events)
+	}
+}
+
+func TestEventHandler_reportWatchedFile(t *testing.T) {
+	eventHandler := NewEventHandler("123", "owner/repo", nil, nil)
+
+	for i := 0; i < 3; i++ {
+		eventHandler.HandleEvent(&Event{EventType: fileAccessMonitorTag, FileName: ".npmrc", Path: "/home/runner", Syscall: "openat",
+			Exe: "/usr/bin/cat", Pid: "20", Severity: FileWatchSeverityLow})
+	}
+	eventHandler.HandleEvent(&Event{EventType: fileAccessMonitorTag, FileName: "/home/runner/tool", Path: "/home/runner", Syscall: "execve",
+		Exe: "/home/runner/tool", Pid: "21", Severity: FileWatchSeverityLow})
+
+	// reported once per exe, file and access
+	if len(eventHandler.ProcessFileMap) != 2 || !eventHandler.ProcessFileMap["/usr/bin/cat|/home/runner/.npmrc|read"] ||
+		!eventHandler.ProcessFileMap["/home/runner/tool|/home/runner/tool|exec"] {
+		t.Fatalf("unexpected reported accesses %v", eventHandler.ProcessFileMap)
+	}
+}
+
+func Test_hasFileWatch(t *testing.T) {
+	workingDirectory := filepath.Join(os.TempDir(), "work")
+	watches := []FileWatch{{Path: workingDirectory + "/"}}
+
+	if !hasFileWatch(watches, workingDirectory) || hasFileWatch(watches, "/etc") {
+		t.Fatalf("hasFileWatch() returned unexpected result")
+	}
+}
@@ -10,6 +10,8 @@ import (
 
 const (
 	filterTable               = "filter"
+	mangleTable               = "mangle"
+	forwardChain              = "FORWARD"
 	outputChain               = "OUTPUT"
 	dockerUserChain           = "DOCKER-USER"
 	dockerInterface           = "docker0"
@@ -20,6 +22,8 @@ const (
 	allProtocols              = "all"
 	tcp                       = "tcp"
 	udp                       = "udp"
+	icmp                      = "icmp"
+	icmpv6                    = "ipv6-icmp"
 	destination               = "-d"
 	destinationPort           = "--dport"
 	target                    = "-j"
@@ -27,6 +31,7 @@ const (
 	reject                    = "REJECT"
 	nflogTarget               = "NFLOG"
 	nflogGroup                = "100"
+	nflogPrefix               = "--nflog-prefix"
 	classAPrivateAddressRange = "10.0.0.0/8"
 	classBPrivateAddressRange = "172.16.0.0/12"
 	classCPrivateAddressRange = "192.168.0.0/16"
@@ -43,13 +48,13 @@ type ipAddressEndpoint struct {
 	port      string
 }
 
-func addBlockRulesForGitHubHostedRunner(firewall *Firewall, endpoints []ipAddressEndpoint) error {
-	err := addBlockRules(firewall, endpoints, outputChain, defaultInterface, outbound)
+func addBlockRulesForGitHubHostedRunner(firewall *Firewall, endpoints []ipAddressEndpoint, allowICMP bool) error {
+	err := addBlockRules(firewall, endpoints, outputChain, defaultInterface, outbound, allowICMP)
 	if err != nil {
 		return errors.Wrap(err, "failed to add block rules for default interface")
 	}
 
-	err = addBlockRules(firewall, endpoints, dockerUserChain, dockerInterface, inbound)
+	err = addBlockRules(firewall, endpoints, dockerUserChain, dockerInterface, inbound, allowICMP)
 	if err != nil {
 		return errors.Wrap(err, "failed to add block rules for docker interface")
 	}
@@ -57,7 +62,7 @@ func addBlockRulesForGitHubHostedRunner(firewall *Firewall, endpoints []ipAddres
 	return nil
 }
 
-func addBlockRules(firewall *Firewall, endpoints []ipAddressEndpoint, chain, netInterface, direction string) error {
+func addBlockRules(firewall *Firewall, endpoints []ipAddressEndpoint, chain, netInterface, direction string, allowICMP bool) error {
 	var ipt IPTables
 	var err error
 	dnsServers := []string{"8.8.8.8", "8.8.4.4", "1.1.1.1"}
@@ -157,18 +162,33 @@ func addBlockRules(firewall *Firewall, endpoints []ipAddressEndpoint, chain, net
 		return errors.Wrap(err, "failed to add rule")
 	}
 
+	// Allow ICMP if the policy allows it, new flows are logged so they are still reported
+	if allowICMP {
+		err = ipt.Append(filterTable, chain, direction, netInterface, protocol, icmp,
+			"-m", "conntrack", "--ctstate", "NEW",
+			target, nflogTarget, "--nflog-group", nflogGroup, nflogPrefix, nflogPrefixAudit)
+		if err != nil {
+			return errors.Wrap(err, "failed to add ICMP NFLOG rule")
+		}
+
+		err = ipt.Append(filterTable, chain, direction, netInterface, protocol, icmp, target, accept)
+		if err != nil {
+			return errors.Wrap(err, "failed to add ICMP rule")
+		}
+	}
+
 	// Log blocked traffic
-	err = ipt.Append(filterTable, chain, direction, netInterface, protocol, tcp, "--tcp-flags", "SYN,ACK", "SYN", "-j", "NFLOG", "--nflog-group", "100")
+	err = ipt.Append(filterTable, chain, direction, netInterface, protocol, tcp, "--tcp-flags", "SYN,ACK", "SYN", "-j", "NFLOG", "--nflog-group", "100", nflogPrefix, nflogPrefixBlocked)
 
 	if err != nil {
 		return errors.Wrap(err, "failed to add rule")
 	}
 
-	// Log blocked traffic - UDP packets
-	err = ipt.Append(filterTable, chain, direction, netInterface, protocol, "udp", "-j", "NFLOG", "--nflog-group", "100")
+	// Log blocked traffic - UDP, ICMP and other protocols
+	err = ipt.Append(filterTable, chain, direction, netInterface, "!", protocol, tcp, "-j", "NFLOG", "--nflog-group", "100", nflogPrefix, nflogPrefixBlocked)
 
 	if err != nil {
-		return errors.Wrap(err, "failed to add UDP NFLOG rule")
+		return errors.Wrap(err, "failed to add NFLOG rule for UDP and other protocols")
 	}
 
 	// Block all other traffic
@@ -238,6 +258,49 @@ func InsertAllowRule(firewall *Firewall, blocklist *GlobalBlocklist, ipAddress,
 	return nil
 }
 
+// AddAgentAllowRules allows the agent, and only the agent, to reach the endpoints,
+// e.g. the forward proxy it sends its own traffic through.
+func AddAgentAllowRules(firewall *Firewall, endpoints []ipAddressEndpoint) error {
+	var ipt IPTables
+	var err error
+	if firewall == nil {
+		ipt, err = iptables.New()
+		if err != nil {
+			return errors.Wrap(err, "new iptables failed")
+		}
+	} else {
+		ipt = firewall.IPTables
+	}
+
+	agentUID := fmt.Sprintf("%d", os.Getuid())
+	for _, endpoint := range endpoints {
+		exists, err := ipt.Exists(filterTable, outputChain, outbound, defaultInterface,
+			"-m", "owner", "--uid-owner", agentUID,
+			protocol, tcp,
+			destination, endpoint.ipAddress,
+			destinationPort, endpoint.port,
+			target, accept)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check agent allow rule ip:%s, port:%s", endpoint.ipAddress, endpoint.port)
+		}
+		if exists {
+			continue
+		}
+
+		err = ipt.Insert(filterTable, outputChain, 1, outbound, defaultInterface,
+			"-m", "owner", "--uid-owner", agentUID,
+			protocol, tcp,
+			destination, endpoint.ipAddress,
+			destinationPort, endpoint.port,
+			target, accept)
+		if err != nil {
+			return errors.Wrapf(err, "failed to insert agent allow rule ip:%s, port:%s", endpoint.ipAddress, endpoint.port)
+		}
+	}
+
+	return nil
+}
+
 func AddGlobalBlockRules(firewall *Firewall, blocklist *GlobalBlocklist) error {
 	if blocklist == nil {
 		return nil
@@ -267,23 +330,23 @@ func addGlobalBlockRulesForChain(firewall *Firewall, blocklist *GlobalBlocklist,
 	}
 
 	// Add NFLOG rules once for all blocked IPs (TCP SYN + UDP)
-	tcpNflogExists, err := ipt.Exists(filterTable, chain, direction, netInterface, protocol, tcp, "--tcp-flags", "SYN,ACK", "SYN", target, nflogTarget, "--nflog-group", nflogGroup)
+	tcpNflogExists, err := ipt.Exists(filterTable, chain, direction, netInterface, protocol, tcp, "--tcp-flags", "SYN,ACK", "SYN", target, nflogTarget, "--nflog-group", nflogGroup, nflogPrefix, nflogPrefixGlobalBlocklist)
 	if err != nil {
 		return errors.Wrapf(err, "failed to check global block tcp nflog rule interface:%s", netInterface)
 	}
 	if !tcpNflogExists {
-		err = ipt.Insert(filterTable, chain, 1, direction, netInterface, protocol, tcp, "--tcp-flags", "SYN,ACK", "SYN", target, nflogTarget, "--nflog-group", nflogGroup)
+		err = ipt.Insert(filterTable, chain, 1, direction, netInterface, protocol, tcp, "--tcp-flags", "SYN,ACK", "SYN", target, nflogTarget, "--nflog-group", nflogGroup, nflogPrefix, nflogPrefixGlobalBlocklist)
 		if err != nil {
 			return errors.Wrapf(err, "failed to insert global block tcp nflog rule interface:%s", netInterface)
 		}
 	}
 
-	udpNflogExists, err := ipt.Exists(filterTable, chain, direction, netInterface, protocol, udp, target, nflogTarget, "--nflog-group", nflogGroup)
+	udpNflogExists, err := ipt.Exists(filterTable, chain, direction, netInterface, protocol, udp, target, nflogTarget, "--nflog-group", nflogGroup, nflogPrefix, nflogPrefixGlobalBlocklist)
 	if err != nil {
 		return errors.Wrapf(err, "failed to check global block udp nflog rule interface:%s", netInterface)
 	}
 	if !udpNflogExists {
-		err = ipt.Insert(filterTable, chain, 2, direction, netInterface, protocol, udp, target, nflogTarget, "--nflog-group", nflogGroup)
+		err = ipt.Insert(filterTable, chain, 2, direction, netInterface, protocol, udp, target, nflogTarget, "--nflog-group", nflogGroup, nflogPrefix, nflogPrefixGlobalBlocklist)
 		if err != nil {
 			return errors.Wrapf(err, "failed to insert global block udp nflog rule interface:%s", netInterface)
 		}
@@ -339,7 +402,14 @@ func AddAuditRules(firewall *Firewall) error {
 	}
 
 	// this limits the number of packets sent to nflog. Only SYN requests are sent
-	err = ipt.Append("filter", "OUTPUT", "-o", "eth0", "-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN", "-j", "NFLOG", "--nflog-group", "100")
+	err = ipt.Append("filter", "OUTPUT", "-o", "eth0", "-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN", "-j", "NFLOG", "--nflog-group", "100", nflogPrefix, nflogPrefixAudit)
+
+	if err != nil {
+		return fmt.Errorf("Append failed for eth0: %v", err)
+	}
+
+	// new flows of UDP, ICMP and other protocols, e.g. ICMP tunnels
+	err = ipt.Append("filter", "OUTPUT", "-o", "eth0", "!", "-p", "tcp", "-m", "conntrack", "--ctstate", "NEW", "-j", "NFLOG", "--nflog-group", "100", nflogPrefix, nflogPrefixAudit)
 
 	if err != nil {
 		return fmt.Errorf("Append failed for eth0: %v", err)
@@ -357,7 +427,13 @@ func AddAuditRules(firewall *Firewall) error {
 		return fmt.Errorf("failed to deny udp docker interface: %v", err)
 	}
 
-	err = ipt.Append("filter", "DOCKER-USER", "-i", "docker0", "-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN", "-j", "NFLOG", "--nflog-group", "100")
+	err = ipt.Append("filter", "DOCKER-USER", "-i", "docker0", "-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN", "-j", "NFLOG", "--nflog-group", "100", nflogPrefix, nflogPrefixAudit)
+
+	if err != nil {
+		return fmt.Errorf("Append failed for FORWARD: %v", err)
+	}
+
+	err = ipt.Append("filter", "DOCKER-USER", "-i", "docker0", "!", "-p", "tcp", "-m", "conntrack", "--ctstate", "NEW", "-j", "NFLOG", "--nflog-group", "100", nflogPrefix, nflogPrefixAudit)
 
 	if err != nil {
 		return fmt.Errorf("Append failed for FORWARD: %v", err)
@@ -366,6 +442,111 @@ func AddAuditRules(firewall *Firewall) error {
 	return nil
 }
 
+// AddServerNameLogRules sends the first payload packets of outbound TCP flows to nflog,
+// so the TLS SNI or HTTP Host of the flow can be recorded.
+// The rules are in the mangle table so that ACCEPT rules in the filter table do not skip them.
+func AddServerNameLogRules(firewall *Firewall) error {
+	var ipt IPTables
+	var err error
+	if firewall == nil {
+		ipt, err = iptables.New()
+		if err != nil {
+			return errors.Wrap(err, "new iptables failed")
+		}
+	} else {
+		ipt = firewall.IPTables
+	}
+
+	// packets 1 and 2 of a flow are the SYN and ACK of the handshake
+	payloadPackets := []string{"-m", "connbytes", "--connbytes", "3:4", "--connbytes-dir", "original", "--connbytes-mode", "packets"}
+
+	rulespec := append([]string{outbound, defaultInterface, protocol, tcp}, payloadPackets...)
+	err = ipt.Append(mangleTable, outputChain, append(rulespec, target, nflogTarget, "--nflog-group", nflogGroup, nflogPrefix, nflogPrefixServerName)...)
+	if err != nil {
+		return errors.Wrap(err, "failed to add server name nflog rule for default interface")
+	}
+
+	rulespec = append([]string{inbound, dockerInterface, protocol, tcp}, payloadPackets...)
+	err = ipt.Append(mangleTable, forwardChain, append(rulespec, target, nflogTarget, "--nflog-group", nflogGroup, nflogPrefix, nflogPrefixServerName)...)
+	if err != nil {
+		return errors.Wrap(err, "failed to add server name nflog rule for docker interface")
+	}
+
+	return nil
+}
+
+// AddSNIEnforcementRules queues the payload packets of new TLS flows to the agent until it allowed or denied
+// the ClientHello, drops flows it denied, and stops queueing flows it allowed. The agent marks the flow
+// when it repeats the packet. The agent's own traffic, e.g. to DNS over HTTPS resolvers, is not queued.
+func AddSNIEnforcementRules(firewall *Firewall) error {
+	var ipt IPTables
+	var err error
+	if firewall == nil {
+		ipt, err = iptables.New()
+		if err != nil {
+			return errors.Wrap(err, "new iptables failed")
+		}
+	} else {
+		ipt = firewall.IPTables
+	}
+
+	return addSNIEnforcementRules(ipt)
+}
+
+// AddSNIEnforcementRulesIPv6 adds the rules of AddSNIEnforcementRules for IPv6 flows.
+// firewall is the ip6tables to use, nil for the system's.
+func AddSNIEnforcementRulesIPv6(firewall *Firewall) error {
+	var ipt IPTables
+	var err error
+	if firewall == nil {
+		ipt, err = iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			return errors.Wrap(err, "new ip6tables failed")
+		}
+	} else {
+		ipt = firewall.IPTables
+	}
+
+	return addSNIEnforcementRules(ipt)
+}
+
+func addSNIEnforcementRules(ipt IPTables) error {
+	deniedMark := fmt.Sprintf("%#x/%#x", sniDeniedMark, sniDeniedMark)
+	allowedMark := fmt.Sprintf("%#x/%#x", sniAllowedMark, sniAllowedMark)
+	agentUID := fmt.Sprintf("%d", os.Getuid())
+	queue := []string{"-m", "connmark", "!", "--mark", allowedMark,
+		target, "NFQUEUE", "--queue-num", fmt.Sprintf("%d", sniQueueNum), "--queue-bypass"}
+
+	chains := []struct {
+		chain       string
+		interfaceOf []string
+		queueMatch  []string
+	}{
+		{chain: outputChain, interfaceOf: []string{outbound, defaultInterface}, queueMatch: []string{"-m", "owner", "!", "--uid-owner", agentUID}},
+		{chain: forwardChain, interfaceOf: []string{inbound, dockerInterface}},
+	}
+
+	for _, c := range chains {
+		tls := append(append([]string{}, c.interfaceOf...), protocol, tcp, destinationPort, "443")
+
+		rules := [][]string{
+			append(append([]string{}, tls...), "-m", "connmark", "--mark", deniedMark, target, "DROP"),
+			append(append([]string{}, tls...), "-m", "mark", "--mark", deniedMark, target, "CONNMARK", "--set-xmark", deniedMark),
+			append(append([]string{}, tls...), "-m", "mark", "--mark", deniedMark, target, "DROP"),
+			append(append([]string{}, tls...), "-m", "mark", "--mark", allowedMark, target, "CONNMARK", "--set-xmark", allowedMark),
+			append(append(append([]string{}, tls...), c.queueMatch...), queue...),
+		}
+
+		for _, rule := range rules {
+			if err := ipt.Append(mangleTable, c.chain, rule...); err != nil {
+				return errors.Wrapf(err, "failed to add sni enforcement rule chain:%s", c.chain)
+			}
+		}
+	}
+
+	return nil
+}
+
 func RevertFirewallChanges(firewall *Firewall) error {
 	var ipt IPTables
 	var err error
@@ -382,6 +563,61 @@ func RevertFirewallChanges(firewall *Firewall) error {
 
 	ipt.ClearChain("filter", "OUTPUT")
 	ipt.ClearChain("filter", "DOCKER-USER")
+	ipt.ClearChain(mangleTable, outputChain)
+	ipt.ClearChain(mangleTable, forwardChain)
+	revertEgressLimitRules(ipt)
+
+	if firewall == nil {
+		if ip6t, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err == nil {
+			ip6t.ClearChain(filterTable, outputChain)
+			ip6t.ClearChain(mangleTable, outputChain)
+			ip6t.ClearChain(mangleTable, forwardChain)
+		}
+	}
+
+	return nil
+}
+
+// AddICMPv6Rules logs ICMPv6 echo requests to non-private destinations, and rejects them if block is set.
+// The other ICMPv6 types are left alone, neighbor discovery needs them.
+// firewall is the ip6tables to use, nil for the system's.
+func AddICMPv6Rules(firewall *Firewall, block bool) error {
+	var ipt IPTables
+	var err error
+	if firewall == nil {
+		ipt, err = iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			return errors.Wrap(err, "new ip6tables failed")
+		}
+	} else {
+		ipt = firewall.IPTables
+	}
+
+	echoRequest := []string{outbound, defaultInterface, protocol, icmpv6, "--icmpv6-type", "echo-request"}
+
+	for _, addressRange := range []string{ipv6LinkLocalAddressRange, ipv6LocalAddressRange} {
+		err = ipt.Append(filterTable, outputChain, append(append([]string{}, echoRequest...), destination, addressRange, target, accept)...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to add ICMPv6 rule for %s", addressRange)
+		}
+	}
+
+	prefix := nflogPrefixAudit
+	if block {
+		prefix = nflogPrefixBlocked
+	}
+	err = ipt.Append(filterTable, outputChain, append(append([]string{}, echoRequest...), "-m", "conntrack", "--ctstate", "NEW",
+		target, nflogTarget, "--nflog-group", nflogGroup, nflogPrefix, prefix)...)
+	if err != nil {
+		return errors.Wrap(err, "failed to add ICMPv6 NFLOG rule")
+	}
+
+	if block {
+		err = ipt.Append(filterTable, outputChain, append(append([]string{}, echoRequest...), target, reject)...)
+		if err != nil {
+			return errors.Wrap(err, "failed to add ICMPv6 reject rule")
+		}
+	}
 
 	return nil
 }
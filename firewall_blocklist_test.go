@@ -4,9 +4,12 @@ import "testing"
 
 type recorderIPTables struct {
 	inserted [][]string
+	appended [][]string
 }
 
 func (m *recorderIPTables) Append(table, chain string, rulespec ...string) error {
+	record := append([]string{table, chain}, rulespec...)
+	m.appended = append(m.appended, record)
 	return nil
 }
 
@@ -24,6 +27,10 @@ func (m *recorderIPTables) ClearChain(table, chain string) error {
 	return nil
 }
 
+func (m *recorderIPTables) ClearAndDeleteChain(table, chain string) error {
+	return nil
+}
+
 func insertedRuleTarget(record []string) string {
 	for i := 0; i < len(record)-1; i++ {
 		if record[i] == target {
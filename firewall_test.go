@@ -27,7 +27,7 @@ func Test_addAuditRules(t *testing.T) {
 	endpoints := []ipAddressEndpoint{}
 	endpoints = append(endpoints, ipAddressEndpoint{ipAddress: "1.1.1.1", port: "443"})
 
-	err = addBlockRulesForGitHubHostedRunner(nil, endpoints)
+	err = addBlockRulesForGitHubHostedRunner(nil, endpoints, false)
 	if err != nil {
 		t.Errorf("Error not expected %v", err)
 	}
@@ -41,3 +41,25 @@ func Test_addAuditRules(t *testing.T) {
 	ipt.ClearChain("filter", "OUTPUT")
 	ipt.ClearChain("filter", "DOCKER-USER")
 }
+
+func Test_addDestinationQuota(t *testing.T) {
+	ipt, err := iptables.New()
+	if err != nil {
+		t.Skipf("iptables is not available %v", err)
+	}
+
+	limits := &EgressLimits{DestinationBytesPerJob: 1024}
+	if err := AddEgressLimitRules(nil, limits, false); err != nil {
+		t.Fatalf("Error not expected %v", err)
+	}
+	defer RevertFirewallChanges(nil)
+
+	// the monitor of audit mode has no firewall
+	netMonitor := &NetworkMonitor{EgressLimits: limits, Status: "Allowed"}
+	netMonitor.addDestinationQuota("140.82.112.3")
+
+	exists, err := ipt.Exists(mangleTable, egressLimitDestinationsChain, "-d", "140.82.112.3", "-m", "quota", "--quota", "1024", target, "RETURN")
+	if err != nil || !exists {
+		t.Errorf("expected quota rule for destination, exists %v, error %v", exists, err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFlowCacheWindow = 10 * time.Minute
+	defaultFlowCacheSize   = 10000
+)
+
+// FlowCache remembers the flows a monitor reported, so that duplicate packets of a flow
+// are only reported again after the window. It holds at most size flows, the oldest are evicted first.
+type FlowCache struct {
+	window  time.Duration
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // oldest report first
+	stats   FlowCacheStats
+	now     func() time.Time
+	mutex   sync.Mutex
+}
+
+type flowCacheEntry struct {
+	key        string
+	reportedAt time.Time
+}
+
+type FlowCacheStats struct {
+	Entries    int
+	Reported   uint64
+	Suppressed uint64
+	Evicted    uint64
+}
+
+func NewFlowCache(window time.Duration, size int) *FlowCache {
+	if window <= 0 {
+		window = defaultFlowCacheWindow
+	}
+	if size <= 0 {
+		size = defaultFlowCacheSize
+	}
+
+	return &FlowCache{
+		window:  window,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// ShouldReport returns true if the flow was not reported within the window, and records the report.
+func (cache *FlowCache) ShouldReport(key string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now := cache.now()
+	cache.expire(now)
+
+	if _, found := cache.entries[key]; found {
+		cache.stats.Suppressed++
+		return false
+	}
+
+	if cache.order.Len() >= cache.size {
+		cache.evict(cache.order.Front())
+	}
+
+	cache.entries[key] = cache.order.PushBack(&flowCacheEntry{key: key, reportedAt: now})
+	cache.stats.Reported++
+	return true
+}
+
+func (cache *FlowCache) Stats() FlowCacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	stats := cache.stats
+	stats.Entries = cache.order.Len()
+	return stats
+}
+
+// expire removes the flows reported before the window, they are at the front of the list.
+func (cache *FlowCache) expire(now time.Time) {
+	for element := cache.order.Front(); element != nil; element = cache.order.Front() {
+		if now.Sub(element.Value.(*flowCacheEntry).reportedAt) < cache.window {
+			return
+		}
+		cache.order.Remove(element)
+		delete(cache.entries, element.Value.(*flowCacheEntry).key)
+	}
+}
+
+func (cache *FlowCache) evict(element *list.Element) {
+	cache.order.Remove(element)
+	delete(cache.entries, element.Value.(*flowCacheEntry).key)
+	cache.stats.Evicted++
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlowCache_ShouldReport(t *testing.T) {
+	cache := NewFlowCache(time.Minute, 2)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		key     string
+		want    bool
+	}{
+		{name: "new flow", key: "1.2.3.4:443", want: true},
+		{name: "duplicate", key: "1.2.3.4:443", want: false},
+		{name: "duplicate within window", advance: 59 * time.Second, key: "1.2.3.4:443", want: false},
+		{name: "reported again after window", advance: time.Second, key: "1.2.3.4:443", want: true},
+		{name: "second flow", key: "1.2.3.5:443", want: true},
+		{name: "third flow evicts oldest", key: "1.2.3.6:443", want: true},
+		{name: "evicted flow", key: "1.2.3.4:443", want: true},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		if got := cache.ShouldReport(step.key); got != step.want {
+			t.Fatalf("%s: ShouldReport(%s) = %v, want %v", step.name, step.key, got, step.want)
+		}
+	}
+
+	stats := cache.Stats()
+	want := FlowCacheStats{Entries: 2, Reported: 5, Suppressed: 2, Evicted: 2}
+	if stats != want {
+		t.Fatalf("Stats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestFlowCache_Concurrent(t *testing.T) {
+	cache := NewFlowCache(time.Minute, 100)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	reported := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if cache.ShouldReport(fmt.Sprintf("flow-%d", j)) {
+					mutex.Lock()
+					reported++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reported != 10 {
+		t.Fatalf("expected 10 flows reported, got %d", reported)
+	}
+	if stats := cache.Stats(); stats.Suppressed != 490 {
+		t.Fatalf("expected 490 suppressed duplicates, got %d", stats.Suppressed)
+	}
+}
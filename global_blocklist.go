@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"strings"
 
 	"github.com/miekg/dns"
@@ -37,7 +38,7 @@ func NewGlobalBlocklist(response *GlobalBlocklistResponse) *GlobalBlocklist {
 	}
 
 	for _, endpoint := range response.IPAddresses {
-		ipAddress := strings.TrimSpace(strings.ToLower(endpoint.Endpoint))
+		ipAddress := normalizeBlocklistIPAddress(endpoint.Endpoint)
 		if ipAddress != "" {
 			blocklist.ipAddresses[ipAddress] = endpoint.Reason
 		}
@@ -60,12 +61,22 @@ func NewGlobalBlocklist(response *GlobalBlocklistResponse) *GlobalBlocklist {
 	return blocklist
 }
 
+// normalizeBlocklistIPAddress returns the canonical form of an address,
+// so IPv6 addresses match however they are written
+func normalizeBlocklistIPAddress(ipAddress string) string {
+	ipAddress = strings.TrimSpace(strings.ToLower(ipAddress))
+	if ip := net.ParseIP(ipAddress); ip != nil {
+		return ip.String()
+	}
+	return ipAddress
+}
+
 func (blocklist *GlobalBlocklist) IsIPAddressBlocked(ipAddress string) bool {
 	if blocklist == nil {
 		return false
 	}
 
-	_, found := blocklist.ipAddresses[strings.TrimSpace(strings.ToLower(ipAddress))]
+	_, found := blocklist.ipAddresses[normalizeBlocklistIPAddress(ipAddress)]
 	return found
 }
 
@@ -74,7 +85,7 @@ func (blocklist *GlobalBlocklist) BlockedIPAddressReason(ipAddress string) strin
 		return ""
 	}
 
-	return blocklist.ipAddresses[strings.TrimSpace(strings.ToLower(ipAddress))]
+	return blocklist.ipAddresses[normalizeBlocklistIPAddress(ipAddress)]
 }
 
 func (blocklist *GlobalBlocklist) GetBlockedIPAddresses() []string {
@@ -3,6 +3,7 @@ module github.com/step-security/agent
 go 1.24.6
 
 require (
+	github.com/cilium/ebpf v0.17.3
 	github.com/coreos/go-iptables v0.6.0
 	github.com/elastic/go-libaudit/v2 v2.3.2
 	github.com/florianl/go-nflog/v2 v2.0.1
@@ -18,7 +19,6 @@ require (
 	github.com/agnivade/levenshtein v1.2.1 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/cilium/ebpf v0.17.3 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.4.0 // indirect
 	github.com/docker/distribution v2.8.1+incompatible // indirect
 	github.com/docker/go-connections v0.4.0 // indirect
@@ -81,7 +81,7 @@ require (
 require (
 	github.com/docker/docker v23.0.4+incompatible
 	github.com/google/go-cmp v0.7.0 // indirect
-	github.com/mdlayher/netlink v1.7.2 // indirect
-	golang.org/x/net v0.47.0 // indirect
-	golang.org/x/sys v0.40.0 // indirect
+	github.com/mdlayher/netlink v1.7.2
+	golang.org/x/net v0.47.0
+	golang.org/x/sys v0.40.0
 )
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const apiClientTimeout = 3 * time.Second
+
+// redactedURL hides credentials in proxy URLs when the config is written to agent.log
+type redactedURL string
+
+func (u redactedURL) String() string {
+	parsed, err := url.Parse(string(u))
+	if err != nil {
+		return ""
+	}
+	return parsed.Redacted()
+}
+
+// ProxySettings is the forward proxy used for every outbound call the agent makes.
+type ProxySettings struct {
+	Config *httpproxy.Config
+	// resolved addresses of the proxies, allowed for the agent in block mode
+	Endpoints []ipAddressEndpoint
+	// proxy host:port to resolved ip:port, since once the agent's DNS proxy is in place
+	// the proxy host name would not resolve in block mode
+	dialAddresses map[string]string
+}
+
+// NewProxySettings uses the proxy from agent.json if set, else HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+// It must be called before the agent changes the host DNS configuration.
+func NewProxySettings(proxy, noProxy string) (*ProxySettings, error) {
+	proxyConfig := httpproxy.FromEnvironment()
+	if proxy != "" {
+		proxyConfig = &httpproxy.Config{HTTPProxy: proxy, HTTPSProxy: proxy, NoProxy: noProxy}
+	}
+
+	settings := &ProxySettings{Config: proxyConfig, dialAddresses: make(map[string]string)}
+
+	for _, proxyURL := range []string{proxyConfig.HTTPSProxy, proxyConfig.HTTPProxy} {
+		if proxyURL == "" {
+			continue
+		}
+
+		host, port, err := proxyHostPort(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, found := settings.dialAddresses[net.JoinHostPort(host, port)]; found {
+			continue
+		}
+
+		ipAddress := host
+		if net.ParseIP(host) == nil {
+			ipAddresses, err := net.LookupIP(host)
+			if err != nil || len(ipAddresses) == 0 {
+				return nil, fmt.Errorf("failed to resolve proxy %s: %v", host, err)
+			}
+			ipAddress = ipAddresses[0].String()
+		}
+
+		settings.dialAddresses[net.JoinHostPort(host, port)] = net.JoinHostPort(ipAddress, port)
+		settings.Endpoints = append(settings.Endpoints, ipAddressEndpoint{ipAddress: ipAddress, port: port})
+	}
+
+	return settings, nil
+}
+
+func proxyHostPort(proxyURL string) (string, string, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		// same as net/http, a proxy without scheme is treated as http
+		u, err = url.Parse("http://" + proxyURL)
+		if err != nil {
+			return "", "", errors.Wrap(err, "failed to parse proxy url")
+		}
+	}
+
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+
+	return u.Hostname(), port, nil
+}
+
+// ProxyFunc returns the proxy for a request, honoring NO_PROXY.
+func (settings *ProxySettings) ProxyFunc() func(*http.Request) (*url.URL, error) {
+	proxyFunc := settings.Config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+}
+
+func (settings *ProxySettings) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if resolved, found := settings.dialAddresses[addr]; found {
+			addr = resolved
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// loadCABundle returns the system roots with the certificates in caBundlePath added.
+func loadCABundle(caBundlePath string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	pem, err := os.ReadFile(caBundlePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read CA bundle")
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", caBundlePath)
+	}
+
+	return pool, nil
+}
+
+// TLSSettings configures how the agent authenticates the hosts it calls and itself to them.
+type TLSSettings struct {
+	CABundlePath string
+	// host to base64 SHA256 hashes of the SubjectPublicKeyInfo of a certificate in its verified chain
+	Pins           map[string][]string
+	ClientCertPath string
+	ClientKeyPath  string
+}
+
+func (settings *TLSSettings) isSet() bool {
+	return settings != nil && (settings.CABundlePath != "" || len(settings.Pins) > 0 || settings.ClientCertPath != "")
+}
+
+// pinFailures has the hosts that already have an annotation for a pin mismatch
+var pinFailures sync.Map
+
+func spkiHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// verifyPins refuses the connection unless a certificate in a verified chain of a pinned host matches one of its pins.
+// Certificates the host presents outside of its verified chains do not count. Hosts without pins are only
+// verified against the root store.
+func verifyPins(pins map[string][]string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		host := strings.ToLower(strings.TrimSuffix(state.ServerName, "."))
+		hostPins, found := pins[host]
+		if !found {
+			return nil
+		}
+
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				hash := spkiHash(cert)
+				for _, pin := range hostPins {
+					if hash == pin {
+						return nil
+					}
+				}
+			}
+		}
+
+		err := fmt.Errorf("certificate pin mismatch for %s", host)
+		WriteLog(err.Error())
+		if _, reported := pinFailures.LoadOrStore(host, true); !reported {
+			WriteAnnotation(fmt.Sprintf("%s Connection to %s refused since its certificate does not match the configured pins", StepSecurityAnnotationPrefix, host))
+		}
+		return err
+	}
+}
+
+func newTLSConfig(settings *TLSSettings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if settings.CABundlePath != "" {
+		pool, err := loadCABundle(settings.CABundlePath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(settings.Pins) > 0 {
+		pins := make(map[string][]string)
+		for host, hostPins := range settings.Pins {
+			pins[strings.ToLower(strings.TrimSuffix(host, "."))] = hostPins
+		}
+		tlsConfig.VerifyConnection = verifyPins(pins)
+	}
+
+	if settings.ClientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(settings.ClientCertPath, settings.ClientKeyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// newHTTPClient returns the client for all agent outbound calls: the StepSecurity API,
+// DNS over HTTPS resolvers and webhook telemetry.
+// Without a proxy or TLS settings the default transport is used.
+func newHTTPClient(proxy *ProxySettings, tlsSettings *TLSSettings) (*http.Client, error) {
+	useProxy := proxy != nil && (proxy.Config.HTTPSProxy != "" || proxy.Config.HTTPProxy != "")
+	if !useProxy && !tlsSettings.isSet() {
+		return &http.Client{Timeout: apiClientTimeout}, nil
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if useProxy {
+		transport.Proxy = proxy.ProxyFunc()
+		transport.DialContext = proxy.dialContext(dialer)
+	}
+
+	if tlsSettings.isSet() {
+		tlsConfig, err := newTLSConfig(tlsSettings)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &http.Client{Timeout: apiClientTimeout, Transport: transport}, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/florianl/go-nflog/v2"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// echo requests with more data than ping sends by default may carry a tunnel
+const icmpTunnelPayloadThreshold = 128
+
+// otherProtocol returns the protocol of a packet that is neither TCP nor UDP, e.g. icmp,
+// and for ICMP echo requests the length of the data they carry.
+func otherProtocol(packet gopacket.Packet) (string, int, bool) {
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+		icmp, _ := icmpLayer.(*layers.ICMPv4)
+		payloadLength := 0
+		if icmp.TypeCode.Type() == layers.ICMPv4TypeEchoRequest {
+			payloadLength = len(icmp.Payload)
+		}
+		return "icmp", payloadLength, true
+	}
+
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv6); icmpLayer != nil {
+		icmp, _ := icmpLayer.(*layers.ICMPv6)
+		payloadLength := 0
+		// the identifier and sequence number of the echo are in the payload of the ICMPv6 layer
+		if icmp.TypeCode.Type() == layers.ICMPv6TypeEchoRequest && len(icmp.Payload) > 4 {
+			payloadLength = len(icmp.Payload) - 4
+		}
+		return "icmpv6", payloadLength, true
+	}
+
+	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
+		ipv4, _ := ipv4Layer.(*layers.IPv4)
+		return strings.ToLower(ipv4.Protocol.String()), 0, true
+	}
+
+	if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
+		ipv6, _ := ipv6Layer.(*layers.IPv6)
+		return strings.ToLower(ipv6.NextHeader.String()), 0, true
+	}
+
+	return "", 0, false
+}
+
+// handleOtherProtocol reports flows of protocols other than TCP and UDP to non-private destinations,
+// whether they are allowed or dropped, as the audit rules do not see them.
+func (netMonitor *NetworkMonitor) handleOtherProtocol(attrs nflog.Attribute, ipAddress, protocolName string, payloadLength int,
+	status, matchedPolicy, reason string, timestamp time.Time) {
+	if isPrivateIPAddress(ipAddress) {
+		return
+	}
+
+	cacheKey := fmt.Sprintf("%s:%s:%s", ipAddress, protocolName, status)
+	if !netMonitor.flows().ShouldReport(cacheKey) {
+		return
+	}
+
+	networkConnection := &NetworkConnection{IPAddress: ipAddress, Protocol: protocolName, PayloadLength: payloadLength,
+		Status: status, TimeStamp: timestamp, Tool: Tool{Name: Unknown, SHA256: Unknown}, MatchedPolicy: matchedPolicy,
+		Reason: reason, UID: attrs.UID, GID: attrs.GID}
+	if attrs.UID != nil {
+		networkConnection.User = userNameForUID(*attrs.UID)
+	}
+
+	destination := ipAddress
+	if netMonitor.DNSProxy != nil {
+		if domainName := netMonitor.DNSProxy.GetReverseIPLookup(ipAddress); domainName != "" {
+			networkConnection.DomainName = domainName
+			destination = fmt.Sprintf("%s (%s)", ipAddress, strings.TrimSuffix(domainName, "."))
+		}
+	}
+
+	logMessage := fmt.Sprintf("%s to %s %s", protocolName, destination, strings.ToLower(status))
+	if payloadLength > 0 {
+		logMessage = fmt.Sprintf("%s, echo payload: %d bytes", logMessage, payloadLength)
+	}
+	if networkConnection.User != "" {
+		logMessage = fmt.Sprintf("%s, user: %s", logMessage, networkConnection.User)
+	}
+
+	netMonitor.sendTelemetry(func() {
+		netMonitor.ApiClient.sendNetworkConnection(netMonitor.CorrelationId, netMonitor.Repo, networkConnection)
+		WriteLog(logMessage)
+
+		if status == "Dropped" {
+			WriteAnnotation(fmt.Sprintf("%s %s traffic to IP Address %s was blocked", StepSecurityAnnotationPrefix, strings.ToUpper(protocolName), ipAddress))
+		} else if payloadLength >= icmpTunnelPayloadThreshold {
+			WriteAnnotation(fmt.Sprintf("%s %s echo request to %s carried %d bytes of data, which may be a tunnel", StepSecurityAnnotationPrefix, strings.ToUpper(protocolName), destination, payloadLength))
+		}
+	})
+}
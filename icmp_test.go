@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/florianl/go-nflog/v2"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestNetworkMonitor_handlePacket_OtherProtocols(t *testing.T) {
+	echoData := gopacket.Payload(bytes.Repeat([]byte{0x41}, 200))
+
+	icmpEcho := func(dst string) []byte {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: net.ParseIP("10.1.0.4"), DstIP: net.ParseIP(dst)}
+		icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: 1}
+		return serializePacket(t, ip, icmp, echoData)
+	}
+
+	icmpv6Echo := func(dst string) []byte {
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: net.ParseIP("2001:db8::4"), DstIP: net.ParseIP(dst)}
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+		icmp.SetNetworkLayerForChecksum(ip)
+		return serializePacket(t, ip, icmp, &layers.ICMPv6Echo{Identifier: 1, SeqNumber: 1}, echoData)
+	}
+
+	gre := func(dst string) []byte {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolGRE, SrcIP: net.ParseIP("10.1.0.4"), DstIP: net.ParseIP(dst)}
+		return serializePacket(t, ip, &layers.GRE{Protocol: layers.EthernetTypeIPv4})
+	}
+
+	tests := []struct {
+		name          string
+		payload       []byte
+		prefix        string
+		ipAddress     string
+		protocol      string
+		payloadLength int
+		status        string
+	}{
+		{name: "icmp echo allowed", payload: icmpEcho("1.2.3.4"), prefix: nflogPrefixAudit, ipAddress: "1.2.3.4", protocol: "icmp", payloadLength: 200, status: "Allowed"},
+		{name: "icmp echo blocked", payload: icmpEcho("1.2.3.4"), prefix: nflogPrefixBlocked, ipAddress: "1.2.3.4", protocol: "icmp", payloadLength: 200, status: "Dropped"},
+		{name: "icmpv6 echo blocked", payload: icmpv6Echo("2001:db8::1"), prefix: nflogPrefixBlocked, ipAddress: "2001:db8::1", protocol: "icmpv6", payloadLength: 200, status: "Dropped"},
+		{name: "gre allowed", payload: gre("1.2.3.5"), prefix: nflogPrefixAudit, ipAddress: "1.2.3.5", protocol: "gre", status: "Allowed"},
+		{name: "icmp echo to private address", payload: icmpEcho("10.1.0.5"), prefix: nflogPrefixAudit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+			fileSink, err := NewFileTelemetrySink(filePath)
+			if err != nil {
+				t.Fatalf("NewFileTelemetrySink() error = %v", err)
+			}
+			apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{fileSink}}
+			netMonitor := &NetworkMonitor{CorrelationId: "123", Repo: "owner/repo", ApiClient: apiclient, Status: "Allowed"}
+
+			payload := tt.payload
+			prefix := tt.prefix
+			netMonitor.handlePacket(nflog.Attribute{Payload: &payload, Prefix: &prefix})
+			netMonitor.handlePacket(nflog.Attribute{Payload: &payload, Prefix: &prefix})
+			apiclient.closeTelemetrySinks()
+
+			data, _ := os.ReadFile(filePath)
+			if tt.ipAddress == "" {
+				if len(data) != 0 {
+					t.Fatalf("expected no network connection, got %s", data)
+				}
+				return
+			}
+
+			lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+			if len(lines) != 1 {
+				t.Fatalf("expected 1 network connection, got %d", len(lines))
+			}
+
+			var event struct {
+				Data NetworkConnection `json:"data"`
+			}
+			json.Unmarshal(lines[0], &event)
+			if event.Data.IPAddress != tt.ipAddress || event.Data.Protocol != tt.protocol ||
+				event.Data.PayloadLength != tt.payloadLength || event.Data.Status != tt.status {
+				t.Fatalf("unexpected network connection %+v", event.Data)
+			}
+		})
+	}
+}
+
+func TestAddICMPv6Rules(t *testing.T) {
+	for _, block := range []bool{false, true} {
+		ip6t := &recorderIPTables{}
+		if err := AddICMPv6Rules(&Firewall{ip6t}, block); err != nil {
+			t.Fatalf("AddICMPv6Rules() error = %v", err)
+		}
+
+		// private destinations are accepted, then the rest is logged and, in block mode, rejected
+		expectedTargets := []string{accept, accept, nflogTarget}
+		if block {
+			expectedTargets = append(expectedTargets, reject)
+		}
+		if len(ip6t.appended) != len(expectedTargets) {
+			t.Fatalf("expected %d rules, got %d", len(expectedTargets), len(ip6t.appended))
+		}
+		for i, targetName := range expectedTargets {
+			if insertedRuleTarget(ip6t.appended[i]) != targetName {
+				t.Fatalf("expected rule %d target %s, got %#v", i, targetName, ip6t.appended[i])
+			}
+		}
+	}
+}
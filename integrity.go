@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// source files changed since checkout are annotated up to this number
+	maxIntegrityAnnotations = 10
+	gitIndexPath            = ".git/index"
+)
+
+// directories of build outputs, they are skipped in working directories that are not git repositories
+var buildOutputDirectories = map[string]bool{
+	".git": true, "node_modules": true, "dist": true, "build": true, "target": true, "bin": true, "obj": true,
+	"__pycache__": true, ".gradle": true, ".venv": true,
+}
+
+// IntegrityReport lists the source files changed since checkout, paths are relative to the working directory.
+type IntegrityReport struct {
+	Modified []string
+	Added    []string
+	Deleted  []string
+}
+
+// IntegrityMonitor snapshots the working directory once it is checked out and reports
+// the source files that changed since then, with the tool chains that last wrote them.
+type IntegrityMonitor struct {
+	WorkingDirectory string
+	Annotate         bool // annotate changed files
+	EventHandler     *EventHandler
+	snapshot         map[string]string // checksums of the source files at checkout
+	writers          map[string]*Event // last write of each file
+	reported         bool
+	mutex            sync.Mutex
+}
+
+// recordWrite keeps the last writer of a file in the working directory. Checkout is done
+// when git writes the index, which is the last thing it writes, so the snapshot is taken then.
+// An index that exists when the agent starts is not used, on self-hosted runners it can be
+// left from a previous job.
+func (integrity *IntegrityMonitor) recordWrite(event *Event) {
+	relativePath, err := filepath.Rel(integrity.WorkingDirectory, event.FileName)
+	if err != nil || strings.HasPrefix(relativePath, "..") {
+		return
+	}
+
+	if relativePath == gitIndexPath {
+		integrity.takeSnapshot()
+		return
+	}
+	if strings.HasPrefix(relativePath, ".git/") {
+		return
+	}
+
+	integrity.mutex.Lock()
+	defer integrity.mutex.Unlock()
+
+	if integrity.writers == nil {
+		integrity.writers = make(map[string]*Event)
+	}
+	if _, found := integrity.writers[relativePath]; found || len(integrity.writers) < maxSourceCodeFiles {
+		integrity.writers[relativePath] = event
+	}
+}
+
+// takeSnapshot hashes the source files of the working directory, once.
+func (integrity *IntegrityMonitor) takeSnapshot() {
+	integrity.mutex.Lock()
+	defer integrity.mutex.Unlock()
+
+	if integrity.snapshot != nil {
+		return
+	}
+
+	integrity.snapshot = integrity.checksums()
+	// writes during checkout are not changes
+	integrity.writers = nil
+
+	WriteLog(fmt.Sprintf("[Source integrity] snapshot of %d files in %s", len(integrity.snapshot), integrity.WorkingDirectory))
+}
+
+// checksums returns the checksums of the source files, which are the files not ignored by git.
+func (integrity *IntegrityMonitor) checksums() map[string]string {
+	checksums := make(map[string]string)
+	for _, relativePath := range sourceFiles(integrity.WorkingDirectory) {
+		checksum, err := getProgramChecksum(filepath.Join(integrity.WorkingDirectory, relativePath))
+		if err == nil {
+			checksums[relativePath] = checksum
+		}
+	}
+	return checksums
+}
+
+// sourceFiles lists the tracked and untracked files that are not ignored, so build outputs are left out.
+// Without git, all files but those in build output directories are listed. The working directory
+// is owned by the runner user, not by the agent, so git is told it is safe.
+func sourceFiles(workingDirectory string) []string {
+	cmd := exec.Command("git", "-c", "safe.directory="+workingDirectory, "-C", workingDirectory, "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+	if out, err := cmd.Output(); err == nil {
+		var files []string
+		for _, file := range bytes.Split(out, []byte{0}) {
+			if len(file) > 0 {
+				files = append(files, string(file))
+			}
+		}
+		return files
+	}
+
+	var files []string
+	filepath.WalkDir(workingDirectory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			if path != workingDirectory && buildOutputDirectories[entry.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Type().IsRegular() && len(files) < maxSourceCodeFiles {
+			relativePath, _ := filepath.Rel(workingDirectory, path)
+			files = append(files, relativePath)
+		}
+		return nil
+	})
+	return files
+}
+
+// Report compares the source files with the snapshot and reports the changes once,
+// nil is returned if there is no snapshot.
+func (integrity *IntegrityMonitor) Report() *IntegrityReport {
+	integrity.mutex.Lock()
+	if integrity.snapshot == nil || integrity.reported {
+		integrity.mutex.Unlock()
+		return nil
+	}
+	integrity.reported = true
+	snapshot := integrity.snapshot
+	integrity.mutex.Unlock()
+
+	checksums := integrity.checksums()
+
+	report := &IntegrityReport{}
+	for relativePath, checksum := range snapshot {
+		currentChecksum, found := checksums[relativePath]
+		if !found {
+			report.Deleted = append(report.Deleted, relativePath)
+		} else if currentChecksum != checksum {
+			report.Modified = append(report.Modified, relativePath)
+		}
+	}
+	for relativePath := range checksums {
+		if _, found := snapshot[relativePath]; !found {
+			report.Added = append(report.Added, relativePath)
+		}
+	}
+	sort.Strings(report.Modified)
+	sort.Strings(report.Added)
+	sort.Strings(report.Deleted)
+
+	WriteLog(fmt.Sprintf("[Source integrity] %d modified, %d added, %d deleted files since checkout", len(report.Modified), len(report.Added), len(report.Deleted)))
+
+	annotations := 0
+	for _, change := range []struct {
+		name  string
+		files []string
+	}{{"modified", report.Modified}, {"added", report.Added}, {"deleted", report.Deleted}} {
+		for _, relativePath := range change.files {
+			toolChain := integrity.writerOf(relativePath)
+			WriteLog(fmt.Sprintf("[Source integrity] %s: %s, tool chain: %s", change.name, relativePath, toolChain))
+
+			if integrity.Annotate && annotations < maxIntegrityAnnotations {
+				WriteAnnotation(fmt.Sprintf("%s Source file %s was %s after checkout by %s", StepSecurityAnnotationPrefix, relativePath, change.name, toolChain))
+			}
+			annotations++
+		}
+	}
+
+	if integrity.Annotate && annotations > maxIntegrityAnnotations {
+		WriteAnnotation(fmt.Sprintf("%s %d more source files were changed after checkout", StepSecurityAnnotationPrefix, annotations-maxIntegrityAnnotations))
+	}
+
+	return report
+}
+
+// writerOf returns the tool chain that last wrote the file.
+func (integrity *IntegrityMonitor) writerOf(relativePath string) string {
+	integrity.mutex.Lock()
+	event, found := integrity.writers[relativePath]
+	integrity.mutex.Unlock()
+
+	if !found || integrity.EventHandler == nil {
+		return Unknown
+	}
+	return formatToolChain(integrity.EventHandler.GetToolChain(event.PPid, event.Exe))
+}
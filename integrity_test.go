@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, directory string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(directory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIntegrityMonitor_Report(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	workingDirectory := t.TempDir()
+	writeFiles(t, workingDirectory, map[string]string{
+		".gitignore": "dist/\n", "src/main.go": "package main\n", "src/util.go": "package main\n", "README.md": "# repo\n",
+	})
+	for _, args := range [][]string{{"init", "-q"}, {"add", "."}, {"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial"}} {
+		if out, err := exec.Command("git", append([]string{"-C", workingDirectory}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v %s", args, err, out)
+		}
+	}
+
+	eventHandler := NewEventHandler("123", "owner/repo", nil, nil)
+	eventHandler.Integrity = &IntegrityMonitor{WorkingDirectory: workingDirectory, EventHandler: eventHandler}
+	eventHandler.ProcessMap["39006100"] = &Process{PID: "39006100", PPid: "39006000", Exe: "/usr/bin/bash"}
+
+	// no report before checkout
+	if report := eventHandler.Integrity.Report(); report != nil {
+		t.Fatalf("expected no report without a snapshot, got %+v", report)
+	}
+
+	// git writes the index at the end of checkout
+	eventHandler.HandleEvent(&Event{EventType: fileMonitorTag, FileName: ".git/index", Path: workingDirectory, Syscall: "rename",
+		Exe: "/usr/bin/git", Pid: "39006101", PPid: "39006100"})
+
+	writeFiles(t, workingDirectory, map[string]string{"src/main.go": "package main\n\nfunc init() {}\n", "src/new.go": "package main\n", "dist/out.js": "build output\n"})
+	os.Remove(filepath.Join(workingDirectory, "README.md"))
+	eventHandler.HandleEvent(&Event{EventType: fileMonitorTag, FileName: "src/main.go", Path: workingDirectory, Syscall: "openat",
+		Exe: "/usr/bin/sed", Pid: "39006102", PPid: "39006100"})
+
+	report := eventHandler.Integrity.Report()
+	want := &IntegrityReport{Modified: []string{"src/main.go"}, Added: []string{"src/new.go"}, Deleted: []string{"README.md"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("Report() = %+v, want %+v", report, want)
+	}
+	if toolChain := eventHandler.Integrity.writerOf("src/main.go"); toolChain != "bash > sed" {
+		t.Fatalf("expected the write by sed, got %s", toolChain)
+	}
+
+	// reported once
+	if report := eventHandler.Integrity.Report(); report != nil {
+		t.Fatalf("expected a single report, got %+v", report)
+	}
+}
+
+func Test_sourceFiles_WithoutGit(t *testing.T) {
+	workingDirectory := t.TempDir()
+	writeFiles(t, workingDirectory, map[string]string{"main.go": "", "pkg/util.go": "", "node_modules/left-pad/index.js": "", "build/out": ""})
+
+	want := []string{"main.go", filepath.Join("pkg", "util.go")}
+	if got := sourceFiles(workingDirectory); !reflect.DeepEqual(got, want) {
+		t.Fatalf("sourceFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestIntegrityMonitor_ExistingIndexIsNotSnapshotted(t *testing.T) {
+	workingDirectory := t.TempDir()
+	writeFiles(t, workingDirectory, map[string]string{".git/index": "", "main.go": "package main\n"})
+
+	eventHandler := NewEventHandler("123", "owner/repo", nil, nil)
+	eventHandler.Integrity = &IntegrityMonitor{WorkingDirectory: workingDirectory, EventHandler: eventHandler}
+
+	// the index is left from a previous job, files changed before the next checkout are not reported
+	eventHandler.HandleEvent(&Event{EventType: fileMonitorTag, FileName: "main.go", Path: workingDirectory, Syscall: "openat",
+		Exe: "/usr/bin/sed", Pid: "39006102", PPid: "39006100"})
+	if report := eventHandler.Integrity.Report(); report != nil {
+		t.Fatalf("expected no report before the index is written, got %+v", report)
+	}
+}
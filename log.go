@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -17,15 +18,18 @@ func WriteLog(message string) {
 		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 
 	defer f.Close()
-	
+
+	var line string
 	//This is to prevent printing time for a newline
 	if message == "\n" {
-		f.WriteString(fmt.Sprintf("\n"))
-	} else{
+		line = "\n"
+	} else {
 		location, _ := time.LoadLocation("Etc/GMT")
-		f.WriteString(fmt.Sprintf("%s:%s\n", time.Now().In(location).Format("Mon, 02 Jan 2006 15:04:05 MST"), message))
+		line = fmt.Sprintf("%s:%s\n", time.Now().In(location).Format("Mon, 02 Jan 2006 15:04:05 MST"), message)
 	}
-	
 
-	
+	offset, err := f.Seek(0, io.SeekEnd)
+	if _, writeErr := f.WriteString(line); writeErr == nil && err == nil {
+		appendLogChain(agentLogChainPath, offset, []byte(line))
+	}
 }
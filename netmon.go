@@ -3,7 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/florianl/go-nflog/v2"
@@ -14,21 +19,51 @@ import (
 
 const Unknown = "Unknown"
 
+// NFLOG prefixes of the firewall rules, so the monitor knows which rule logged a packet
+const (
+	nflogPrefixAudit           = "stepsecurity-audit"
+	nflogPrefixBlocked         = "stepsecurity-blocked"
+	nflogPrefixGlobalBlocklist = "stepsecurity-global-blocklist"
+	nflogPrefixServerName      = "stepsecurity-server-name"
+)
+
 type NetworkMonitor struct {
 	CorrelationId   string
 	Repo            string
 	ApiClient       *ApiClient
 	GlobalBlocklist *GlobalBlocklist
+	DNSProxy        *DNSProxy
+	EventHandler    *EventHandler
+	EgressLimits    *EgressLimits
+	Firewall        *Firewall // adds the egress limit rules of new destinations, nil for the system's iptables
+	FlowCache       *FlowCache
 	Status          string
-	netMutex        sync.RWMutex
+	Workers         int
+	QueueSize       int
+	flowCacheOnce   sync.Once
+	queue           atomic.Pointer[packetQueue]
+
+	limitsMutex       sync.Mutex
+	annotatedLimits   map[string]bool // nflog prefixes of the limits annotated
+	quotaDestinations map[string]bool // destinations with quota rules
 }
 
-var ipAddresses = make(map[string]bool)
+// flows returns the cache of reported flows, a default one if none is set.
+func (netMonitor *NetworkMonitor) flows() *FlowCache {
+	netMonitor.flowCacheOnce.Do(func() {
+		if netMonitor.FlowCache == nil {
+			netMonitor.FlowCache = NewFlowCache(defaultFlowCacheWindow, defaultFlowCacheSize)
+		}
+	})
+	return netMonitor.FlowCache
+}
 
 func (netMonitor *NetworkMonitor) MonitorNetwork(ctx context.Context, nflogger AgentNflogger, errc chan error) []string {
 
 	//sysLogger, err := syslog.NewLogger(syslog.LOG_INFO|syslog.LOG_USER, 1)
 	var err error
+	// the kernel adds the UID and GID of the sending socket and the NFLOG prefix to every message,
+	// go-nflog has no flags to request them
 	config := nflog.Config{
 		Group:    100,
 		Copymode: nflog.CopyPacket,
@@ -49,8 +84,10 @@ func (netMonitor *NetworkMonitor) MonitorNetwork(ctx context.Context, nflogger A
 	}
 	defer nf.Close()
 
+	netMonitor.startPacketQueue(ctx)
+
 	fn := func(attrs nflog.Attribute) int {
-		go netMonitor.handlePacket(attrs)
+		netMonitor.enqueuePacket(attrs)
 		return 0
 	}
 
@@ -66,65 +103,194 @@ func (netMonitor *NetworkMonitor) MonitorNetwork(ctx context.Context, nflogger A
 	return nil
 }
 
+// ReportStats writes the flow cache and packet queue counters to agent.log.
+// It is called at post_event, as the agent is not stopped at the end of the job.
+func (netMonitor *NetworkMonitor) ReportStats() {
+	stats := netMonitor.flows().Stats()
+	WriteLog(fmt.Sprintf("network monitor flows reported: %d, duplicates suppressed: %d, evicted: %d",
+		stats.Reported, stats.Suppressed, stats.Evicted))
+	WriteLog(fmt.Sprintf("network monitor packet queue stats: %+v", netMonitor.Stats()))
+}
+
+// ipLayerType returns the IP version of an nflog or nfqueue payload, which starts at the network header.
+func ipLayerType(hwProtocol *uint16, data []byte) gopacket.LayerType {
+	if hwProtocol != nil {
+		switch layers.EthernetType(*hwProtocol) {
+		case layers.EthernetTypeIPv4:
+			return layers.LayerTypeIPv4
+		case layers.EthernetTypeIPv6:
+			return layers.LayerTypeIPv6
+		}
+	}
+
+	if len(data) > 0 && data[0]>>4 == 6 {
+		return layers.LayerTypeIPv6
+	}
+	return layers.LayerTypeIPv4
+}
+
+// dstIPAddress returns the destination of an IPv4 or IPv6 packet.
+// Extension headers of IPv6 packets are decoded by gopacket before the transport layer.
+func dstIPAddress(packet gopacket.Packet) (string, bool) {
+	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
+		ipv4, _ := ipv4Layer.(*layers.IPv4)
+		return ipv4.DstIP.String(), true
+	}
+	if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
+		ipv6, _ := ipv6Layer.(*layers.IPv6)
+		return ipv6.DstIP.String(), true
+	}
+	return "", false
+}
+
 func (netMonitor *NetworkMonitor) handlePacket(attrs nflog.Attribute) {
-	timestamp := time.Now().UTC() // *attrs.Timestamp
+	if attrs.Payload == nil {
+		return
+	}
+	// the kernel only adds a timestamp if the packet has one
+	timestamp := time.Now().UTC()
+	if attrs.Timestamp != nil {
+		timestamp = attrs.Timestamp.UTC()
+	}
+	prefix := ""
+	if attrs.Prefix != nil {
+		prefix = *attrs.Prefix
+	}
 	data := *attrs.Payload
-	packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+	packet := gopacket.NewPacket(data, ipLayerType(attrs.HwProtocol, data), gopacket.Default)
 	port := ""
+	var srcPort, dstPort uint16
+	transport := ""
 	isSYN := false
 	isUDP := false
+	otherProtocolName, icmpPayloadLength := "", 0
+	var payload []byte
 	// Get the TCP layer from this packet
 	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
 		// Get actual TCP data from this layer
 		tcp, _ := tcpLayer.(*layers.TCP)
 		port = tcp.DstPort.String()
+		srcPort, dstPort, transport = uint16(tcp.SrcPort), uint16(tcp.DstPort), "tcp"
 		isSYN = tcp.SYN
+		payload = tcp.Payload
 
 	} else if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
 		// Get actual UDP data from this layer
 		udp, _ := udpLayer.(*layers.UDP)
 		port = udp.DstPort.String()
+		srcPort, dstPort, transport = uint16(udp.SrcPort), uint16(udp.DstPort), "udp"
 		isUDP = true
+	} else {
+		otherProtocolName, icmpPayloadLength, _ = otherProtocol(packet)
 	}
 
 	// Get the IP layer from this packet
-	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
-		// Get actual TCP data from this layer
-		ipv4, _ := ipv4Layer.(*layers.IPv4)
-		netMonitor.netMutex.Lock()
-		ipv4Address := ipv4.DstIP.String()
+	if ipAddress, found := dstIPAddress(packet); found {
+		if prefix == nflogPrefixNewDestination {
+			netMonitor.addDestinationQuota(ipAddress)
+			return
+		}
+		if strings.HasPrefix(prefix, nflogPrefixLimit) {
+			netMonitor.handleEgressLimit(ipAddress, port, prefix, transport, srcPort, dstPort, timestamp)
+			return
+		}
+
 		matchedPolicy := ""
 		reason := ""
+		if len(payload) > 0 {
+			// first payload packets of a flow, logged to attribute it to a host name
+			netMonitor.handleServerName(ipAddress, port, payload, timestamp)
+			return
+		}
+
 		status := netMonitor.Status
-		if netMonitor.GlobalBlocklist != nil && netMonitor.GlobalBlocklist.IsIPAddressBlocked(ipv4Address) {
+		if prefix == nflogPrefixBlocked {
+			// logged right before the packet is rejected
+			status = "Dropped"
+		} else if prefix == nflogPrefixGlobalBlocklist {
+			// logged for every new connection, it is only dropped if the address is on the blocklist
+			status = "Allowed"
+		}
+		if netMonitor.GlobalBlocklist != nil && netMonitor.GlobalBlocklist.IsIPAddressBlocked(ipAddress) {
 			status = "Dropped"
 			matchedPolicy = GlobalBlocklistMatchedPolicy
-			reason = netMonitor.GlobalBlocklist.BlockedIPAddressReason(ipv4Address)
+			reason = netMonitor.GlobalBlocklist.BlockedIPAddressReason(ipAddress)
 		}
 
-		cacheKey := fmt.Sprintf("%s:%s:%s", ipv4Address, port, status)
-		_, found := ipAddresses[cacheKey]
-		if !found {
-			ipAddresses[cacheKey] = true
-
-			if isSYN || isUDP {
-				if status == "Dropped" {
-					netMonitor.ApiClient.sendNetConnection(netMonitor.CorrelationId, netMonitor.Repo,
-						ipv4Address, port, "", status, matchedPolicy, reason, timestamp, Tool{Name: Unknown, SHA256: Unknown})
-
-					logMessage := fmt.Sprintf("ip address dropped: %s", ipv4Address)
-					if reason != "" {
-						logMessage = fmt.Sprintf("%s, reason: %s", logMessage, reason)
-					}
-					go WriteLog(logMessage)
-
-					if ipv4Address != StepSecuritySinkHoleIPAddress { // Sinkhole IP address will be covered by DNS block
-						go WriteAnnotation(fmt.Sprintf("StepSecurity Harden Runner: Traffic to IP Address %s was blocked", ipv4Address))
-					}
-				}
+		if otherProtocolName != "" {
+			netMonitor.handleOtherProtocol(attrs, ipAddress, otherProtocolName, icmpPayloadLength, status, matchedPolicy, reason, timestamp)
+			return
+		}
+
+		cacheKey := fmt.Sprintf("%s:%s", net.JoinHostPort(ipAddress, port), status)
+		if (isSYN || isUDP) && status == "Dropped" && netMonitor.flows().ShouldReport(cacheKey) {
+			tool := netMonitor.toolForPacket(transport, srcPort, net.ParseIP(ipAddress), dstPort)
+
+			networkConnection := &NetworkConnection{IPAddress: ipAddress, Port: port, Status: status, TimeStamp: timestamp,
+				Tool: tool, MatchedPolicy: matchedPolicy, Reason: reason, UID: attrs.UID, GID: attrs.GID}
+			if attrs.UID != nil {
+				networkConnection.User = userNameForUID(*attrs.UID)
 			}
+			logMessage := fmt.Sprintf("ip address dropped: %s", ipAddress)
+			if tool.Name != Unknown {
+				logMessage = fmt.Sprintf("%s, process: %s", logMessage, tool.Name)
+			}
+			if networkConnection.User != "" {
+				logMessage = fmt.Sprintf("%s, user: %s", logMessage, networkConnection.User)
+			}
+			if reason != "" {
+				logMessage = fmt.Sprintf("%s, reason: %s", logMessage, reason)
+			}
+
+			// logging is done by the telemetry sender too, so it does not add a goroutine per packet
+			netMonitor.sendTelemetry(func() {
+				netMonitor.ApiClient.sendNetworkConnection(netMonitor.CorrelationId, netMonitor.Repo, networkConnection)
+				WriteLog(logMessage)
+
+				if ipAddress != StepSecuritySinkHoleIPAddress { // Sinkhole IP address will be covered by DNS block
+					WriteAnnotation(fmt.Sprintf("StepSecurity Harden Runner: Traffic to IP Address %s was blocked", ipAddress))
+				}
+			})
 		}
-		netMonitor.netMutex.Unlock()
 	}
 
 }
+
+// toolForPacket finds the process that sent a packet through its socket.
+// The socket can be closed by the time the packet is handled, then the tool is Unknown.
+func (netMonitor *NetworkMonitor) toolForPacket(transport string, srcPort uint16, dstIP net.IP, dstPort uint16) Tool {
+	unknown := Tool{Name: Unknown, SHA256: Unknown}
+	if netMonitor.EventHandler == nil || transport == "" {
+		return unknown
+	}
+
+	pid, ppid, exe, err := findProcessBySocket(transport, srcPort, dstIP, dstPort)
+	if err != nil {
+		return unknown
+	}
+
+	tool, _ := netMonitor.EventHandler.GetTool(pid, ppid, exe)
+	if tool.Name == "" {
+		return unknown
+	}
+	return tool
+}
+
+var userNames sync.Map
+
+// userNameForUID returns the name of the account with the uid, or the uid if it has no name.
+// UID and GID are only in the nflog message for packets sent by a local socket.
+func userNameForUID(uid uint32) string {
+	if name, found := userNames.Load(uid); found {
+		return name.(string)
+	}
+
+	id := strconv.FormatUint(uint64(uid), 10)
+	name := id
+	if u, err := user.LookupId(id); err == nil {
+		name = fmt.Sprintf("%s(%s)", u.Username, id)
+	}
+
+	userNames.Store(uid, name)
+	return name
+}
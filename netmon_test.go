@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nflog/v2"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serializePacket(t *testing.T, packetLayers ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, packetLayers...); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestNetworkMonitor_handlePacket(t *testing.T) {
+	srcIPv6 := net.ParseIP("fd00::1")
+
+	tcpSYN := func(ip gopacket.NetworkLayer) *layers.TCP {
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		return tcp
+	}
+
+	ipv4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.1.0.4"), DstIP: net.ParseIP("1.2.3.4")}
+	ipv6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: srcIPv6, DstIP: net.ParseIP("2001:db8::1")}
+	ipv6HopByHop := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6HopByHop, SrcIP: srcIPv6, DstIP: net.ParseIP("2001:db8::2"),
+		HopByHop: &layers.IPv6HopByHop{Options: []*layers.IPv6HopByHopOption{{OptionType: 1, OptionData: []byte{0, 0, 0, 0}}}}}
+	ipv6HopByHop.HopByHop.NextHeader = layers.IPProtocolTCP
+	udpIPv6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: srcIPv6, DstIP: net.ParseIP("2001:db8::3")}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(udpIPv6)
+
+	ipv6EtherType := uint16(layers.EthernetTypeIPv6)
+
+	tests := []struct {
+		name       string
+		payload    []byte
+		hwProtocol *uint16
+		ipAddress  string
+		port       string
+	}{
+		{name: "IPv4 SYN", payload: serializePacket(t, ipv4, tcpSYN(ipv4)), ipAddress: "1.2.3.4", port: "443(https)"},
+		{name: "IPv6 SYN", payload: serializePacket(t, ipv6, tcpSYN(ipv6)), ipAddress: "2001:db8::1", port: "443(https)"},
+		{name: "IPv6 SYN with hop-by-hop header", payload: serializePacket(t, ipv6HopByHop, tcpSYN(ipv6HopByHop)), hwProtocol: &ipv6EtherType, ipAddress: "2001:db8::2", port: "443(https)"},
+		{name: "IPv6 UDP", payload: serializePacket(t, udpIPv6, udp), ipAddress: "2001:db8::3", port: "53(domain)"},
+	}
+
+	blocklist := NewGlobalBlocklist(&GlobalBlocklistResponse{IPAddresses: []CompromisedEndpoint{
+		{Endpoint: "1.2.3.4"}, {Endpoint: "2001:DB8:0::1"}, {Endpoint: "2001:db8::2"}, {Endpoint: "2001:db8::3"},
+	}})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+			fileSink, err := NewFileTelemetrySink(filePath)
+			if err != nil {
+				t.Fatalf("NewFileTelemetrySink() error = %v", err)
+			}
+			apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{fileSink}}
+			netMonitor := &NetworkMonitor{CorrelationId: "123", Repo: "owner/repo", ApiClient: apiclient, GlobalBlocklist: blocklist, Status: "Allowed"}
+
+			payload := tt.payload
+			netMonitor.handlePacket(nflog.Attribute{Payload: &payload, HwProtocol: tt.hwProtocol})
+			// duplicate packets are reported once
+			netMonitor.handlePacket(nflog.Attribute{Payload: &payload, HwProtocol: tt.hwProtocol})
+			apiclient.closeTelemetrySinks()
+
+			data, _ := os.ReadFile(filePath)
+			lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+			if len(lines) != 1 {
+				t.Fatalf("expected 1 network connection, got %d", len(lines))
+			}
+
+			var event struct {
+				Data NetworkConnection `json:"data"`
+			}
+			json.Unmarshal(lines[0], &event)
+			if event.Data.IPAddress != tt.ipAddress || event.Data.Port != tt.port || event.Data.Status != "Dropped" {
+				t.Fatalf("unexpected network connection %+v", event.Data)
+			}
+		})
+	}
+}
+
+func TestNetworkMonitor_handlePacket_Prefix(t *testing.T) {
+	ipv4 := func(dst string) []byte {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.1.0.4"), DstIP: net.ParseIP(dst)}
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 8443, SYN: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		return serializePacket(t, ip, tcp)
+	}
+	uid := uint32(os.Getuid())
+	kernelTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		prefix    string
+		ipAddress string
+		dropped   bool
+	}{
+		{name: "blocked rule", prefix: nflogPrefixBlocked, ipAddress: "5.6.7.8", dropped: true},
+		{name: "global blocklist rule, address not on blocklist", prefix: nflogPrefixGlobalBlocklist, ipAddress: "5.6.7.9", dropped: false},
+		{name: "global blocklist rule, address on blocklist", prefix: nflogPrefixGlobalBlocklist, ipAddress: "5.6.7.10", dropped: true},
+	}
+
+	blocklist := NewGlobalBlocklist(&GlobalBlocklistResponse{IPAddresses: []CompromisedEndpoint{{Endpoint: "5.6.7.10"}}})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+			fileSink, err := NewFileTelemetrySink(filePath)
+			if err != nil {
+				t.Fatalf("NewFileTelemetrySink() error = %v", err)
+			}
+			apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{fileSink}}
+			// in block mode the status of the monitor is Dropped
+			netMonitor := &NetworkMonitor{CorrelationId: "123", Repo: "owner/repo", ApiClient: apiclient, GlobalBlocklist: blocklist, Status: "Dropped"}
+
+			payload := ipv4(tt.ipAddress)
+			prefix := tt.prefix
+			netMonitor.handlePacket(nflog.Attribute{Payload: &payload, Prefix: &prefix, UID: &uid, GID: &uid, Timestamp: &kernelTime})
+			apiclient.closeTelemetrySinks()
+
+			data, _ := os.ReadFile(filePath)
+			lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+			if !tt.dropped {
+				if len(data) != 0 {
+					t.Fatalf("expected no network connection, got %s", data)
+				}
+				return
+			}
+			if len(lines) != 1 {
+				t.Fatalf("expected 1 network connection, got %d", len(lines))
+			}
+
+			var event struct {
+				Data NetworkConnection `json:"data"`
+			}
+			json.Unmarshal(lines[0], &event)
+			if event.Data.Status != "Dropped" || event.Data.UID == nil || *event.Data.UID != uid || event.Data.User != userNameForUID(uid) ||
+				!event.Data.TimeStamp.Equal(kernelTime) {
+				t.Fatalf("unexpected network connection %+v", event.Data)
+			}
+		})
+	}
+}
+
+func TestNetworkMonitor_handlePacket_NonSYNBeforeSYN(t *testing.T) {
+	packet := func(syn bool) []byte {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.1.0.4"), DstIP: net.ParseIP("1.2.3.4")}
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: syn, ACK: !syn}
+		tcp.SetNetworkLayerForChecksum(ip)
+		return serializePacket(t, ip, tcp)
+	}
+
+	filePath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+	fileSink, err := NewFileTelemetrySink(filePath)
+	if err != nil {
+		t.Fatalf("NewFileTelemetrySink() error = %v", err)
+	}
+	apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{fileSink}}
+	netMonitor := &NetworkMonitor{CorrelationId: "123", Repo: "owner/repo", ApiClient: apiclient, Status: "Dropped"}
+
+	// a packet that is not reported does not suppress the report of the next SYN
+	ack, syn := packet(false), packet(true)
+	netMonitor.handlePacket(nflog.Attribute{Payload: &ack})
+	netMonitor.handlePacket(nflog.Attribute{Payload: &syn})
+	apiclient.closeTelemetrySinks()
+
+	data, _ := os.ReadFile(filePath)
+	if lines := bytes.Split(bytes.TrimSpace(data), []byte("\n")); len(data) == 0 || len(lines) != 1 {
+		t.Fatalf("expected 1 network connection, got %s", data)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "context"
+
+const (
+	sniQueueNum = 101
+
+	// netfilter verdicts, /include/uapi/linux/netfilter.h
+	nfDrop   = 0
+	nfAccept = 1
+	nfRepeat = 4
+)
+
+// NfQueuePacket is a packet handed to userspace by the NFQUEUE target.
+type NfQueuePacket struct {
+	ID         uint32
+	HwProtocol uint16
+	Payload    []byte
+}
+
+// NfQueueVerdict decides the fate of a queued packet.
+// Mark, if not zero, is set on the packet before the verdict is applied.
+type NfQueueVerdict struct {
+	Verdict uint32
+	Mark    uint32
+}
+
+// NfQueueHookFunc is called for every queued packet, in order.
+type NfQueueHookFunc func(packet NfQueuePacket) NfQueueVerdict
+
+type NfQueue interface {
+	Register(ctx context.Context, fn NfQueueHookFunc) error
+	Close() error
+}
+
+type AgentNfQueuer interface {
+	Open(queueNum uint16) (NfQueue, error)
+}
@@ -0,0 +1,9 @@
+package main
+
+import "fmt"
+
+type NfQueuer struct{}
+
+func (queuer *NfQueuer) Open(queueNum uint16) (NfQueue, error) {
+	return nil, fmt.Errorf("nfqueue is not supported on darwin")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// nfnetlink_queue message and attribute types, /include/uapi/linux/netfilter/nfnetlink_queue.h
+const (
+	nfnlSubsysQueue = 3
+
+	nfqnlMsgPacket  = 0
+	nfqnlMsgVerdict = 1
+	nfqnlMsgConfig  = 2
+
+	nfqaPacketHdr  = 1
+	nfqaVerdictHdr = 2
+	nfqaMark       = 3
+	nfqaPayload    = 10
+
+	nfqaCfgCmd    = 1
+	nfqaCfgParams = 2
+	nfqaCfgFlags  = 5
+	nfqaCfgMask   = 6
+
+	nfqnlCfgCmdBind   = 1
+	nfqnlCfgCmdUnbind = 2
+	nfqnlCopyPacket   = 2
+
+	// accept packets instead of dropping them when the queue is full
+	nfqaCfgFFailOpen = 1
+
+	nfqueueCopyRange = 0xffff
+
+	// wait after the socket buffer overflowed, so the queue can drain
+	nfqueueReceiveBackoff = 100 * time.Millisecond
+)
+
+// netlinkNfQueue is a minimal NFQUEUE client, enough to inspect packets and issue verdicts.
+type netlinkNfQueue struct {
+	con      *netlink.Conn
+	queueNum uint16
+}
+
+type NfQueuer struct{}
+
+func (queuer *NfQueuer) Open(queueNum uint16) (NfQueue, error) {
+	con, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open netfilter netlink socket")
+	}
+
+	return &netlinkNfQueue{con: con, queueNum: queueNum}, nil
+}
+
+func (queue *netlinkNfQueue) Close() error {
+	return queue.con.Close()
+}
+
+// Register binds to the queue and calls fn for every packet until ctx is done.
+func (queue *netlinkNfQueue) Register(ctx context.Context, fn NfQueueHookFunc) error {
+	// IPv4 and IPv6 packets are queued
+	for _, family := range []uint16{unix.AF_INET, unix.AF_INET6} {
+		err := queue.setConfig(unix.AF_UNSPEC, []netlink.Attribute{{Type: nfqaCfgCmd, Data: configCmd(nfqnlCfgCmdBind, family)}})
+		if err != nil {
+			return errors.Wrap(err, "failed to bind nfqueue")
+		}
+	}
+
+	params := make([]byte, 5)
+	binary.BigEndian.PutUint32(params, nfqueueCopyRange)
+	params[4] = nfqnlCopyPacket
+
+	flags := make([]byte, 4)
+	binary.BigEndian.PutUint32(flags, nfqaCfgFFailOpen)
+
+	err := queue.setConfig(unix.AF_UNSPEC, []netlink.Attribute{
+		{Type: nfqaCfgParams, Data: params},
+		{Type: nfqaCfgFlags, Data: flags},
+		{Type: nfqaCfgMask, Data: flags},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to configure nfqueue")
+	}
+
+	go func() {
+		<-ctx.Done()
+		// interrupt the blocking Receive
+		queue.con.SetReadDeadline(time.Now().Add(-1 * time.Second))
+	}()
+
+	go func() {
+		defer func() {
+			for _, family := range []uint16{unix.AF_INET, unix.AF_INET6} {
+				queue.setConfig(unix.AF_UNSPEC, []netlink.Attribute{{Type: nfqaCfgCmd, Data: configCmd(nfqnlCfgCmdUnbind, family)}})
+			}
+		}()
+
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			msgs, err := queue.con.Receive()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				// packets are dropped when the socket buffer overflows, read on with the next ones
+				if errors.Is(err, unix.ENOBUFS) {
+					WriteLog(fmt.Sprintf("nfqueue receive buffer overflowed: %v", err))
+					time.Sleep(nfqueueReceiveBackoff)
+					continue
+				}
+				if errors.Is(err, unix.EINTR) || errors.Is(err, unix.EAGAIN) {
+					continue
+				}
+				WriteLog(fmt.Sprintf("failed to receive from nfqueue: %v", err))
+				return
+			}
+
+			for _, msg := range msgs {
+				if msg.Header.Type != netlink.HeaderType(nfnlSubsysQueue<<8|nfqnlMsgPacket) {
+					continue
+				}
+
+				packet, err := parseNfQueueMsg(msg.Data)
+				if err != nil {
+					WriteLog(fmt.Sprintf("failed to parse nfqueue message: %v", err))
+					continue
+				}
+
+				if err := queue.setVerdict(packet.ID, fn(packet)); err != nil {
+					WriteLog(fmt.Sprintf("failed to set nfqueue verdict: %v", err))
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// configCmd is struct nfqnl_msg_config_cmd
+func configCmd(command uint8, pf uint16) []byte {
+	cmd := []byte{command, 0, 0, 0}
+	binary.BigEndian.PutUint16(cmd[2:], pf)
+	return cmd
+}
+
+// nfgenHeader is struct nfgenmsg
+func nfgenHeader(family uint8, resID uint16) []byte {
+	header := []byte{family, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], resID)
+	return header
+}
+
+func (queue *netlinkNfQueue) setConfig(family uint8, attrs []netlink.Attribute) error {
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return err
+	}
+
+	req := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(nfnlSubsysQueue<<8 | nfqnlMsgConfig),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(nfgenHeader(family, queue.queueNum), data...),
+	}
+
+	reply, err := queue.con.Execute(req)
+	if err != nil {
+		return err
+	}
+	return netlink.Validate(req, reply)
+}
+
+func (queue *netlinkNfQueue) setVerdict(id uint32, verdict NfQueueVerdict) error {
+	verdictHdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(verdictHdr, verdict.Verdict)
+	binary.BigEndian.PutUint32(verdictHdr[4:], id)
+
+	attrs := []netlink.Attribute{{Type: nfqaVerdictHdr, Data: verdictHdr}}
+	if verdict.Mark != 0 {
+		mark := make([]byte, 4)
+		binary.BigEndian.PutUint32(mark, verdict.Mark)
+		attrs = append(attrs, netlink.Attribute{Type: nfqaMark, Data: mark})
+	}
+
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return err
+	}
+
+	_, err = queue.con.Send(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(nfnlSubsysQueue<<8 | nfqnlMsgVerdict),
+			Flags: netlink.Request,
+		},
+		Data: append(nfgenHeader(unix.AF_UNSPEC, queue.queueNum), data...),
+	})
+	return err
+}
+
+func parseNfQueueMsg(data []byte) (NfQueuePacket, error) {
+	packet := NfQueuePacket{}
+	if len(data) < 4 {
+		return packet, fmt.Errorf("message too short")
+	}
+
+	ad, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return packet, err
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	foundHdr := false
+	for ad.Next() {
+		switch ad.Type() {
+		case nfqaPacketHdr:
+			// struct nfqnl_msg_packet_hdr: packet_id(4) hw_protocol(2) hook(1)
+			hdr := ad.Bytes()
+			if len(hdr) < 6 {
+				return packet, fmt.Errorf("invalid packet header")
+			}
+			packet.ID = binary.BigEndian.Uint32(hdr)
+			packet.HwProtocol = binary.BigEndian.Uint16(hdr[4:])
+			foundHdr = true
+		case nfqaPayload:
+			packet.Payload = ad.Bytes()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return packet, err
+	}
+	if !foundHdr {
+		return packet, fmt.Errorf("missing packet header")
+	}
+
+	return packet, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+)
+
+func Test_parseNfQueueMsg(t *testing.T) {
+	hdr := make([]byte, 7)
+	binary.BigEndian.PutUint32(hdr, 42)
+	binary.BigEndian.PutUint16(hdr[4:], 0x0800)
+
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfqaPacketHdr, Data: hdr},
+		{Type: nfqaPayload, Data: []byte{0x45, 0x00}},
+	})
+	if err != nil {
+		t.Fatalf("MarshalAttributes() error = %v", err)
+	}
+
+	packet, err := parseNfQueueMsg(append(nfgenHeader(0, sniQueueNum), attrs...))
+	if err != nil {
+		t.Fatalf("parseNfQueueMsg() error = %v", err)
+	}
+	if packet.ID != 42 || packet.HwProtocol != 0x0800 || len(packet.Payload) != 2 {
+		t.Fatalf("unexpected packet %+v", packet)
+	}
+
+	if _, err := parseNfQueueMsg(nfgenHeader(0, sniQueueNum)); err == nil {
+		t.Fatalf("expected error for message without packet header")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/florianl/go-nflog/v2"
+)
+
+const (
+	defaultPacketWorkers        = 4
+	defaultPacketQueueSize      = 4096
+	defaultNetworkTelemetrySize = 1024
+)
+
+// NetworkMonitorStats are the counters of the packet queue of a NetworkMonitor.
+type NetworkMonitorStats struct {
+	QueueDepth       int
+	Queued           uint64
+	Dropped          uint64
+	Processed        uint64
+	TelemetryQueued  uint64
+	TelemetryDropped uint64
+}
+
+// packetQueue hands packets from the nflog hook to a fixed number of workers, and their telemetry
+// to a single sender, so a burst of packets, e.g. a port scan, neither grows goroutines without bound
+// nor waits on the API. Packets and telemetry that do not fit in the queues are dropped and counted.
+type packetQueue struct {
+	packets          chan nflog.Attribute
+	telemetry        chan func()
+	queued           uint64
+	dropped          uint64
+	processed        uint64
+	telemetryQueued  uint64
+	telemetryDropped uint64
+}
+
+// startPacketQueue starts the workers and the telemetry sender, they stop when ctx is done.
+func (netMonitor *NetworkMonitor) startPacketQueue(ctx context.Context) {
+	workers := netMonitor.Workers
+	if workers <= 0 {
+		workers = defaultPacketWorkers
+	}
+	queueSize := netMonitor.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultPacketQueueSize
+	}
+
+	queue := &packetQueue{
+		packets:   make(chan nflog.Attribute, queueSize),
+		telemetry: make(chan func(), defaultNetworkTelemetrySize),
+	}
+	netMonitor.queue.Store(queue)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case attrs := <-queue.packets:
+					netMonitor.handlePacket(attrs)
+					atomic.AddUint64(&queue.processed, 1)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case send := <-queue.telemetry:
+				send()
+			}
+		}
+	}()
+}
+
+// enqueuePacket is called from the nflog hook and never blocks it.
+func (netMonitor *NetworkMonitor) enqueuePacket(attrs nflog.Attribute) {
+	queue := netMonitor.queue.Load()
+	if queue == nil {
+		go netMonitor.handlePacket(attrs)
+		return
+	}
+
+	select {
+	case queue.packets <- attrs:
+		atomic.AddUint64(&queue.queued, 1)
+	default:
+		if atomic.AddUint64(&queue.dropped, 1) == 1 {
+			go WriteLog("network monitor packet queue is full, dropping packets")
+		}
+	}
+}
+
+// sendTelemetry hands send to the telemetry sender without blocking the worker.
+// Without a started queue, e.g. in tests, send runs right away.
+func (netMonitor *NetworkMonitor) sendTelemetry(send func()) {
+	queue := netMonitor.queue.Load()
+	if queue == nil {
+		send()
+		return
+	}
+
+	select {
+	case queue.telemetry <- send:
+		atomic.AddUint64(&queue.telemetryQueued, 1)
+	default:
+		if atomic.AddUint64(&queue.telemetryDropped, 1) == 1 {
+			go WriteLog("network monitor telemetry queue is full, dropping events")
+		}
+	}
+}
+
+func (netMonitor *NetworkMonitor) Stats() NetworkMonitorStats {
+	queue := netMonitor.queue.Load()
+	if queue == nil {
+		return NetworkMonitorStats{}
+	}
+
+	return NetworkMonitorStats{
+		QueueDepth:       len(queue.packets),
+		Queued:           atomic.LoadUint64(&queue.queued),
+		Dropped:          atomic.LoadUint64(&queue.dropped),
+		Processed:        atomic.LoadUint64(&queue.processed),
+		TelemetryQueued:  atomic.LoadUint64(&queue.telemetryQueued),
+		TelemetryDropped: atomic.LoadUint64(&queue.telemetryDropped),
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nflog/v2"
+	"github.com/google/gopacket/layers"
+)
+
+// scanNflogger replays packets to the hook as fast as it returns, like nflog during a port scan.
+type scanNflogger struct {
+	packets    [][]byte
+	registered chan time.Duration
+}
+
+func (m *scanNflogger) Open(config *nflog.Config) (AgentNfLog, error) {
+	return AgentNfLog{m}, nil
+}
+
+func (m *scanNflogger) Close() error {
+	return nil
+}
+
+func (m *scanNflogger) Register(ctx context.Context, fn nflog.HookFunc) error {
+	start := time.Now()
+	prefix := nflogPrefixBlocked
+	for i := range m.packets {
+		fn(nflog.Attribute{Payload: &m.packets[i], Prefix: &prefix})
+	}
+	m.registered <- time.Since(start)
+	return nil
+}
+
+// slowTelemetrySink blocks like an unreachable API.
+type slowTelemetrySink struct{}
+
+func (sink *slowTelemetrySink) Name() string {
+	return "slow"
+}
+
+func (sink *slowTelemetrySink) Send(event *TelemetryEvent) error {
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+func (sink *slowTelemetrySink) Close() error {
+	return nil
+}
+
+func TestNetworkMonitor_MonitorNetwork_Load(t *testing.T) {
+	const packetCount = 20000
+
+	nflogger := &scanNflogger{registered: make(chan time.Duration, 1)}
+	for i := 0; i < packetCount; i++ {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.1.0.4"),
+			DstIP: net.IPv4(5, 6, byte(i>>8), byte(i))}
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(1 + i%1000), SYN: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		nflogger.packets = append(nflogger.packets, serializePacket(t, ip, tcp))
+	}
+
+	sink := &slowTelemetrySink{}
+	apiclient := &ApiClient{Sinks: []TelemetrySink{sink}}
+	netMonitor := &NetworkMonitor{CorrelationId: "123", Repo: "owner/repo", ApiClient: apiclient, Status: "Dropped",
+		Workers: 2, QueueSize: 256}
+
+	goroutinesBefore := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		netMonitor.MonitorNetwork(ctx, nflogger, make(chan error, 1))
+		close(done)
+	}()
+
+	elapsed := <-nflogger.registered
+	// the hook never waits on packet handling or telemetry
+	if elapsed > 5*time.Second {
+		t.Fatalf("hook took %v for %d packets", elapsed, packetCount)
+	}
+
+	// workers, telemetry sender and logging, but no goroutine per packet
+	if goroutines := runtime.NumGoroutine() - goroutinesBefore; goroutines > 100 {
+		t.Fatalf("expected a bounded number of goroutines, got %d more", goroutines)
+	}
+
+	// workers get through the queue although telemetry is slow, it is handed off without waiting
+	deadline := time.Now().Add(5 * time.Second)
+	for netMonitor.Stats().Processed < netMonitor.Stats().Queued && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	stats := netMonitor.Stats()
+	if stats.Queued+stats.Dropped != packetCount {
+		t.Fatalf("expected %d packets queued or dropped, got %+v", packetCount, stats)
+	}
+	if stats.Processed != stats.Queued {
+		t.Fatalf("expected all queued packets processed, got %+v", stats)
+	}
+}
+
+func TestNetworkMonitor_enqueuePacket_Drops(t *testing.T) {
+	netMonitor := &NetworkMonitor{CorrelationId: "123", Repo: "owner/repo", Status: "Dropped"}
+	// a queue whose worker is blocked, nothing takes packets off it
+	netMonitor.queue.Store(&packetQueue{packets: make(chan nflog.Attribute, 2), telemetry: make(chan func(), 1)})
+
+	payload := []byte{}
+	for i := 0; i < 5; i++ {
+		netMonitor.enqueuePacket(nflog.Attribute{Payload: &payload})
+	}
+
+	if stats := netMonitor.Stats(); stats.Queued != 2 || stats.Dropped != 3 || stats.QueueDepth != 2 {
+		t.Fatalf("expected 2 packets queued and 3 dropped, got %+v", stats)
+	}
+}
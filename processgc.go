@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+const (
+	defaultProcessGCInterval = time.Minute
+	// exited processes are kept a while for events that arrive after the exit, e.g. from the network monitor
+	defaultProcessRetention = 5 * time.Minute
+	maxSourceCodeFiles      = 100000
+)
+
+// processCacheKey is the key of a process in ProcessConnectionMap, so the entries of a retired process can be found.
+func processCacheKey(pid string, parts ...string) string {
+	return pid + "|" + strings.Join(parts, "|")
+}
+
+// StartProcessGC retires exited processes every interval until ctx is done.
+func (eventHandler *EventHandler) StartProcessGC(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultProcessGCInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			eventHandler.retireProcesses(time.Now(), defaultProcessRetention)
+		}
+	}
+}
+
+// retireProcesses removes processes that exited more than retention ago from ProcessMap, along with their
+// entries in ProcessConnectionMap. Exited processes that are ancestors of running ones are kept for their tool chain.
+func (eventHandler *EventHandler) retireProcesses(now time.Time, retention time.Duration) []string {
+	eventHandler.procMutex.Lock()
+
+	for pid, process := range eventHandler.ProcessMap {
+		if processExists(pid) {
+			process.exited = time.Time{}
+		} else if process.exited.IsZero() {
+			process.exited = now
+		}
+	}
+
+	ancestors := make(map[string]bool)
+	for _, process := range eventHandler.ProcessMap {
+		if !process.exited.IsZero() {
+			continue
+		}
+		for ppid := process.PPid; !ancestors[ppid]; {
+			ancestors[ppid] = true
+			parent, found := eventHandler.ProcessMap[ppid]
+			if !found {
+				break
+			}
+			ppid = parent.PPid
+		}
+	}
+
+	var retired []string
+	for pid, process := range eventHandler.ProcessMap {
+		if !process.exited.IsZero() && now.Sub(process.exited) >= retention && !ancestors[pid] {
+			delete(eventHandler.ProcessMap, pid)
+			retired = append(retired, pid)
+		}
+	}
+	eventHandler.procMutex.Unlock()
+
+	if len(retired) == 0 {
+		return retired
+	}
+
+	retiredPids := make(map[string]bool, len(retired))
+	for _, pid := range retired {
+		retiredPids[pid] = true
+	}
+
+	eventHandler.netMutex.Lock()
+	for cacheKey := range eventHandler.ProcessConnectionMap {
+		if pid, _, found := strings.Cut(cacheKey, "|"); found && retiredPids[pid] {
+			delete(eventHandler.ProcessConnectionMap, cacheKey)
+		}
+	}
+	eventHandler.netMutex.Unlock()
+
+	return retired
+}
@@ -3,14 +3,34 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/elastic/go-libaudit/v2/auparse"
 )
 
 const (
-	netMonitorTag     = "netmon"
-	fileMonitorTag    = "filemon"
-	processMonitorTag = "procmon"
+	netMonitorTag        = "netmon"
+	fileMonitorTag       = "filemon"
+	processMonitorTag    = "procmon"
+	rawSocketMonitorTag  = "rawsock"
+	fileAccessMonitorTag = "fileaccess" // reads and execs of watched files
+	credentialMonitorTag = "credaccess" // reads of credential files
+	fileCmdMonitorTag    = "filecmd"    // writes to GITHUB_ENV, GITHUB_PATH and GITHUB_OUTPUT
+
+	AuditModeExclusive = "exclusive" // the agent replaces the audit rules of the host and receives all events
+	AuditModeCoexist   = "coexist"   // rules of the host are kept, events are read from the multicast group if auditd runs
+	AuditModeMulticast = "multicast" // rules of the host are kept, events are always read from the multicast group
+
+	ProcessMonitorBackendAudit = "audit"
+	ProcessMonitorBackendEBPF  = "ebpf" // falls back to audit if the kernel does not support it
+
+	// keys of the audit rules of the agent start with it, so only they are removed
+	agentAuditKeyPrefix = "stepsecurity-"
+
+	// events are evicted once this many sequences are pending, e.g. if their EOE record is lost
+	maxPendingAuditEvents = 10000
 )
 
 type ProcessMonitor struct {
@@ -20,7 +40,23 @@ type ProcessMonitor struct {
 	DNSProxy              *DNSProxy
 	WorkingDirectory      string
 	DisableFileMonitoring bool
+	EventHandler          *EventHandler
+	FileWatches           []FileWatch
+	CredentialFiles       []credentialFile // reads of them are audited
+	FileCommandsDirectory string           // writes to it are audited if set
+	AuditMode             string
+	Backend               string // ProcessMonitorBackendAudit or ProcessMonitorBackendEBPF
+	AuditBacklogLimit     uint32
+	AuditRateLimit        uint32 // events per second, 0 is unlimited
+	AuditRecordPath       string // the audit stream is recorded to this file if set
 	Events                map[int]*Event
+	lastSequence          int
+	auditHealth           auditHealth
+	auditRuleSnapshot     [][]byte             // rules of the host when monitoring started
+	ebpfExecs             map[uint32]*ebpfExec // execves of the eBPF backend by pid, until their result
+	ebpfCwds              map[uint32][]string  // working directories of the eBPF backend by pid, until their syscall
+	ebpfFiles             *ebpfFileFilter
+	pending               sync.WaitGroup // events being handled
 	mutex                 sync.RWMutex
 }
 
@@ -33,10 +69,14 @@ type Process struct {
 	Arguments        []string
 	Scenario         string // npm publish, dotnet push are scenarios
 	Timestamp        string
+	exited           time.Time // when the process was first seen gone, zero while it runs
 }
 
 type Event struct {
 	FileName          string
+	SourceFileName    string // the file renamed to FileName
+	Severity          string // of the file watch of FileName
+	fileNameType      string // nametype of the PATH record of FileName
 	Path              string
 	Syscall           string
 	Exe               string
@@ -46,6 +86,9 @@ type Event struct {
 	ProcessArguments  []string
 	PPid              string
 	Euid              string
+	SocketFamily      string // arguments of socket, in hex
+	SocketType        string
+	SocketProtocol    string
 	Timestamp         time.Time
 	EventType         string
 	Status            string
@@ -65,6 +108,13 @@ func (p *ProcessMonitor) PrepareEvent(sequence int, eventMap map[string]interfac
 	if found {
 		tags := value.([]string)
 		for _, tag := range tags {
+			tag = strings.TrimPrefix(tag, agentAuditKeyPrefix)
+			for _, fileTag := range []string{fileMonitorTag, fileAccessMonitorTag} {
+				if severity, found := strings.CutPrefix(tag, fileTag+"-"); found {
+					tag = fileTag
+					p.Events[sequence].Severity = severity
+				}
+			}
 			p.Events[sequence].EventType = tag
 			p.Events[sequence].Syscall = getValue("syscall", eventMap)
 			p.Events[sequence].Exe = getValue("exe", eventMap)
@@ -77,6 +127,11 @@ func (p *ProcessMonitor) PrepareEvent(sequence int, eventMap map[string]interfac
 			}
 			p.Events[sequence].Timestamp = timestamp
 			p.Events[sequence].Status = getValue("result", eventMap)
+			if tag == rawSocketMonitorTag {
+				p.Events[sequence].SocketFamily = getValue("a0", eventMap)
+				p.Events[sequence].SocketType = getValue("a1", eventMap)
+				p.Events[sequence].SocketProtocol = getValue("a2", eventMap)
+			}
 		}
 	}
 
@@ -111,15 +166,17 @@ func (p *ProcessMonitor) PrepareEvent(sequence int, eventMap map[string]interfac
 	nameType, found := eventMap["nametype"]
 
 	if found {
-		nameTypeStr := fmt.Sprintf("%v", nameType)
-		if nameTypeStr == "DELETE" || nameTypeStr == "CREATE" || nameTypeStr == "NORMAL" {
-			p.Events[sequence].FileName = getValue("name", eventMap)
-		}
+		p.Events[sequence].addPath(getValue("name", eventMap), fmt.Sprintf("%v", nameType))
 	}
 
 	p.mutex.Unlock()
 }
 
+// auditKey is the key of the audit rules of the agent for events of tag.
+func auditKey(tag string) string {
+	return agentAuditKeyPrefix + tag
+}
+
 func getValue(key string, eventMap map[string]interface{}) string {
 	val, found := eventMap[key]
 	if found {
@@ -129,10 +186,72 @@ func getValue(key string, eventMap map[string]interface{}) string {
 	return ""
 }
 
-func (p *ProcessMonitor) markEventSent(event *Event) {
+// addPath sets FileName from the PATH records of an event, a syscall has one per file it touches.
+// The first created, deleted or opened file is the FileName, unless a file is created later, e.g. by
+// rename, then it is the FileName and the deleted file its SourceFileName. PARENT records are skipped.
+func (event *Event) addPath(name, nameType string) {
+	if nameType != "DELETE" && nameType != "CREATE" && nameType != "NORMAL" {
+		return
+	}
+
+	switch {
+	case event.FileName == "":
+		event.FileName = name
+		event.fileNameType = nameType
+	case nameType == "CREATE" && event.fileNameType != "CREATE":
+		if event.fileNameType == "DELETE" && event.SourceFileName == "" {
+			event.SourceFileName = event.FileName
+		}
+		event.FileName = name
+		event.fileNameType = nameType
+	}
+}
+
+// handleRecord adds an audit record to the event of its sequence. The kernel ends every syscall event
+// with an EOE record, then the event is removed from Events and returned if it is complete.
+func (p *ProcessMonitor) handleRecord(sequence int, recordType auparse.AuditMessageType, eventMap map[string]interface{}) *Event {
+	if recordType != auparse.AUDIT_EOE {
+		p.PrepareEvent(sequence, eventMap)
+
+		p.mutex.Lock()
+		p.evictOldEvents(sequence)
+		p.mutex.Unlock()
+		return nil
+	}
+
 	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	event, found := p.Events[sequence]
+	if !found {
+		return nil
+	}
+	delete(p.Events, sequence)
+
+	if !isEventReady(event) {
+		return nil
+	}
 	event.SentForProcessing = true
-	p.mutex.Unlock()
+	return event
+}
+
+// evictOldEvents removes the oldest half of the pending sequences once there are too many.
+// Callers must hold mutex.
+func (p *ProcessMonitor) evictOldEvents(sequence int) {
+	if sequence > p.lastSequence {
+		p.lastSequence = sequence
+	}
+
+	if len(p.Events) <= maxPendingAuditEvents {
+		return
+	}
+
+	oldest := p.lastSequence - maxPendingAuditEvents/2
+	for pendingSequence := range p.Events {
+		if pendingSequence <= oldest {
+			delete(p.Events, pendingSequence)
+		}
+	}
 }
 
 func isEventReady(event *Event) bool {
@@ -145,7 +264,7 @@ func isEventReady(event *Event) bool {
 		if event.IPAddress != "" && event.Port != "" {
 			return true
 		}
-	case fileMonitorTag:
+	case fileMonitorTag, fileAccessMonitorTag, credentialMonitorTag, fileCmdMonitorTag:
 		if event.FileName != "" && event.Path != "" {
 			return true
 		}
@@ -153,6 +272,10 @@ func isEventReady(event *Event) bool {
 		if len(event.ProcessArguments) > 0 && event.Path != "" {
 			return true
 		}
+	case rawSocketMonitorTag:
+		if event.SocketFamily != "" && event.Exe != "" {
+			return true
+		}
 	}
 	return false
 }
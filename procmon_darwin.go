@@ -5,15 +5,45 @@ package main
 
 import (
 	"fmt"
+	"net"
 )
 
 func (p *ProcessMonitor) MonitorProcesses(errc chan error) {
 	WriteLog("Monitor Processes called")
 }
 
+func (p *ProcessMonitor) RevertAuditRules() error {
+	return nil
+}
+
 func getParentProcessId(pid string) (int, error) {
 	return -1, fmt.Errorf("not implemented")
 }
 func getProcessExe(pid string) (string, error) {
 	return "", fmt.Errorf("not implemented")
 }
+
+func getProcessCwd(pid string) (string, error) {
+	return "", fmt.Errorf("not implemented")
+}
+
+func getProcessFile(pid string, fd int) (string, error) {
+	return "", fmt.Errorf("not implemented")
+}
+
+func getProcessArguments(pid string) ([]string, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func getProcessUID(pid string) (string, error) {
+	return "", fmt.Errorf("not implemented")
+}
+
+// processExists always reports true, processes are not retired on darwin.
+func processExists(pid string) bool {
+	return true
+}
+
+func findProcessBySocket(protocol string, srcPort uint16, dstIP net.IP, dstPort uint16) (string, string, string, error) {
+	return "", "", "", fmt.Errorf("not implemented")
+}
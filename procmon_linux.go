@@ -9,6 +9,8 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/elastic/go-libaudit/v2"
 	"github.com/elastic/go-libaudit/v2/auparse"
@@ -21,6 +23,14 @@ func (p *ProcessMonitor) MonitorProcesses(errc chan error) {
 	WriteLog("\n")
 	WriteLog("Monitor Processes called")
 
+	if p.Backend == ProcessMonitorBackendEBPF {
+		err := p.monitorProcessesEBPF()
+		if err == nil {
+			return
+		}
+		WriteLog(fmt.Sprintf("eBPF process monitor is not available, falling back to audit: %v", err))
+	}
+
 	client, err := libaudit.NewAuditClient(nil)
 	if err != nil {
 		errc <- errors.Wrap(err, "failed to new audit client")
@@ -42,11 +52,58 @@ func (p *ProcessMonitor) MonitorProcesses(errc chan error) {
 
 	WriteLog("Status is enabled")
 
-	if _, err = client.DeleteRules(); err != nil {
-		errc <- errors.Wrap(err, "failed to delete audit rules")
+	// the rules of the host are restored when the agent reverts its changes
+	if err = p.snapshotAuditRules(client); err != nil {
+		WriteLog(fmt.Sprintf("failed to snapshot audit rules %v", err))
 	}
 
-	WriteLog("Rules deleted")
+	if p.AuditMode == AuditModeExclusive {
+		backlogLimit := p.AuditBacklogLimit
+		if backlogLimit == 0 {
+			backlogLimit = defaultAuditBacklogLimit
+		}
+		if err = client.SetBacklogLimit(backlogLimit, libaudit.WaitForReply); err != nil {
+			WriteLog(fmt.Sprintf("failed to set audit backlog limit %v", err))
+		}
+		if err = client.SetRateLimit(p.AuditRateLimit, libaudit.WaitForReply); err != nil {
+			WriteLog(fmt.Sprintf("failed to set audit rate limit %v", err))
+		}
+
+		WriteLog(fmt.Sprintf("Audit backlog limit: %d, rate limit: %d", backlogLimit, p.AuditRateLimit))
+
+		if _, err = client.DeleteRules(); err != nil {
+			errc <- errors.Wrap(err, "failed to delete audit rules")
+		}
+
+		WriteLog("Rules deleted")
+	} else {
+		WriteLog(fmt.Sprintf("Audit mode %s, keeping the audit configuration of the host", p.AuditMode))
+	}
+
+	// reads of credential files and writes to file commands, before the file watches so their exclusions do not hide them
+	for _, credentialRule := range credentialAccessRules(p.CredentialFiles, os.Getpid()) {
+		r, _ := flags.Parse(credentialRule)
+		actualBytes, _ := rule.Build(r)
+
+		if err = client.AddRule(actualBytes); err != nil {
+			WriteLog(fmt.Sprintf("failed to add audit rule %s %v", credentialRule, err))
+		}
+	}
+
+	if len(p.CredentialFiles) > 0 {
+		WriteLog(fmt.Sprintf("Credential file monitor added for %d files", len(p.CredentialFiles)))
+	}
+
+	for _, fileCommandRule := range fileCommandRules(p.FileCommandsDirectory) {
+		r, _ := flags.Parse(fileCommandRule)
+		actualBytes, _ := rule.Build(r)
+
+		if err = client.AddRule(actualBytes); err != nil {
+			WriteLog(fmt.Sprintf("failed to add audit rule %s %v", fileCommandRule, err))
+		} else {
+			WriteLog(fmt.Sprintf("File command monitor added for %s", p.FileCommandsDirectory))
+		}
+	}
 
 	if !p.DisableFileMonitoring {
 
@@ -55,19 +112,41 @@ func (p *ProcessMonitor) MonitorProcesses(errc chan error) {
 		if len(workingDirectory) == 0 {
 			workingDirectory = "/home/runner"
 		}
-		r, _ := flags.Parse(fmt.Sprintf("-a exit,always -F dir=%s -F perm=wa -S open -S openat -S rename -S renameat -k %s", workingDirectory, fileMonitorTag))
 
-		actualBytes, _ := rule.Build(r)
+		// watches of agent.json, their exclusions have to come before the rule of the working directory
+		watchRules, err := fileWatchRules(p.FileWatches, workingDirectory)
+		if err != nil {
+			WriteLog(fmt.Sprintf("invalid file watches %v", err))
+		}
+		for _, watchRule := range watchRules {
+			r, _ := flags.Parse(watchRule)
+			actualBytes, _ := rule.Build(r)
 
-		if err = client.AddRule(actualBytes); err != nil {
-			WriteLog(fmt.Sprintf("failed to add audit rule %v", err))
-			errc <- errors.Wrap(err, "failed to add audit rule")
+			if err = client.AddRule(actualBytes); err != nil {
+				WriteLog(fmt.Sprintf("failed to add audit rule %s %v", watchRule, err))
+			}
+		}
+
+		if len(watchRules) > 0 {
+			WriteLog(fmt.Sprintf("File watches added, %d rules", len(watchRules)))
+		}
+
+		// a watch of the working directory replaces the default rule
+		if !hasFileWatch(p.FileWatches, workingDirectory) {
+			r, _ := flags.Parse(fmt.Sprintf("-a exit,always -F dir=%s -F perm=wa -S open -S openat -S rename -S renameat -k %s", workingDirectory, auditKey(fileMonitorTag)))
+
+			actualBytes, _ := rule.Build(r)
+
+			if err = client.AddRule(actualBytes); err != nil {
+				WriteLog(fmt.Sprintf("failed to add audit rule %v", err))
+				errc <- errors.Wrap(err, "failed to add audit rule")
+			}
 		}
 
 		WriteLog(fmt.Sprintf("File monitor added for %s", workingDirectory))
 	}
 
-	r, _ := flags.Parse(fmt.Sprintf("-w %s -p w -k %s", "/home/agent", fileMonitorTag))
+	r, _ := flags.Parse(fmt.Sprintf("-w %s -p w -k %s", "/home/agent", auditKey(fileMonitorTag)))
 	actualBytes, _ := rule.Build(r)
 
 	if err = client.AddRule(actualBytes); err != nil {
@@ -77,7 +156,7 @@ func (p *ProcessMonitor) MonitorProcesses(errc chan error) {
 
 	WriteLog("Agent file monitor added")
 
-	r, _ = flags.Parse(fmt.Sprintf("-w %s -p w -k %s", dockerDaemonConfigPath, fileMonitorTag))
+	r, _ = flags.Parse(fmt.Sprintf("-w %s -p w -k %s", dockerDaemonConfigPath, auditKey(fileMonitorTag)))
 	actualBytes, _ = rule.Build(r)
 
 	if err = client.AddRule(actualBytes); err != nil {
@@ -87,7 +166,7 @@ func (p *ProcessMonitor) MonitorProcesses(errc chan error) {
 
 	WriteLog("Docker's daemon.json file monitor added")
 
-	r, _ = flags.Parse(fmt.Sprintf("-w %s -p w -k %s", resolvedConfigPath, fileMonitorTag))
+	r, _ = flags.Parse(fmt.Sprintf("-w %s -p w -k %s", resolvedConfigPath, auditKey(fileMonitorTag)))
 	actualBytes, _ = rule.Build(r)
 
 	if err = client.AddRule(actualBytes); err != nil {
@@ -98,7 +177,7 @@ func (p *ProcessMonitor) MonitorProcesses(errc chan error) {
 	WriteLog("Systemd's resolved.conf file monitor added")
 
 	// syscall connect
-	r, _ = flags.Parse(fmt.Sprintf("-a exit,always -S connect -k %s", netMonitorTag))
+	r, _ = flags.Parse(fmt.Sprintf("-a exit,always -S connect -k %s", auditKey(netMonitorTag)))
 
 	actualBytes, _ = rule.Build(r)
 
@@ -110,7 +189,7 @@ func (p *ProcessMonitor) MonitorProcesses(errc chan error) {
 	WriteLog("Net monitor added for TCP (connect)")
 
 	// syscall sendto (for UDP)
-	r, _ = flags.Parse(fmt.Sprintf("-a exit,always -S sendto -S sendmsg -k %s", netMonitorTag))
+	r, _ = flags.Parse(fmt.Sprintf("-a exit,always -S sendto -S sendmsg -k %s", auditKey(netMonitorTag)))
 
 	actualBytes, _ = rule.Build(r)
 
@@ -121,8 +200,22 @@ func (p *ProcessMonitor) MonitorProcesses(errc chan error) {
 
 	WriteLog("Net monitor added for UDP (sendto & sendmsg)")
 
+	// raw and packet sockets, e.g. for ICMP tunnels, send without connect or a port
+	for _, socketFilter := range []string{"-F a0=17", "-F a1&=3"} { // AF_PACKET, SOCK_RAW
+		r, _ = flags.Parse(fmt.Sprintf("-a exit,always -S socket %s -k %s", socketFilter, auditKey(rawSocketMonitorTag)))
+
+		actualBytes, _ = rule.Build(r)
+
+		if err = client.AddRule(actualBytes); err != nil {
+			WriteLog(fmt.Sprintf("failed to add audit rule for socket %v", err))
+			errc <- errors.Wrap(err, "failed to add audit rule for syscall socket")
+		}
+	}
+
+	WriteLog("Net monitor added for raw sockets (socket)")
+
 	// syscall process start
-	r, _ = flags.Parse(fmt.Sprintf("-a exit,always -S execve -k %s", processMonitorTag))
+	r, _ = flags.Parse(fmt.Sprintf("-a exit,always -S execve -k %s", auditKey(processMonitorTag)))
 
 	actualBytes, _ = rule.Build(r)
 
@@ -139,30 +232,95 @@ func (p *ProcessMonitor) MonitorProcesses(errc chan error) {
 	}*/
 	WriteLog("Process monitor added")
 
-	// sending message to kernel registering our PID
-	if err = client.SetPID(libaudit.NoWait); err != nil {
-		errc <- errors.Wrap(err, "failed to set audit PID")
+	// auditd keeps receiving the events of the host if the agent reads them from the multicast group
+	var receiver AuditReceiver = client
+	if p.AuditMode == AuditModeMulticast || p.AuditMode == AuditModeCoexist && auditdRunning(status) {
+		multicastClient, err := libaudit.NewMulticastAuditClient(nil)
+		if err != nil {
+			errc <- errors.Wrap(err, "failed to create multicast audit client")
+			return
+		}
+		defer multicastClient.Close()
+		receiver = multicastClient
+
+		WriteLog("Receiving audit events from the multicast group")
+	} else {
+		// sending message to kernel registering our PID
+		if err = client.SetPID(libaudit.NoWait); err != nil {
+			errc <- errors.Wrap(err, "failed to set audit PID")
+		}
 	}
 
+	if status != nil {
+		p.reportAuditStatus(status.Lost, status.Backlog, status.BacklogLimit)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go p.pollAuditStatus(done)
+
 	WriteLog("receive called")
 	WriteLog("\n")
 
-	p.receive(client)
+	if p.AuditRecordPath != "" {
+		recorder, err := newAuditRecorder(receiver, p.AuditRecordPath)
+		if err != nil {
+			WriteLog(fmt.Sprintf("failed to record audit stream %v", err))
+		} else {
+			defer recorder.Close()
+			receiver = recorder
+			WriteLog(fmt.Sprintf("recording audit stream to %s", p.AuditRecordPath))
+		}
+	}
+
+	if err = p.receive(receiver); err != nil {
+		WriteLog(fmt.Sprintf("process monitor stopped %v", err))
+	}
 }
 
-func (p *ProcessMonitor) receive(r *libaudit.AuditClient) error {
+// pollAuditStatus reports lost events until done is closed. It uses a client of its own,
+// the replies would otherwise be read by receive.
+func (p *ProcessMonitor) pollAuditStatus(done chan struct{}) {
+	client, err := libaudit.NewAuditClient(nil)
+	if err != nil {
+		WriteLog(fmt.Sprintf("failed to create audit status client %v", err))
+		return
+	}
+	defer client.Close()
+
+	ticker := time.NewTicker(auditStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			status, err := client.GetStatus()
+			if err != nil {
+				WriteLog(fmt.Sprintf("failed to get audit status %v", err))
+				continue
+			}
+			p.reportAuditStatus(status.Lost, status.Backlog, status.BacklogLimit)
+		}
+	}
+}
+
+func (p *ProcessMonitor) receive(r AuditReceiver) error {
 
 	p.Events = make(map[int]*Event)
-	eventHandler := EventHandler{CorrelationId: p.CorrelationId, Repo: p.Repo, ApiClient: p.ApiClient, DNSProxy: p.DNSProxy}
-	eventHandler.ProcessConnectionMap = make(map[string]bool)
-	eventHandler.ProcessFileMap = make(map[string]bool)
-	eventHandler.SourceCodeMap = make(map[string][]*Event)
-	eventHandler.ProcessMap = make(map[string]*Process)
-	eventHandler.FileOverwriteCounterMap = make(map[string]int)
+	eventHandler := p.EventHandler
+	if eventHandler == nil {
+		eventHandler = NewEventHandler(p.CorrelationId, p.Repo, p.ApiClient, p.DNSProxy)
+	}
 
 	for {
 		rawEvent, err := r.Receive(false)
 		if err != nil {
+			// records are dropped when the socket buffer overflows, read on with the next ones
+			if errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+				continue
+			}
 			return errors.Wrap(err, "receive failed")
 		}
 
@@ -174,21 +332,24 @@ func (p *ProcessMonitor) receive(r *libaudit.AuditClient) error {
 
 		message, err := auparse.Parse(rawEvent.Type, string(rawEvent.Data))
 		if err != nil {
-			return errors.Wrap(err, "parse failed.")
+			p.recordParseError(err)
+			continue
 		}
 		eventMap := message.ToMapStr()
 
-		p.PrepareEvent(int(message.Sequence), eventMap)
-		if isEventReady(p.Events[int(message.Sequence)]) {
-			p.markEventSent(p.Events[int(message.Sequence)])
-			go eventHandler.HandleEvent(p.Events[int(message.Sequence)])
+		if event := p.handleRecord(int(message.Sequence), rawEvent.Type, eventMap); event != nil {
+			p.pending.Add(1)
+			go func() {
+				defer p.pending.Done()
+				eventHandler.HandleEvent(event)
+			}()
 		}
 
 	}
 }
 
 func getParentProcessId(pid string) (int, error) {
-	statPath := fmt.Sprintf("/proc/%s/stat", pid)
+	statPath := fmt.Sprintf("%s/%s/stat", procRoot, pid)
 	dataBytes, err := ioutil.ReadFile(statPath)
 	if err != nil {
 		return -1, err
@@ -213,10 +374,48 @@ func getParentProcessId(pid string) (int, error) {
 	return ppid, err
 }
 
+func processExists(pid string) bool {
+	_, err := os.Stat(fmt.Sprintf("%s/%s", procRoot, pid))
+	return err == nil
+}
+
+// getProcessCwd returns the working directory of a running process.
+func getProcessCwd(pid string) (string, error) {
+	return os.Readlink(fmt.Sprintf("%s/%s/cwd", procRoot, pid))
+}
+
+// getProcessFile returns the path of an open file descriptor of a running process.
+func getProcessFile(pid string, fd int) (string, error) {
+	return os.Readlink(fmt.Sprintf("%s/%s/fd/%d", procRoot, pid, fd))
+}
+
 func getProcessExe(pid string) (string, error) {
-	path, err := os.Readlink(fmt.Sprintf("/proc/%s/exe", pid))
+	path, err := os.Readlink(fmt.Sprintf("%s/%s/exe", procRoot, pid))
 	if err != nil {
 		return "", err
 	}
 	return path, nil
 }
+
+// getProcessArguments returns the command line of a running process.
+func getProcessArguments(pid string) ([]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/cmdline", procRoot, pid))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00"), nil
+}
+
+// getProcessUID returns the real user id of a running process.
+func getProcessUID(pid string) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/status", procRoot, pid))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "Uid:" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("no uid in status of %s", pid)
+}
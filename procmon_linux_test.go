@@ -4,8 +4,12 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"os/user"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func Test_getProcessExe(t *testing.T) {
@@ -35,3 +39,85 @@ func Test_getProcessExe(t *testing.T) {
 	}
 
 }
+
+func TestEventHandler_retireProcesses(t *testing.T) {
+	defer func(root string) { procRoot = root }(procRoot)
+	procRoot = t.TempDir()
+
+	// 100 runs, 200 exited, the parent of the running 300 exited too
+	for _, pid := range []string{"100", "300"} {
+		if err := os.Mkdir(filepath.Join(procRoot, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eventHandler := NewEventHandler("123", "owner/repo", nil, nil)
+	eventHandler.ProcessMap["100"] = &Process{PID: "100", PPid: "1"}
+	eventHandler.ProcessMap["200"] = &Process{PID: "200", PPid: "100"}
+	eventHandler.ProcessMap["250"] = &Process{PID: "250", PPid: "100"}
+	eventHandler.ProcessMap["300"] = &Process{PID: "300", PPid: "250"}
+	eventHandler.ProcessConnectionMap[processCacheKey("200", "1.1.1.1", "443")] = true
+	eventHandler.ProcessConnectionMap[processCacheKey("2000", "1.1.1.1", "443")] = true
+
+	now := time.Now()
+	if retired := eventHandler.retireProcesses(now, time.Minute); len(retired) != 0 {
+		t.Fatalf("expected exited processes to be kept for the retention, got %v", retired)
+	}
+
+	retired := eventHandler.retireProcesses(now.Add(time.Minute), time.Minute)
+	if len(retired) != 1 || retired[0] != "200" {
+		t.Fatalf("expected 200 to be retired, got %v", retired)
+	}
+	if _, found := eventHandler.ProcessMap["250"]; !found {
+		t.Fatalf("expected parent of a running process to be kept")
+	}
+	if eventHandler.ProcessConnectionMap[processCacheKey("200", "1.1.1.1", "443")] ||
+		!eventHandler.ProcessConnectionMap[processCacheKey("2000", "1.1.1.1", "443")] {
+		t.Fatalf("expected only the connections of 200 to be removed, got %v", eventHandler.ProcessConnectionMap)
+	}
+
+	// long jobs start many short lived processes
+	for pid := 1000; pid < 101000; pid++ {
+		eventHandler.ProcessMap[fmt.Sprint(pid)] = &Process{PID: fmt.Sprint(pid), PPid: "100"}
+	}
+	eventHandler.retireProcesses(now.Add(2*time.Minute), time.Minute)
+	eventHandler.retireProcesses(now.Add(3*time.Minute), time.Minute)
+	if len(eventHandler.ProcessMap) != 3 {
+		t.Fatalf("expected only running processes and their parents, got %d", len(eventHandler.ProcessMap))
+	}
+}
+
+func Test_credentialFiles_Runner(t *testing.T) {
+	defer func(root string) { procRoot = root }(procRoot)
+	procRoot = t.TempDir()
+
+	runnerRoot := filepath.Join(t.TempDir(), "runners", "2.319.1")
+	os.MkdirAll(filepath.Join(procRoot, "1234"), 0755)
+	os.Symlink(filepath.Join(runnerRoot, "bin", "Runner.Worker"), filepath.Join(procRoot, "1234", "exe"))
+
+	files := credentialFiles("/home/runner", "1234")
+
+	want := []string{filepath.Join(runnerRoot, ".credentials"), filepath.Join(runnerRoot, ".credentials_rsaparams"), "/proc/1234/environ"}
+	if blocked := blockedCredentialFiles(files); fmt.Sprint(blocked) != fmt.Sprint(want) {
+		t.Fatalf("blockedCredentialFiles() = %v, want %v", blocked, want)
+	}
+}
+
+func Test_runnerHome(t *testing.T) {
+	defer func(root string) { procRoot = root }(procRoot)
+	procRoot = t.TempDir()
+
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("current user is not known")
+	}
+	os.MkdirAll(filepath.Join(procRoot, "1234"), 0755)
+	os.WriteFile(filepath.Join(procRoot, "1234", "status"), []byte("Name:\tRunner.Worker\nUid:\t"+u.Uid+"\t"+u.Uid+"\t"+u.Uid+"\t"+u.Uid+"\n"), 0644)
+
+	if home := runnerHome("1234"); home != u.HomeDir {
+		t.Fatalf("runnerHome() = %s, want %s", home, u.HomeDir)
+	}
+	if home := runnerHome("4321"); home != defaultRunnerHomeDirectory {
+		t.Fatalf("runnerHome() = %s, want %s", home, defaultRunnerHomeDirectory)
+	}
+}
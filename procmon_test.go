@@ -1,7 +1,10 @@
 package main
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/elastic/go-libaudit/v2/auparse"
 )
 
 func TestProcessMonitor_PrepareEvent(t *testing.T) {
@@ -63,4 +66,158 @@ func TestProcessMonitor_PrepareEvent(t *testing.T) {
 	if !isReady {
 		t.Errorf("Event ready expected")
 	}
+
+	rawSocketEvent := make(map[string]interface{})
+	rawSocketEvent["tags"] = []string{"rawsock"}
+	rawSocketEvent["syscall"] = "socket"
+	rawSocketEvent["exe"] = "/usr/bin/ping"
+	rawSocketEvent["a0"] = "2"
+	rawSocketEvent["a1"] = "3"
+	rawSocketEvent["a2"] = "1"
+
+	processMonitor.PrepareEvent(3, rawSocketEvent)
+
+	if !isEventReady(processMonitor.Events[3]) || processMonitor.Events[3].SocketType != "3" {
+		t.Errorf("Event ready expected")
+	}
+}
+
+// handleRecords feeds audit log lines to the process monitor, like the records of the audit netlink socket.
+func handleRecords(t *testing.T, processMonitor *ProcessMonitor, records string) []*Event {
+	var events []*Event
+	for _, line := range strings.Split(strings.TrimSpace(records), "\n") {
+		message, err := auparse.ParseLogLine(strings.TrimSpace(line))
+		if err != nil {
+			t.Fatalf("ParseLogLine(%q) error = %v", line, err)
+		}
+		if event := processMonitor.handleRecord(int(message.Sequence), message.RecordType, message.ToMapStr()); event != nil {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestProcessMonitor_handleRecord(t *testing.T) {
+	tests := []struct {
+		name           string
+		records        string
+		fileName       string
+		sourceFileName string
+		ipAddress      string
+		arguments      int
+	}{
+		{
+			name: "open creates file",
+			records: `type=SYSCALL msg=audit(1700000000.100:100): arch=c000003e syscall=257 success=yes exit=3 items=2 ppid=10 pid=20 uid=1001 euid=1001 comm="touch" exe="/usr/bin/touch" key="filemon"
+				type=CWD msg=audit(1700000000.100:100): cwd="/home/runner/work/repo"
+				type=PATH msg=audit(1700000000.100:100): item=0 name="src/" inode=11 nametype=PARENT
+				type=PATH msg=audit(1700000000.100:100): item=1 name="src/main.go" inode=12 nametype=CREATE
+				type=PROCTITLE msg=audit(1700000000.100:100): proctitle=746F756368
+				type=EOE msg=audit(1700000000.100:100): `,
+			fileName: "src/main.go",
+		},
+		{
+			name: "rename",
+			records: `type=SYSCALL msg=audit(1700000000.200:200): arch=c000003e syscall=316 success=yes exit=0 items=4 ppid=10 pid=20 uid=1001 euid=1001 comm="mv" exe="/usr/bin/mv" key="filemon"
+				type=CWD msg=audit(1700000000.200:200): cwd="/home/runner/work/repo"
+				type=PATH msg=audit(1700000000.200:200): item=0 name="/tmp/" inode=11 nametype=PARENT
+				type=PATH msg=audit(1700000000.200:200): item=1 name="src/" inode=12 nametype=PARENT
+				type=PATH msg=audit(1700000000.200:200): item=2 name="/tmp/main.go" inode=13 nametype=DELETE
+				type=PATH msg=audit(1700000000.200:200): item=3 name="src/main.go" inode=14 nametype=DELETE
+				type=PATH msg=audit(1700000000.200:200): item=4 name="src/main.go" inode=13 nametype=CREATE
+				type=EOE msg=audit(1700000000.200:200): `,
+			fileName:       "src/main.go",
+			sourceFileName: "/tmp/main.go",
+		},
+		{
+			name: "unlink",
+			records: `type=SYSCALL msg=audit(1700000000.300:300): arch=c000003e syscall=263 success=yes exit=0 items=2 ppid=10 pid=20 uid=1001 euid=1001 comm="rm" exe="/usr/bin/rm" key="filemon"
+				type=CWD msg=audit(1700000000.300:300): cwd="/home/runner/work/repo"
+				type=PATH msg=audit(1700000000.300:300): item=0 name="src/" inode=12 nametype=PARENT
+				type=PATH msg=audit(1700000000.300:300): item=1 name="src/main.go" inode=14 nametype=DELETE
+				type=EOE msg=audit(1700000000.300:300): `,
+			fileName: "src/main.go",
+		},
+		{
+			name: "execve",
+			records: `type=SYSCALL msg=audit(1700000000.400:400): arch=c000003e syscall=59 success=yes exit=0 items=2 ppid=10 pid=20 uid=1001 euid=1001 comm="ls" exe="/usr/bin/ls" key="procmon"
+				type=EXECVE msg=audit(1700000000.400:400): argc=2 a0="ls" a1="-la"
+				type=CWD msg=audit(1700000000.400:400): cwd="/home/runner/work/repo"
+				type=PATH msg=audit(1700000000.400:400): item=0 name="/usr/bin/ls" inode=15 nametype=NORMAL
+				type=PATH msg=audit(1700000000.400:400): item=1 name="/lib64/ld-linux-x86-64.so.2" inode=16 nametype=NORMAL
+				type=EOE msg=audit(1700000000.400:400): `,
+			fileName:  "/usr/bin/ls",
+			arguments: 2,
+		},
+		{
+			name: "connect",
+			records: `type=SYSCALL msg=audit(1700000000.500:500): arch=c000003e syscall=42 success=yes exit=0 items=0 ppid=10 pid=20 uid=1001 euid=1001 comm="curl" exe="/usr/bin/curl" key="stepsecurity-netmon"
+				type=SOCKADDR msg=audit(1700000000.500:500): saddr=020001BB020202020000000000000000
+				type=PROCTITLE msg=audit(1700000000.500:500): proctitle=6375726C
+				type=EOE msg=audit(1700000000.500:500): `,
+			ipAddress: "2.2.2.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			processMonitor := &ProcessMonitor{Events: make(map[int]*Event)}
+
+			// records are only complete with the EOE record
+			lines := strings.Split(strings.TrimSpace(tt.records), "\n")
+			if events := handleRecords(t, processMonitor, strings.Join(lines[:len(lines)-1], "\n")); len(events) != 0 {
+				t.Fatalf("expected no event before EOE, got %+v", events[0])
+			}
+
+			events := handleRecords(t, processMonitor, lines[len(lines)-1])
+			if len(events) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(events))
+			}
+			event := events[0]
+			if event.FileName != tt.fileName || event.SourceFileName != tt.sourceFileName ||
+				event.IPAddress != tt.ipAddress || len(event.ProcessArguments) != tt.arguments {
+				t.Fatalf("unexpected event %+v", event)
+			}
+			if event.Pid != "20" || event.Path == "" && tt.ipAddress == "" {
+				t.Fatalf("expected syscall and cwd records in the event, got %+v", event)
+			}
+			if len(processMonitor.Events) != 0 {
+				t.Fatalf("expected event to be removed after EOE, got %d events", len(processMonitor.Events))
+			}
+		})
+	}
+}
+
+func TestProcessMonitor_handleRecord_Interleaved(t *testing.T) {
+	processMonitor := &ProcessMonitor{Events: make(map[int]*Event)}
+
+	events := handleRecords(t, processMonitor, `
+		type=SYSCALL msg=audit(1700000000.100:100): arch=c000003e syscall=42 success=yes exit=0 items=0 ppid=10 pid=20 comm="curl" exe="/usr/bin/curl" key="netmon"
+		type=SYSCALL msg=audit(1700000000.100:101): arch=c000003e syscall=42 success=yes exit=0 items=0 ppid=10 pid=21 comm="wget" exe="/usr/bin/wget" key="netmon"
+		type=SOCKADDR msg=audit(1700000000.100:101): saddr=020001BB030303030000000000000000
+		type=SOCKADDR msg=audit(1700000000.100:100): saddr=020001BB020202020000000000000000
+		type=EOE msg=audit(1700000000.100:101): 
+		type=EOE msg=audit(1700000000.100:100): `)
+
+	if len(events) != 2 || events[0].Pid != "21" || events[0].IPAddress != "3.3.3.3" ||
+		events[1].Pid != "20" || events[1].IPAddress != "2.2.2.2" {
+		t.Fatalf("expected events of both sequences, got %+v", events)
+	}
+}
+
+func TestProcessMonitor_handleRecord_MemoryBound(t *testing.T) {
+	processMonitor := &ProcessMonitor{Events: make(map[int]*Event)}
+
+	for sequence := 1; sequence <= 10*maxPendingAuditEvents; sequence++ {
+		processMonitor.handleRecord(sequence, auparse.AUDIT_SYSCALL, map[string]interface{}{"tags": []string{"netmon"}, "syscall": "connect"})
+		processMonitor.handleRecord(sequence, auparse.AUDIT_SOCKADDR, map[string]interface{}{"addr": "2.2.2.2", "port": "443"})
+		// the EOE record of every other event is lost
+		if sequence%2 == 0 {
+			processMonitor.handleRecord(sequence, auparse.AUDIT_EOE, map[string]interface{}{})
+		}
+	}
+
+	if len(processMonitor.Events) > maxPendingAuditEvents {
+		t.Fatalf("expected at most %d pending sequences, got %d", maxPendingAuditEvents, len(processMonitor.Events))
+	}
 }
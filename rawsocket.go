@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// RawSocket is a raw or packet socket opened by a process, it can send any protocol
+// to any destination without connect.
+type RawSocket struct {
+	Family    string    `json:"family"`
+	Type      string    `json:"type"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Pid       string    `json:"pid"`
+	Status    string    `json:"status,omitempty"`
+	TimeStamp time.Time `json:"timestamp"`
+	Tool      Tool      `json:"tool"`
+}
+
+var socketFamilies = map[uint64]string{2: "inet", 10: "inet6", 17: "packet"}
+
+var socketTypes = map[uint64]string{1: "stream", 2: "dgram", 3: "raw", 5: "seqpacket"}
+
+var ipProtocols = map[uint64]string{0: "ip", 1: "icmp", 6: "tcp", 17: "udp", 58: "icmpv6", 255: "raw"}
+
+// describeSocket returns the names of the socket arguments, which audit records in hex.
+// Unknown values are returned as numbers.
+func describeSocket(family, socketType, protocol string) (string, string, string) {
+	name := func(names map[uint64]string, value string, mask uint64) string {
+		number, err := strconv.ParseUint(value, 16, 64)
+		if err != nil {
+			return value
+		}
+		if name, found := names[number&mask]; found {
+			return name
+		}
+		return strconv.FormatUint(number&mask, 10)
+	}
+
+	familyName := name(socketFamilies, family, ^uint64(0))
+	// SOCK_NONBLOCK and SOCK_CLOEXEC are or'ed into the type
+	typeName := name(socketTypes, socketType, 0xf)
+
+	protocolName := ""
+	if familyName == "packet" {
+		// the ethertype, in network byte order
+		if number, err := strconv.ParseUint(protocol, 16, 64); err == nil {
+			protocolName = fmt.Sprintf("%#04x", (number&0xff)<<8|(number>>8)&0xff)
+		}
+	} else {
+		protocolName = name(ipProtocols, protocol, ^uint64(0))
+	}
+
+	return familyName, typeName, protocolName
+}
+
+func (eventHandler *EventHandler) handleRawSocketEvent(event *Event) {
+	family, socketType, protocol := describeSocket(event.SocketFamily, event.SocketType, event.SocketProtocol)
+
+	cacheKey := processCacheKey(event.Pid, family, socketType, protocol)
+
+	eventHandler.netMutex.Lock()
+	_, found := eventHandler.ProcessConnectionMap[cacheKey]
+	if !found {
+		eventHandler.ProcessConnectionMap[cacheKey] = true
+	}
+	eventHandler.netMutex.Unlock()
+
+	if found {
+		return
+	}
+
+	tool, _ := eventHandler.GetTool(event.Pid, event.PPid, event.Exe)
+	rawSocket := &RawSocket{Family: family, Type: socketType, Protocol: protocol, Pid: event.Pid, Status: event.Status,
+		TimeStamp: event.Timestamp, Tool: tool}
+	eventHandler.ApiClient.sendRawSocket(eventHandler.CorrelationId, eventHandler.Repo, rawSocket)
+
+	WriteLog(fmt.Sprintf("raw socket opened family: %s, type: %s, protocol: %s, pid: %s, process: %s, result: %s",
+		family, socketType, protocol, event.Pid, tool.Name, event.Status))
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func Test_describeSocket(t *testing.T) {
+	tests := []struct {
+		name                 string
+		family, typ, proto   string
+		wantFamily, wantType string
+		wantProto            string
+	}{
+		{name: "icmp raw", family: "2", typ: "3", proto: "1", wantFamily: "inet", wantType: "raw", wantProto: "icmp"},
+		{name: "icmpv6 raw with flags", family: "a", typ: "80803", proto: "3a", wantFamily: "inet6", wantType: "raw", wantProto: "icmpv6"},
+		{name: "packet all", family: "11", typ: "3", proto: "300", wantFamily: "packet", wantType: "raw", wantProto: "0x0003"},
+		{name: "packet ipv4", family: "11", typ: "2", proto: "8", wantFamily: "packet", wantType: "dgram", wantProto: "0x0800"},
+		{name: "unknown", family: "26", typ: "3", proto: "ff", wantFamily: "38", wantType: "raw", wantProto: "raw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			family, typ, proto := describeSocket(tt.family, tt.typ, tt.proto)
+			if family != tt.wantFamily || typ != tt.wantType || proto != tt.wantProto {
+				t.Errorf("describeSocket() = %s, %s, %s, want %s, %s, %s", family, typ, proto, tt.wantFamily, tt.wantType, tt.wantProto)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	serverNameSourceSNI  = "sni"
+	serverNameSourceHost = "http_host"
+
+	tlsRecordTypeHandshake   = 0x16
+	tlsHandshakeClientHello  = 0x01
+	tlsExtensionServerName   = 0x0000
+	tlsServerNameTypeHost    = 0x00
+	maxHTTPRequestLineLength = 8192
+)
+
+var httpMethods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "PATCH ", "OPTIONS ", "CONNECT "}
+
+// parseServerName returns the host name a client asked for in the first payload of a TCP flow,
+// from the SNI of a TLS ClientHello or the Host header of a plain HTTP request.
+func parseServerName(payload []byte) (string, string, bool) {
+	if serverName, found := parseTLSServerName(payload); found {
+		return serverName, serverNameSourceSNI, true
+	}
+
+	if host, found := parseHTTPHost(payload); found {
+		return host, serverNameSourceHost, true
+	}
+
+	return "", "", false
+}
+
+// parseTLSServerName reads the server_name extension of a ClientHello.
+// Only ClientHellos that fit in the first packet are parsed.
+func parseTLSServerName(payload []byte) (string, bool) {
+	serverName, _ := parseTLSClientHello(payload)
+	return serverName, serverName != ""
+}
+
+// parseTLSClientHello returns the server name of a ClientHello, or an empty one if it has none.
+// valid is false if the ClientHello is malformed, the server name may be found in a truncated one.
+func parseTLSClientHello(payload []byte) (serverName string, valid bool) {
+	// record header: type(1) version(2) length(2)
+	if len(payload) < 5 || payload[0] != tlsRecordTypeHandshake {
+		return "", false
+	}
+	data := payload[5:]
+
+	// handshake header: type(1) length(3)
+	if len(data) < 4 || data[0] != tlsHandshakeClientHello {
+		return "", false
+	}
+	data = data[4:]
+
+	// client version(2) random(32)
+	if len(data) < 34 {
+		return "", false
+	}
+	data = data[34:]
+
+	// session id, cipher suites and compression methods
+	var ok bool
+	if data, ok = skipVector(data, 1); !ok {
+		return "", false
+	}
+	if data, ok = skipVector(data, 2); !ok {
+		return "", false
+	}
+	if data, ok = skipVector(data, 1); !ok {
+		return "", false
+	}
+
+	if len(data) < 2 {
+		return "", false
+	}
+	extensionsLength := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	truncated := len(data) < extensionsLength
+	if !truncated {
+		data = data[:extensionsLength]
+	}
+
+	for len(data) >= 4 {
+		extensionType := binary.BigEndian.Uint16(data)
+		extensionLength := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+		if len(data) < extensionLength {
+			return "", false
+		}
+		extension := data[:extensionLength]
+		data = data[extensionLength:]
+
+		if extensionType != tlsExtensionServerName {
+			continue
+		}
+
+		// server name list: length(2), then type(1) length(2) name
+		if len(extension) < 2 {
+			return "", false
+		}
+		list := extension[2:]
+		for len(list) >= 3 {
+			nameType := list[0]
+			nameLength := int(binary.BigEndian.Uint16(list[1:]))
+			list = list[3:]
+			if len(list) < nameLength {
+				return "", false
+			}
+			if nameType == tlsServerNameTypeHost && nameLength > 0 {
+				return strings.ToLower(string(list[:nameLength])), true
+			}
+			list = list[nameLength:]
+		}
+		return "", false
+	}
+
+	return "", !truncated && len(data) == 0
+}
+
+// skipVector skips a TLS vector with a length prefix of lengthSize bytes.
+func skipVector(data []byte, lengthSize int) ([]byte, bool) {
+	if len(data) < lengthSize {
+		return nil, false
+	}
+
+	length := 0
+	for i := 0; i < lengthSize; i++ {
+		length = length<<8 | int(data[i])
+	}
+	data = data[lengthSize:]
+	if len(data) < length {
+		return nil, false
+	}
+
+	return data[length:], true
+}
+
+// parseHTTPHost reads the Host header of a plain HTTP request.
+func parseHTTPHost(payload []byte) (string, bool) {
+	isHTTP := false
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(payload, []byte(method)) {
+			isHTTP = true
+			break
+		}
+	}
+	if !isHTTP {
+		return "", false
+	}
+
+	if len(payload) > maxHTTPRequestLineLength {
+		payload = payload[:maxHTTPRequestLineLength]
+	}
+
+	lines := strings.Split(string(payload), "\r\n")
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "host") {
+			continue
+		}
+
+		host := strings.ToLower(strings.TrimSpace(value))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host, host != ""
+	}
+
+	return "", false
+}
+
+// isServerNameMismatch reports whether the host name a client asked for differs from the
+// domain the DNS proxy resolved to the IP address. Either can be wrong for shared CDN addresses,
+// so a mismatch is flagged, not blocked.
+func isServerNameMismatch(serverName, resolvedDomain string) bool {
+	resolvedDomain = strings.ToLower(strings.TrimSuffix(resolvedDomain, "."))
+	if resolvedDomain == "" || net.ParseIP(serverName) != nil {
+		return false
+	}
+
+	return serverName != resolvedDomain
+}
+
+// handleServerName records the host name of a flow seen in its first payload packet.
+func (netMonitor *NetworkMonitor) handleServerName(ipAddress, port string, payload []byte, timestamp time.Time) {
+	serverName, source, found := parseServerName(payload)
+	if !found {
+		return
+	}
+
+	cacheKey := fmt.Sprintf("%s:%s", net.JoinHostPort(ipAddress, port), serverName)
+	if !netMonitor.flows().ShouldReport(cacheKey) {
+		return
+	}
+
+	resolvedDomain := ""
+	if netMonitor.DNSProxy != nil {
+		resolvedDomain = netMonitor.DNSProxy.GetReverseIPLookup(ipAddress)
+	}
+
+	mismatch := isServerNameMismatch(serverName, resolvedDomain)
+
+	netMonitor.sendTelemetry(func() {
+		if mismatch {
+			WriteLog(fmt.Sprintf("server name %s (%s) does not match resolved domain %s for ip address %s", serverName, source, resolvedDomain, ipAddress))
+		}
+		netMonitor.ApiClient.sendServerName(netMonitor.CorrelationId, netMonitor.Repo, ipAddress, port, resolvedDomain,
+			serverName, source, mismatch, netMonitor.Status, timestamp)
+	})
+}
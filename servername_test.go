@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/florianl/go-nflog/v2"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// clientHello returns the ClientHello a TLS client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		client.Close()
+	}()
+
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read ClientHello: %v", err)
+	}
+	return buf[:n]
+}
+
+func Test_parseServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    []byte
+		serverName string
+		source     string
+		found      bool
+	}{
+		{name: "TLS ClientHello", payload: clientHello(t, "GitHub.com"), serverName: "github.com", source: serverNameSourceSNI, found: true},
+		{name: "truncated ClientHello", payload: clientHello(t, "github.com")[:60]},
+		{name: "HTTP request", payload: []byte("GET /index.html HTTP/1.1\r\nUser-Agent: curl\r\nHost: Example.com:8080\r\n\r\n"), serverName: "example.com", source: serverNameSourceHost, found: true},
+		{name: "HTTP request without host", payload: []byte("GET / HTTP/1.0\r\n\r\nHost: example.com\r\n")},
+		{name: "other protocol", payload: []byte("SSH-2.0-OpenSSH_8.9\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverName, source, found := parseServerName(tt.payload)
+			if serverName != tt.serverName || source != tt.source || found != tt.found {
+				t.Errorf("parseServerName() = %s, %s, %v, want %s, %s, %v", serverName, source, found, tt.serverName, tt.source, tt.found)
+			}
+		})
+	}
+}
+
+func Test_parseTLSClientHello(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    []byte
+		serverName string
+		valid      bool
+	}{
+		{name: "with server name", payload: clientHello(t, "github.com"), serverName: "github.com", valid: true},
+		{name: "without server name", payload: clientHello(t, "140.82.112.3"), valid: true},
+		{name: "truncated", payload: clientHello(t, "140.82.112.3")[:100]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if serverName, valid := parseTLSClientHello(tt.payload); serverName != tt.serverName || valid != tt.valid {
+				t.Errorf("parseTLSClientHello() = %s, %v, want %s, %v", serverName, valid, tt.serverName, tt.valid)
+			}
+		})
+	}
+}
+
+func Test_isServerNameMismatch(t *testing.T) {
+	tests := []struct {
+		serverName     string
+		resolvedDomain string
+		want           bool
+	}{
+		{serverName: "github.com", resolvedDomain: "github.com.", want: false},
+		{serverName: "evil.example.com", resolvedDomain: "github.com.", want: true},
+		{serverName: "github.com", resolvedDomain: "", want: false},
+		{serverName: "1.2.3.4", resolvedDomain: "github.com.", want: false},
+	}
+	for _, tt := range tests {
+		if got := isServerNameMismatch(tt.serverName, tt.resolvedDomain); got != tt.want {
+			t.Errorf("isServerNameMismatch(%s, %s) = %v, want %v", tt.serverName, tt.resolvedDomain, got, tt.want)
+		}
+	}
+}
+
+func TestNetworkMonitor_handlePacket_ServerName(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+	fileSink, err := NewFileTelemetrySink(filePath)
+	if err != nil {
+		t.Fatalf("NewFileTelemetrySink() error = %v", err)
+	}
+	apiclient := &ApiClient{Client: &http.Client{}, Sinks: []TelemetrySink{fileSink}}
+	dnsProxy := &DNSProxy{ReverseIPLookup: make(map[string]string)}
+	dnsProxy.SetReverseIPLookup("github.com.", "4.3.2.1")
+	netMonitor := &NetworkMonitor{CorrelationId: "123", Repo: "owner/repo", ApiClient: apiclient, DNSProxy: dnsProxy, Status: "Allowed"}
+
+	ipv4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.1.0.4"), DstIP: net.ParseIP("4.3.2.1")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, ACK: true, PSH: true}
+	tcp.SetNetworkLayerForChecksum(ipv4)
+	payload := serializePacket(t, ipv4, tcp, gopacket.Payload(clientHello(t, "evil.example.com")))
+
+	netMonitor.handlePacket(nflog.Attribute{Payload: &payload})
+	apiclient.closeTelemetrySinks()
+
+	data, _ := os.ReadFile(filePath)
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 network connection, got %d", len(lines))
+	}
+
+	var event struct {
+		Data NetworkConnection `json:"data"`
+	}
+	json.Unmarshal(lines[0], &event)
+	if event.Data.ServerName != "evil.example.com" || event.Data.ServerNameSource != serverNameSourceSNI ||
+		event.Data.DomainName != "github.com." || !event.Data.DomainMismatch {
+		t.Fatalf("unexpected network connection %+v", event.Data)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+)
+
+const (
+	// set by the verdict on a ClientHello that is not allowed, and saved to the connection,
+	// so the firewall drops the rest of the flow
+	sniDeniedMark = 0x10000000
+	// set by the verdict on a ClientHello that is allowed, and saved to the connection,
+	// so the rest of the flow is not queued
+	sniAllowedMark = 0x20000000
+
+	maxPendingClientHellos = 1024
+	// ClientHellos that take more segments or bytes are dropped
+	maxClientHelloSegments = 32
+	maxClientHelloSize     = 32 << 10
+	// pending ClientHellos older than this are dropped when there are too many
+	pendingClientHelloTimeout = 10 * time.Second
+)
+
+// pendingClientHello is the start of a ClientHello that did not fit in one packet.
+type pendingClientHello struct {
+	data     []byte
+	nextSeq  uint32
+	segments int
+	started  time.Time
+}
+
+// SNIGuard enforces the allowed endpoints on the TLS server name of new flows in block mode,
+// so an allowed IP address, e.g. of a CDN, cannot be used to reach other domains behind it.
+// Flows whose ClientHello cannot be inspected are dropped.
+type SNIGuard struct {
+	CorrelationId string
+	Repo          string
+	ApiClient     *ApiClient
+	DNSProxy      *DNSProxy
+	pending       map[string]*pendingClientHello
+	annotated     sync.Map
+}
+
+// Start inspects packets from the SNI queue until ctx is done.
+func (guard *SNIGuard) Start(ctx context.Context, queuer AgentNfQueuer) error {
+	queue, err := queuer.Open(sniQueueNum)
+	if err != nil {
+		return err
+	}
+
+	if err := queue.Register(ctx, guard.verdict); err != nil {
+		queue.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		queue.Close()
+	}()
+
+	return nil
+}
+
+// reassembleClientHello returns the ClientHello at the start of a flow as a single TLS record, it may be
+// fragmented into several records. complete is false if more data is needed, valid is false if data does
+// not start with a ClientHello or it is larger than maxClientHelloSize.
+func reassembleClientHello(data []byte) (hello []byte, complete bool, valid bool) {
+	var message []byte
+	for len(data) > 0 {
+		if data[0] != tlsRecordTypeHandshake {
+			return nil, false, false
+		}
+		// record header: type(1) version(2) length(2)
+		if len(data) < 5 {
+			return nil, false, true
+		}
+		recordLength := int(binary.BigEndian.Uint16(data[3:]))
+		if recordLength == 0 || recordLength > maxClientHelloSize {
+			return nil, false, false
+		}
+		if len(data) < 5+recordLength {
+			return nil, false, true
+		}
+		message = append(message, data[5:5+recordLength]...)
+		data = data[5+recordLength:]
+
+		// handshake header: type(1) length(3)
+		if len(message) < 4 {
+			continue
+		}
+		messageLength := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+		if message[0] != tlsHandshakeClientHello || 4+messageLength > maxClientHelloSize {
+			return nil, false, false
+		}
+		if len(message) >= 4+messageLength {
+			hello = []byte{tlsRecordTypeHandshake, 0x03, 0x01, 0, 0}
+			binary.BigEndian.PutUint16(hello[3:], uint16(4+messageLength))
+			return append(hello, message[:4+messageLength]...), true, true
+		}
+	}
+
+	return nil, false, true
+}
+
+// addPending saves the start of a ClientHello. If there are too many, the ones that were never
+// completed are dropped, and their flows with them.
+func (guard *SNIGuard) addPending(flowKey string, pending *pendingClientHello) {
+	if guard.pending == nil {
+		guard.pending = make(map[string]*pendingClientHello)
+	}
+
+	if len(guard.pending) >= maxPendingClientHellos {
+		for key, old := range guard.pending {
+			if time.Since(old.started) > pendingClientHelloTimeout {
+				delete(guard.pending, key)
+			}
+		}
+	}
+	if len(guard.pending) >= maxPendingClientHellos {
+		guard.pending = make(map[string]*pendingClientHello)
+	}
+
+	guard.pending[flowKey] = pending
+}
+
+func (guard *SNIGuard) isAllowed(serverName string) bool {
+	if guard.DNSProxy.isAllowedDomain(serverName) {
+		return true
+	}
+
+	matches, _ := guard.DNSProxy.matchAnyWildcard(dns.Fqdn(serverName))
+	return matches
+}
+
+// verdict is called for the payload packets of outbound TLS flows until the flow is allowed or denied.
+// Packets are handled one at a time, in the order they were queued. The segments of a ClientHello are
+// accepted until it is complete; flows that do not start with a ClientHello, or whose ClientHello
+// cannot be parsed, are denied.
+func (guard *SNIGuard) verdict(queued NfQueuePacket) NfQueueVerdict {
+	accept := NfQueueVerdict{Verdict: nfAccept}
+
+	hwProtocol := queued.HwProtocol
+	packet := gopacket.NewPacket(queued.Payload, ipLayerType(&hwProtocol, queued.Payload), gopacket.Default)
+	tcpLayer := packet.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil || packet.NetworkLayer() == nil {
+		return NfQueueVerdict{Verdict: nfDrop}
+	}
+	tcp, _ := tcpLayer.(*layers.TCP)
+	if len(tcp.Payload) == 0 {
+		// the handshake and ACKs
+		return accept
+	}
+
+	flow := packet.NetworkLayer().NetworkFlow()
+	flowKey := fmt.Sprintf("%s %s", flow.String(), tcp.TransportFlow().String())
+	ipAddress := flow.Dst().String()
+	port := tcp.DstPort.String()
+
+	pending, found := guard.pending[flowKey]
+	if !found {
+		pending = &pendingClientHello{nextSeq: tcp.Seq, started: time.Now()}
+	} else if tcp.Seq != pending.nextSeq {
+		// a retransmission of a segment that was accepted, or a segment after a gap which the client resends
+		if int32(pending.nextSeq-(tcp.Seq+uint32(len(tcp.Payload)))) >= 0 {
+			return accept
+		}
+		return NfQueueVerdict{Verdict: nfDrop}
+	}
+
+	pending.data = append(pending.data, tcp.Payload...)
+	pending.nextSeq += uint32(len(tcp.Payload))
+	pending.segments++
+
+	hello, complete, valid := reassembleClientHello(pending.data)
+	if valid && !complete {
+		if pending.segments >= maxClientHelloSegments {
+			delete(guard.pending, flowKey)
+			return guard.deny(ipAddress, port, "", "ClientHello is split into too many segments")
+		}
+		// the rest of the ClientHello is in the next packets, which are queued as well
+		guard.addPending(flowKey, pending)
+		return accept
+	}
+	delete(guard.pending, flowKey)
+
+	if !valid {
+		return guard.deny(ipAddress, port, "", "flow does not start with a ClientHello")
+	}
+
+	serverName, valid := parseTLSClientHello(hello)
+	if !valid {
+		return guard.deny(ipAddress, port, "", "ClientHello could not be parsed")
+	}
+	// without a server name only the IP address based rules apply
+	if serverName == "" || guard.isAllowed(serverName) {
+		return NfQueueVerdict{Verdict: nfRepeat, Mark: sniAllowedMark}
+	}
+
+	return guard.deny(ipAddress, port, serverName, "")
+}
+
+// deny reports a flow to a server name that is not allowed, or whose ClientHello could not be inspected for reason.
+func (guard *SNIGuard) deny(ipAddress, port, serverName, reason string) NfQueueVerdict {
+	if serverName == "" {
+		go WriteLog(fmt.Sprintf("tls connection dropped: %s, ip address %s", reason, ipAddress))
+
+		if _, annotated := guard.annotated.LoadOrStore(ipAddress, true); !annotated {
+			go WriteAnnotation(fmt.Sprintf("%s Traffic to IP Address %s was blocked. Its TLS server name could not be inspected.",
+				StepSecurityAnnotationPrefix, ipAddress))
+		}
+	} else {
+		go WriteLog(fmt.Sprintf("tls connection dropped: server name %s is not allowed, ip address %s", serverName, ipAddress))
+
+		if _, annotated := guard.annotated.LoadOrStore(serverName, true); !annotated {
+			go WriteAnnotation(fmt.Sprintf("%s Traffic to %s at IP Address %s was blocked. This domain is not in the list of allowed-endpoints.",
+				StepSecurityAnnotationPrefix, strings.TrimSuffix(serverName, "."), ipAddress))
+		}
+
+		resolvedDomain := guard.DNSProxy.GetReverseIPLookup(ipAddress)
+		go guard.ApiClient.sendServerName(guard.CorrelationId, guard.Repo, ipAddress, port, resolvedDomain,
+			serverName, serverNameSourceSNI, isServerNameMismatch(serverName, resolvedDomain), "Dropped", time.Now().UTC())
+	}
+
+	// repeat the packet with the mark, so the firewall marks the connection and drops it
+	return NfQueueVerdict{Verdict: nfRepeat, Mark: sniDeniedMark}
+}
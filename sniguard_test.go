@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func queuedTLSPacket(t *testing.T, seq uint32, payload []byte) NfQueuePacket {
+	ipv4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.1.0.4"), DstIP: net.ParseIP("151.101.1.1")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: seq, ACK: true, PSH: true}
+	tcp.SetNetworkLayerForChecksum(ipv4)
+
+	return NfQueuePacket{ID: 1, HwProtocol: uint16(layers.EthernetTypeIPv4), Payload: serializePacket(t, ipv4, tcp, gopacket.Payload(payload))}
+}
+
+func queuedTLSPacketIPv6(t *testing.T, seq uint32, payload []byte) NfQueuePacket {
+	ipv6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("fd00::4"), DstIP: net.ParseIP("2a04:4e42::223")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: seq, ACK: true, PSH: true}
+	tcp.SetNetworkLayerForChecksum(ipv6)
+
+	return NfQueuePacket{ID: 1, HwProtocol: uint16(layers.EthernetTypeIPv6), Payload: serializePacket(t, ipv6, tcp, gopacket.Payload(payload))}
+}
+
+// fragmentClientHello splits the handshake message of a ClientHello into TLS records of up to size bytes.
+func fragmentClientHello(hello []byte, size int) []byte {
+	var records []byte
+	for message := hello[5:]; len(message) > 0; {
+		fragment := message[:min(size, len(message))]
+		message = message[len(fragment):]
+		records = append(records, tlsRecordTypeHandshake, 0x03, 0x01, byte(len(fragment)>>8), byte(len(fragment)))
+		records = append(records, fragment...)
+	}
+	return records
+}
+
+func newTestSNIGuard() *SNIGuard {
+	dnsProxy := &DNSProxy{
+		AllowedEndpoints:  map[string][]Endpoint{"pypi.org.": {{domainName: "pypi.org.", port: 443}}},
+		WildCardEndpoints: map[string][]Endpoint{"*.githubusercontent.com.": {{domainName: "*.githubusercontent.com.", port: 443}}},
+		ReverseIPLookup:   make(map[string]string),
+	}
+	return &SNIGuard{CorrelationId: "123", Repo: "owner/repo", ApiClient: &ApiClient{Client: &http.Client{}, DisableTelemetry: true}, DNSProxy: dnsProxy}
+}
+
+func TestSNIGuard_verdict(t *testing.T) {
+	guard := newTestSNIGuard()
+
+	denied := NfQueueVerdict{Verdict: nfRepeat, Mark: sniDeniedMark}
+	allowed := NfQueueVerdict{Verdict: nfRepeat, Mark: sniAllowedMark}
+
+	malformed := clientHello(t, "pypi.org")
+	malformed[5+4+34] = 0xff // length of the session id
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    NfQueueVerdict
+	}{
+		{name: "allowed domain", payload: clientHello(t, "pypi.org"), want: allowed},
+		{name: "allowed wildcard domain", payload: clientHello(t, "raw.githubusercontent.com"), want: allowed},
+		{name: "domain fronting", payload: clientHello(t, "attacker.example.com"), want: denied},
+		{name: "without server name", payload: clientHello(t, "151.101.1.1"), want: allowed},
+		{name: "malformed ClientHello", payload: malformed, want: denied},
+		{name: "not tls", payload: []byte("GET / HTTP/1.1\r\nHost: attacker.example.com\r\n\r\n"), want: denied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := guard.verdict(queuedTLSPacket(t, 1000, tt.payload)); got != tt.want {
+				t.Errorf("verdict() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSNIGuard_verdict_SplitClientHello(t *testing.T) {
+	hello := clientHello(t, "attacker.example.com")
+
+	tests := []struct {
+		name     string
+		segments [][]byte
+		queue    func(t *testing.T, seq uint32, payload []byte) NfQueuePacket
+	}{
+		{name: "two segments", segments: [][]byte{hello[:20], hello[20:]}},
+		{name: "one byte first segment", segments: [][]byte{hello[:1], hello[1:]}},
+		{name: "three segments", segments: [][]byte{hello[:3], hello[3:100], hello[100:]}},
+		{name: "several records", segments: func() [][]byte {
+			records := fragmentClientHello(hello, 64)
+			return [][]byte{records[:150], records[150:]}
+		}()},
+		{name: "IPv6", segments: [][]byte{hello[:20], hello[20:]}, queue: queuedTLSPacketIPv6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := newTestSNIGuard()
+			queue := tt.queue
+			if queue == nil {
+				queue = queuedTLSPacket
+			}
+
+			seq := uint32(1000)
+			for i, segment := range tt.segments {
+				got := guard.verdict(queue(t, seq, segment))
+				seq += uint32(len(segment))
+
+				if i < len(tt.segments)-1 {
+					if got.Verdict != nfAccept {
+						t.Fatalf("expected segment %d to be accepted, got %+v", i, got)
+					}
+					continue
+				}
+				if got.Verdict != nfRepeat || got.Mark != sniDeniedMark {
+					t.Fatalf("expected reassembled ClientHello to be denied, got %+v", got)
+				}
+			}
+
+			if len(guard.pending) != 0 {
+				t.Fatalf("expected pending ClientHello to be removed")
+			}
+		})
+	}
+}
+
+func TestSNIGuard_verdict_PendingClientHello(t *testing.T) {
+	hello := clientHello(t, "pypi.org")
+
+	t.Run("retransmission", func(t *testing.T) {
+		guard := newTestSNIGuard()
+		guard.verdict(queuedTLSPacket(t, 1000, hello[:20]))
+
+		if got := guard.verdict(queuedTLSPacket(t, 1000, hello[:20])); got.Verdict != nfAccept {
+			t.Fatalf("expected retransmission to be accepted, got %+v", got)
+		}
+		if got := guard.verdict(queuedTLSPacket(t, 1100, hello[100:])); got.Verdict != nfDrop {
+			t.Fatalf("expected segment after a gap to be dropped, got %+v", got)
+		}
+		if got := guard.verdict(queuedTLSPacket(t, 1020, hello[20:])); got.Verdict != nfRepeat || got.Mark != sniAllowedMark {
+			t.Fatalf("expected reassembled ClientHello to be allowed, got %+v", got)
+		}
+	})
+
+	t.Run("too many segments", func(t *testing.T) {
+		guard := newTestSNIGuard()
+		var got NfQueueVerdict
+		for i := 0; i < maxClientHelloSegments; i++ {
+			got = guard.verdict(queuedTLSPacket(t, 1000+uint32(i), hello[i:i+1]))
+		}
+		if got.Verdict != nfRepeat || got.Mark != sniDeniedMark {
+			t.Fatalf("expected ClientHello to be denied, got %+v", got)
+		}
+	})
+
+	t.Run("continuation without ClientHello", func(t *testing.T) {
+		guard := newTestSNIGuard()
+		if got := guard.verdict(queuedTLSPacket(t, 1020, hello[20:])); got.Verdict != nfRepeat || got.Mark != sniDeniedMark {
+			t.Fatalf("expected segment without pending ClientHello to be denied, got %+v", got)
+		}
+	})
+}
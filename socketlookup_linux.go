@@ -0,0 +1,203 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// procRoot is where proc is mounted, changed in tests
+var procRoot = "/proc"
+
+// findSocketInode returns the inode of the local socket that sent a packet from srcPort to dstIP:dstPort.
+// IPv4 connections of dual stack sockets are listed in the IPv6 tables, so both are searched.
+// Unconnected UDP sockets have no remote address and are matched on the local port.
+func findSocketInode(protocol string, srcPort uint16, dstIP net.IP, dstPort uint16) (uint64, error) {
+	for _, table := range []string{protocol, protocol + "6"} {
+		inode, err := findSocketInodeInTable(filepath.Join(procRoot, "net", table), protocol, srcPort, dstIP, dstPort)
+		if err == nil && inode != 0 {
+			return inode, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no %s socket found for local port %d", protocol, srcPort)
+}
+
+func findSocketInodeInTable(tablePath, protocol string, srcPort uint16, dstIP net.IP, dstPort uint16) (uint64, error) {
+	f, err := os.Open(tablePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		_, localPort, err := parseProcNetAddress(fields[1])
+		if err != nil || localPort != srcPort {
+			continue
+		}
+
+		remoteIP, remotePort, err := parseProcNetAddress(fields[2])
+		if err != nil {
+			continue
+		}
+
+		unconnected := protocol == udp && remotePort == 0
+		if !unconnected && (remotePort != dstPort || !remoteIP.Equal(dstIP)) {
+			continue
+		}
+
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || inode == 0 {
+			continue
+		}
+		return inode, nil
+	}
+
+	return 0, scanner.Err()
+}
+
+// parseProcNetAddress parses an address of /proc/net/{tcp,udp}[6], the IP address is
+// in 32 bit words in host byte order, the port in hex.
+func parseProcNetAddress(address string) (net.IP, uint16, error) {
+	ipHex, portHex, found := strings.Cut(address, ":")
+	if !found {
+		return nil, 0, fmt.Errorf("invalid address %s", address)
+	}
+
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	raw, err := hex.DecodeString(ipHex)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %s", address)
+	}
+
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(raw[i:]))
+	}
+
+	return ip, uint16(port), nil
+}
+
+// socketOwnerCache maps socket inodes to the processes that have them open, from one scan of /proc/*/fd.
+// A burst of packets, e.g. a port scan, is resolved from the cache instead of a scan per packet.
+type socketOwnerCache struct {
+	pids      map[uint64]string
+	scannedAt time.Time
+	mutex     sync.Mutex
+}
+
+const (
+	// how long a scan is used, like the reports of the flows the sockets are looked up for
+	socketOwnersMaxAge = defaultFlowCacheWindow
+	// sockets opened after the scan are found by scanning again, at most this often
+	socketOwnersRescanInterval = time.Second
+)
+
+var socketOwners = &socketOwnerCache{}
+
+// findPidBySocketInode returns the process that has the socket open.
+func findPidBySocketInode(inode uint64) (string, error) {
+	socketOwners.mutex.Lock()
+	defer socketOwners.mutex.Unlock()
+
+	age := time.Since(socketOwners.scannedAt)
+	pid, found := socketOwners.pids[inode]
+	if (!found && age >= socketOwnersRescanInterval) || age >= socketOwnersMaxAge {
+		pids, err := scanSocketOwners()
+		if err != nil {
+			return "", err
+		}
+		socketOwners.pids, socketOwners.scannedAt = pids, time.Now()
+		pid, found = pids[inode]
+	}
+
+	if !found {
+		return "", fmt.Errorf("no process found for socket %d", inode)
+	}
+	return pid, nil
+}
+
+// scanSocketOwners returns the process of each socket inode that is open.
+func scanSocketOwners() (map[uint64]string, error) {
+	pids, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[uint64]string)
+	for _, pid := range pids {
+		if _, err := strconv.Atoi(pid.Name()); err != nil {
+			continue
+		}
+
+		fdDir := filepath.Join(procRoot, pid.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if _, found := owners[inode]; !found {
+				owners[inode] = pid.Name()
+			}
+		}
+	}
+
+	return owners, nil
+}
+
+// findProcessBySocket returns the pid, parent pid and executable of the process that sent a packet.
+func findProcessBySocket(protocol string, srcPort uint16, dstIP net.IP, dstPort uint16) (string, string, string, error) {
+	inode, err := findSocketInode(protocol, srcPort, dstIP, dstPort)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	pid, err := findPidBySocketInode(inode)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	exe, err := getProcessExe(pid)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	ppid, err := getParentProcessId(pid)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return pid, strconv.Itoa(ppid), exe, nil
+}
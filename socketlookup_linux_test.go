@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func Test_parseProcNetAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		ip      string
+		port    uint16
+	}{
+		{address: "0100007F:1F90", ip: "127.0.0.1", port: 8080},
+		{address: "0000000000000000FFFF00000100007F:0035", ip: "127.0.0.1", port: 53},
+		{address: "B80D0120000000000000000001000000:01BB", ip: "2001:db8::1", port: 443},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			ip, port, err := parseProcNetAddress(tt.address)
+			if err != nil || !ip.Equal(net.ParseIP(tt.ip)) || port != tt.port {
+				t.Errorf("parseProcNetAddress() = %v, %d, %v, want %s, %d", ip, port, err, tt.ip, tt.port)
+			}
+		})
+	}
+}
+
+func Test_findProcessBySocket(t *testing.T) {
+	// the socket is opened after scans of other tests
+	previousOwners := socketOwners
+	socketOwners = &socketOwnerCache{}
+	defer func() { socketOwners = previousOwners }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+
+	pid, _, exe, err := findProcessBySocket(tcp, uint16(local.Port), remote.IP, uint16(remote.Port))
+	if err != nil {
+		t.Fatalf("findProcessBySocket() error = %v", err)
+	}
+
+	selfExe, _ := os.Executable()
+	if pid != strconv.Itoa(os.Getpid()) || filepath.Base(exe) != filepath.Base(selfExe) {
+		t.Fatalf("findProcessBySocket() = %s, %s, want %d, %s", pid, exe, os.Getpid(), selfExe)
+	}
+
+	if _, _, _, err := findProcessBySocket(udp, uint16(local.Port), remote.IP, uint16(remote.Port)); err == nil {
+		t.Fatalf("expected no udp socket for the tcp port")
+	}
+}
+
+func Test_findPidBySocketInode_Cached(t *testing.T) {
+	previousRoot, previousOwners := procRoot, socketOwners
+	defer func() { procRoot, socketOwners = previousRoot, previousOwners }()
+
+	procRoot = t.TempDir()
+	socketOwners = &socketOwnerCache{}
+	fdDir := filepath.Join(procRoot, "1234", "fd")
+	if err := os.MkdirAll(fdDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("socket:[42]", filepath.Join(fdDir, "3")); err != nil {
+		t.Fatal(err)
+	}
+
+	if pid, err := findPidBySocketInode(42); err != nil || pid != "1234" {
+		t.Fatalf("findPidBySocketInode() = %s, %v, want 1234", pid, err)
+	}
+
+	// found from the scan, /proc is not read again
+	os.RemoveAll(filepath.Join(procRoot, "1234"))
+	if pid, err := findPidBySocketInode(42); err != nil || pid != "1234" {
+		t.Fatalf("findPidBySocketInode() = %s, %v, want the cached 1234", pid, err)
+	}
+
+	// a socket opened after the scan is found once the rescan interval passed
+	if err := os.MkdirAll(filepath.Join(procRoot, "5678", "fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink("socket:[43]", filepath.Join(procRoot, "5678", "fd", "3"))
+	if _, err := findPidBySocketInode(43); err == nil {
+		t.Fatalf("expected no rescan within the rescan interval")
+	}
+	socketOwners.scannedAt = socketOwners.scannedAt.Add(-socketOwnersRescanInterval)
+	if pid, err := findPidBySocketInode(43); err != nil || pid != "5678" {
+		t.Fatalf("findPidBySocketInode() = %s, %v, want 5678", pid, err)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	TelemetrySinkAPI     = "api"
+	TelemetrySinkFile    = "file"
+	TelemetrySinkSyslog  = "syslog"
+	TelemetrySinkWebhook = "webhook"
+
+	telemetryTypeDNS               = "dns"
+	telemetryTypeNetworkConnection = "networkconnection"
+	telemetryTypeRawSocket         = "rawsocket"
+
+	defaultTelemetryFilePath = "/home/agent/telemetry.jsonl"
+	defaultSyslogTag         = "stepsecurity-agent"
+)
+
+// localTelemetryTypes have no StepSecurity API endpoint yet. They only go to the file, syslog and webhook sinks
+// and are not linked into the telemetry chain, so the API sees no gaps in it.
+var localTelemetryTypes = map[string]bool{
+	telemetryTypeEgressSummary: true,
+	telemetryTypeRawSocket:     true,
+}
+
+// TelemetryEvent is a single DNS record or network connection along with the job it belongs to.
+// Type matches the path segment used by the StepSecurity API for that kind of record.
+// Chain links the event to the previous one, computed over the event marshaled without Chain.
+type TelemetryEvent struct {
+	Type          string      `json:"type"`
+	CorrelationId string      `json:"correlation_id"`
+	Repo          string      `json:"repo"`
+	Data          interface{} `json:"data"`
+	Chain         *ChainLink  `json:"chain,omitempty"`
+}
+
+// TelemetrySink is a destination for DNS and network connection records.
+type TelemetrySink interface {
+	Name() string
+	Send(event *TelemetryEvent) error
+	Close() error
+}
+
+// TelemetrySinkConfig is one entry of telemetry_sinks in agent.json.
+type TelemetrySinkConfig struct {
+	Type    string            `json:"type"`
+	Path    string            `json:"path,omitempty"`    // file
+	Network string            `json:"network,omitempty"` // syslog, empty for the local daemon
+	Address string            `json:"address,omitempty"` // syslog
+	Tag     string            `json:"tag,omitempty"`     // syslog
+	URL     string            `json:"url,omitempty"`     // webhook
+	Headers map[string]string `json:"headers,omitempty"` // webhook
+}
+
+// String redacts webhook header values, since the config is written to agent.log
+func (c TelemetrySinkConfig) String() string {
+	headers := make([]string, 0, len(c.Headers))
+	for key := range c.Headers {
+		headers = append(headers, key)
+	}
+	return fmt.Sprintf("{Type:%s Path:%s Network:%s Address:%s Tag:%s URL:%s Headers:%v}", c.Type, c.Path, c.Network, c.Address, c.Tag, c.URL, headers)
+}
+
+// newTelemetrySinks builds the sinks declared in agent.json.
+// If none are declared, telemetry goes to the StepSecurity API only.
+func newTelemetrySinks(configs []TelemetrySinkConfig, apiclient *ApiClient) ([]TelemetrySink, error) {
+	if len(configs) == 0 {
+		return []TelemetrySink{&ApiTelemetrySink{ApiClient: apiclient}}, nil
+	}
+
+	sinks := []TelemetrySink{}
+	var errs []string
+	for _, sinkConfig := range configs {
+		sink, err := newTelemetrySink(sinkConfig, apiclient)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if len(errs) > 0 {
+		return sinks, fmt.Errorf("failed to create telemetry sinks: %v", errs)
+	}
+
+	return sinks, nil
+}
+
+func newTelemetrySink(sinkConfig TelemetrySinkConfig, apiclient *ApiClient) (TelemetrySink, error) {
+	switch sinkConfig.Type {
+	case TelemetrySinkAPI:
+		return &ApiTelemetrySink{ApiClient: apiclient}, nil
+	case TelemetrySinkFile:
+		return NewFileTelemetrySink(sinkConfig.Path)
+	case TelemetrySinkSyslog:
+		return NewSyslogTelemetrySink(sinkConfig.Network, sinkConfig.Address, sinkConfig.Tag)
+	case TelemetrySinkWebhook:
+		return NewWebhookTelemetrySink(sinkConfig.URL, sinkConfig.Headers, apiclient.Client)
+	default:
+		return nil, fmt.Errorf("unknown telemetry sink type: %s", sinkConfig.Type)
+	}
+}
+
+// telemetrySinkEndpoints returns the remote endpoints the sinks send to, by domain name and by IP address,
+// so they can be allowed through the firewall in block mode. IPv6 addresses are left out, the block rules are IPv4 only.
+func telemetrySinkEndpoints(configs []TelemetrySinkConfig) ([]Endpoint, []ipAddressEndpoint) {
+	endpoints := []Endpoint{}
+	ipAddressEndpoints := []ipAddressEndpoint{}
+	add := func(host string, port int) {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.To4() != nil {
+				ipAddressEndpoints = append(ipAddressEndpoints, ipAddressEndpoint{ipAddress: ip.String(), port: strconv.Itoa(port)})
+			}
+			return
+		}
+		endpoints = append(endpoints, Endpoint{domainName: dns.Fqdn(host), port: port})
+	}
+
+	for _, sinkConfig := range configs {
+		switch sinkConfig.Type {
+		case TelemetrySinkWebhook:
+			u, err := url.Parse(sinkConfig.URL)
+			if err != nil || u.Hostname() == "" {
+				continue
+			}
+			port := 443
+			if u.Port() != "" {
+				port, _ = strconv.Atoi(u.Port())
+			} else if u.Scheme == "http" {
+				port = 80
+			}
+			add(u.Hostname(), port)
+		case TelemetrySinkSyslog:
+			if sinkConfig.Network != "tcp" || sinkConfig.Address == "" {
+				continue
+			}
+			host, portStr, err := net.SplitHostPort(sinkConfig.Address)
+			if err != nil {
+				continue
+			}
+			port, _ := strconv.Atoi(portStr)
+			add(host, port)
+		}
+	}
+
+	return endpoints, ipAddressEndpoints
+}
+
+// ApiTelemetrySink sends events to the StepSecurity API.
+type ApiTelemetrySink struct {
+	ApiClient *ApiClient
+}
+
+func (sink *ApiTelemetrySink) Name() string {
+	return TelemetrySinkAPI
+}
+
+func (sink *ApiTelemetrySink) disabled() bool {
+	apiclient := sink.ApiClient
+	return apiclient.DisableTelemetry && apiclient.EgressPolicy != EgressPolicyAudit
+}
+
+func (sink *ApiTelemetrySink) url(event *TelemetryEvent) string {
+	return fmt.Sprintf("%s/github/%s/actions/jobs/%s/%s", sink.ApiClient.TelemetryURL, event.Repo, event.CorrelationId, event.Type)
+}
+
+// Send posts the event to the API endpoint of its type, signed with the telemetry chain. The chain link
+// of the event is sent as headers.
+// Retries are left to the TelemetryPipeline, which backs off between attempts.
+func (sink *ApiTelemetrySink) Send(event *TelemetryEvent) error {
+	if sink.disabled() || localTelemetryTypes[event.Type] {
+		return nil
+	}
+
+	jsonData, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", sink.url(event), bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+
+	if event.Chain != nil {
+		req.Header.Add("x-telemetry-chain-seq", strconv.FormatUint(event.Chain.Seq, 10))
+		req.Header.Add("x-telemetry-chain-prev-hash", event.Chain.PrevHash)
+		req.Header.Add("x-telemetry-chain-hash", event.Chain.Hash)
+		req.Header.Add("x-telemetry-chain-signature", event.Chain.Signature)
+	}
+
+	return sink.post(req, jsonData)
+}
+
+// SendBatch posts each run of events of the same job and type as one gzip compressed JSON array
+// to the API endpoint of their type. The events carry their chain links.
+// It returns how many events from the start of the batch were delivered.
+func (sink *ApiTelemetrySink) SendBatch(events []*TelemetryEvent) (int, error) {
+	if sink.disabled() {
+		return len(events), nil
+	}
+
+	delivered := 0
+	for delivered < len(events) {
+		first := events[delivered]
+		end := delivered + 1
+		for end < len(events) && events[end].Repo == first.Repo && events[end].CorrelationId == first.CorrelationId &&
+			events[end].Type == first.Type {
+			end++
+		}
+		if localTelemetryTypes[first.Type] {
+			delivered = end
+			continue
+		}
+
+		jsonData, err := json.Marshal(events[delivered:end])
+		if err != nil {
+			return delivered, err
+		}
+
+		var body bytes.Buffer
+		gz := gzip.NewWriter(&body)
+		if _, err := gz.Write(jsonData); err != nil {
+			return delivered, err
+		}
+		if err := gz.Close(); err != nil {
+			return delivered, err
+		}
+
+		req, err := http.NewRequest("POST", sink.url(first), &body)
+		if err != nil {
+			return delivered, err
+		}
+		req.Header.Add("Content-Encoding", "gzip")
+
+		if err := sink.post(req, jsonData); err != nil {
+			return delivered, err
+		}
+		delivered = end
+	}
+
+	return delivered, nil
+}
+
+// post sends a telemetry request whose uncompressed body is jsonData. The drops not reported yet
+// are sent as a header and forgotten once the API accepted them.
+func (sink *ApiTelemetrySink) post(req *http.Request, jsonData []byte) error {
+	apiclient := sink.ApiClient
+
+	req.Header.Add("x-one-time-key", apiclient.OneTimeKey)
+	req.Header.Add("Content-Type", "application/json; charset=UTF-8")
+	if apiclient.Chain != nil {
+		req.Header.Add("x-telemetry-signature", apiclient.Chain.Sign(jsonData))
+		if head := logChainHead(); head != "" {
+			req.Header.Add("x-log-chain-head", head)
+		}
+	}
+	drops := apiclient.pendingTelemetryDrops()
+	if len(drops) > 0 {
+		dropsData, err := json.Marshal(drops)
+		if err != nil {
+			return err
+		}
+		req.Header.Add("x-telemetry-drops", string(dropsData))
+	}
+
+	resp, err := apiclient.sendHttpRequest(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	apiclient.reportedTelemetryDrops(drops)
+	return nil
+}
+
+func (sink *ApiTelemetrySink) Close() error {
+	return nil
+}
+
+// FileTelemetrySink appends each event as a JSON line to a local file.
+type FileTelemetrySink struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func NewFileTelemetrySink(filePath string) (*FileTelemetrySink, error) {
+	if filePath == "" {
+		filePath = defaultTelemetryFilePath
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create telemetry file directory")
+	}
+
+	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open telemetry file")
+	}
+
+	return &FileTelemetrySink{file: f}, nil
+}
+
+func (sink *FileTelemetrySink) Name() string {
+	return TelemetrySinkFile
+}
+
+func (sink *FileTelemetrySink) Send(event *TelemetryEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	_, err = sink.file.Write(append(line, '\n'))
+	return err
+}
+
+func (sink *FileTelemetrySink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	return sink.file.Close()
+}
+
+// SyslogTelemetrySink writes each event as JSON to the local or a remote syslog daemon.
+type SyslogTelemetrySink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogTelemetrySink(network, address, tag string) (*SyslogTelemetrySink, error) {
+	if tag == "" {
+		tag = defaultSyslogTag
+	}
+
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_USER, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to syslog")
+	}
+
+	return &SyslogTelemetrySink{writer: writer}, nil
+}
+
+func (sink *SyslogTelemetrySink) Name() string {
+	return TelemetrySinkSyslog
+}
+
+func (sink *SyslogTelemetrySink) Send(event *TelemetryEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return sink.writer.Info(string(line))
+}
+
+func (sink *SyslogTelemetrySink) Close() error {
+	return sink.writer.Close()
+}
+
+// WebhookTelemetrySink posts each event as JSON to a user supplied URL.
+type WebhookTelemetrySink struct {
+	Client  *http.Client
+	URL     string
+	Headers map[string]string
+}
+
+func NewWebhookTelemetrySink(webhookURL string, headers map[string]string, client *http.Client) (*WebhookTelemetrySink, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse webhook url")
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported webhook url scheme: %s", u.Scheme)
+	}
+
+	return &WebhookTelemetrySink{Client: client, URL: webhookURL, Headers: headers}, nil
+}
+
+func (sink *WebhookTelemetrySink) Name() string {
+	return TelemetrySinkWebhook
+}
+
+func (sink *WebhookTelemetrySink) Send(event *TelemetryEvent) error {
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", sink.URL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json; charset=UTF-8")
+	for key, value := range sink.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := sink.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook call error, status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (sink *WebhookTelemetrySink) Close() error {
+	return nil
+}
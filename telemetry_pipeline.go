@@ -0,0 +1,450 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultTelemetryQueueSize     = 10000
+	defaultTelemetryBatchSize     = 100
+	defaultTelemetryFlushInterval = 2 * time.Second
+	defaultTelemetryMaxRetries    = 5
+	defaultTelemetryBaseBackoff   = 500 * time.Millisecond
+	defaultTelemetryMaxBackoff    = 30 * time.Second
+	defaultTelemetryCloseTimeout  = 10 * time.Second
+	defaultTelemetrySpoolDir      = "/home/agent/telemetry-spool"
+	telemetrySpoolFileSuffix      = ".json.gz"
+	// a spooled batch the sink keeps rejecting is discarded after this many replays
+	maxTelemetrySpoolAttempts = 5
+)
+
+// errors of Send when the event was dropped
+var (
+	errTelemetryPipelineClosed = errors.New("telemetry pipeline closed")
+	errTelemetryQueueFull      = errors.New("telemetry queue full")
+)
+
+// TelemetryBatchSink is implemented by sinks that can deliver several events in one call.
+// SendBatch returns how many events from the start of the batch were delivered.
+type TelemetryBatchSink interface {
+	SendBatch(events []*TelemetryEvent) (int, error)
+}
+
+// TelemetryPipelineConfig is telemetry_pipeline in agent.json. Zero values use the defaults.
+type TelemetryPipelineConfig struct {
+	QueueSize       int    `json:"queue_size,omitempty"`
+	BatchSize       int    `json:"batch_size,omitempty"`
+	FlushIntervalMs int    `json:"flush_interval_ms,omitempty"`
+	MaxRetries      int    `json:"max_retries,omitempty"`
+	SpoolDir        string `json:"spool_dir,omitempty"`
+}
+
+type TelemetryPipelineStats struct {
+	QueueDepth int
+	Enqueued   uint64
+	Sent       uint64
+	Dropped    uint64
+	Spooled    uint64
+	Failed     uint64
+}
+
+// TelemetryPipeline delivers events to a sink asynchronously.
+// Events are batched, retried with exponential backoff and jitter, and spooled to disk
+// when the sink stays unreachable. Spooled batches are replayed after the next successful delivery.
+// TelemetryPipeline is itself a TelemetrySink, so it can wrap any sink transparently.
+type TelemetryPipeline struct {
+	Sink          TelemetrySink
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	BaseBackoff   time.Duration
+	MaxBackoff    time.Duration
+	CloseTimeout  time.Duration // of Close and Flush
+	SpoolDir      string
+
+	queue   chan *TelemetryEvent
+	flushes chan chan struct{} // closed once the queued events are delivered
+	done    chan struct{}
+	abort   chan struct{} // closed when Close times out, delivery stops retrying and spools
+	closed  bool
+	mutex   sync.RWMutex
+
+	abortOnce sync.Once
+
+	spoolAttempts map[string]int // failed replays of spool files, only used by run
+
+	enqueued uint64
+	sent     uint64
+	dropped  uint64
+	spooled  uint64
+	failed   uint64
+}
+
+func NewTelemetryPipeline(sink TelemetrySink, pipelineConfig TelemetryPipelineConfig) *TelemetryPipeline {
+	pipeline := &TelemetryPipeline{
+		Sink:          sink,
+		BatchSize:     pipelineConfig.BatchSize,
+		FlushInterval: time.Duration(pipelineConfig.FlushIntervalMs) * time.Millisecond,
+		MaxRetries:    pipelineConfig.MaxRetries,
+		BaseBackoff:   defaultTelemetryBaseBackoff,
+		MaxBackoff:    defaultTelemetryMaxBackoff,
+		CloseTimeout:  defaultTelemetryCloseTimeout,
+		SpoolDir:      pipelineConfig.SpoolDir,
+	}
+
+	queueSize := pipelineConfig.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultTelemetryQueueSize
+	}
+	if pipeline.BatchSize <= 0 {
+		pipeline.BatchSize = defaultTelemetryBatchSize
+	}
+	if pipeline.FlushInterval <= 0 {
+		pipeline.FlushInterval = defaultTelemetryFlushInterval
+	}
+	if pipeline.MaxRetries <= 0 {
+		pipeline.MaxRetries = defaultTelemetryMaxRetries
+	}
+	if pipeline.SpoolDir == "" {
+		pipeline.SpoolDir = defaultTelemetrySpoolDir
+	}
+
+	pipeline.queue = make(chan *TelemetryEvent, queueSize)
+	pipeline.flushes = make(chan chan struct{})
+	pipeline.done = make(chan struct{})
+	pipeline.abort = make(chan struct{})
+
+	go pipeline.run()
+
+	return pipeline
+}
+
+func (pipeline *TelemetryPipeline) Name() string {
+	return pipeline.Sink.Name()
+}
+
+// Send enqueues the event without blocking. If the queue is full the event is dropped and counted.
+func (pipeline *TelemetryPipeline) Send(event *TelemetryEvent) error {
+	pipeline.mutex.RLock()
+	defer pipeline.mutex.RUnlock()
+
+	if pipeline.closed {
+		atomic.AddUint64(&pipeline.dropped, 1)
+		return errTelemetryPipelineClosed
+	}
+
+	select {
+	case pipeline.queue <- event:
+		atomic.AddUint64(&pipeline.enqueued, 1)
+		return nil
+	default:
+		if atomic.AddUint64(&pipeline.dropped, 1) == 1 {
+			go WriteLog(fmt.Sprintf("telemetry queue for sink %s is full, dropping events", pipeline.Name()))
+		}
+		return errTelemetryQueueFull
+	}
+}
+
+// Close flushes queued events, waits up to CloseTimeout for delivery and closes the sink.
+// Events that are not delivered by then are spooled, the sink is closed only once delivery stopped.
+func (pipeline *TelemetryPipeline) Close() error {
+	pipeline.mutex.Lock()
+	if !pipeline.closed {
+		pipeline.closed = true
+		close(pipeline.queue)
+	}
+	pipeline.mutex.Unlock()
+
+	select {
+	case <-pipeline.done:
+	case <-time.After(pipeline.CloseTimeout):
+		WriteLog(fmt.Sprintf("timed out flushing telemetry sink %s, spooling the remaining events", pipeline.Name()))
+		pipeline.abortOnce.Do(func() { close(pipeline.abort) })
+		<-pipeline.done
+	}
+
+	WriteLog(fmt.Sprintf("telemetry sink %s stats: %+v", pipeline.Name(), pipeline.Stats()))
+
+	return pipeline.Sink.Close()
+}
+
+// Flush delivers the queued events and waits up to CloseTimeout for delivery.
+// Unlike Close, the pipeline stays open, as the agent keeps running after the job.
+func (pipeline *TelemetryPipeline) Flush() {
+	pipeline.mutex.RLock()
+	closed := pipeline.closed
+	pipeline.mutex.RUnlock()
+	if closed {
+		return
+	}
+
+	flushed := make(chan struct{})
+	timeout := time.After(pipeline.CloseTimeout)
+	select {
+	case pipeline.flushes <- flushed:
+	case <-timeout:
+		WriteLog(fmt.Sprintf("timed out flushing telemetry sink %s", pipeline.Name()))
+		return
+	}
+
+	select {
+	case <-flushed:
+	case <-timeout:
+		WriteLog(fmt.Sprintf("timed out flushing telemetry sink %s", pipeline.Name()))
+	}
+}
+
+func (pipeline *TelemetryPipeline) Stats() TelemetryPipelineStats {
+	return TelemetryPipelineStats{
+		QueueDepth: len(pipeline.queue),
+		Enqueued:   atomic.LoadUint64(&pipeline.enqueued),
+		Sent:       atomic.LoadUint64(&pipeline.sent),
+		Dropped:    atomic.LoadUint64(&pipeline.dropped),
+		Spooled:    atomic.LoadUint64(&pipeline.spooled),
+		Failed:     atomic.LoadUint64(&pipeline.failed),
+	}
+}
+
+func (pipeline *TelemetryPipeline) run() {
+	defer close(pipeline.done)
+
+	ticker := time.NewTicker(pipeline.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*TelemetryEvent, 0, pipeline.BatchSize)
+	for {
+		select {
+		case event, ok := <-pipeline.queue:
+			if !ok {
+				pipeline.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= pipeline.BatchSize {
+				pipeline.flush(batch)
+				batch = make([]*TelemetryEvent, 0, pipeline.BatchSize)
+			}
+		case flushed := <-pipeline.flushes:
+			// events queued before the flush was requested are part of it
+			for drained := false; !drained; {
+				select {
+				case event, ok := <-pipeline.queue:
+					if !ok {
+						drained = true
+					} else {
+						batch = append(batch, event)
+					}
+				default:
+					drained = true
+				}
+			}
+			pipeline.flush(batch)
+			batch = make([]*TelemetryEvent, 0, pipeline.BatchSize)
+			close(flushed)
+		case <-ticker.C:
+			if len(batch) > 0 {
+				pipeline.flush(batch)
+				batch = make([]*TelemetryEvent, 0, pipeline.BatchSize)
+			}
+		}
+	}
+}
+
+func (pipeline *TelemetryPipeline) flush(batch []*TelemetryEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	remaining, err := pipeline.deliverWithRetry(batch)
+	atomic.AddUint64(&pipeline.sent, uint64(len(batch)-len(remaining)))
+	if err != nil {
+		atomic.AddUint64(&pipeline.failed, 1)
+		WriteLog(fmt.Sprintf("telemetry sink %s unreachable, spooling %d events: %v", pipeline.Name(), len(remaining), err))
+		if err := pipeline.spool(remaining); err != nil {
+			atomic.AddUint64(&pipeline.dropped, uint64(len(remaining)))
+			WriteLog(fmt.Sprintf("failed to spool telemetry for sink %s: %v", pipeline.Name(), err))
+		}
+		return
+	}
+
+	if !pipeline.aborted() {
+		pipeline.replaySpool()
+	}
+}
+
+func (pipeline *TelemetryPipeline) aborted() bool {
+	select {
+	case <-pipeline.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliverWithRetry returns the events that could not be delivered after all retries.
+func (pipeline *TelemetryPipeline) deliverWithRetry(batch []*TelemetryEvent) ([]*TelemetryEvent, error) {
+	var err error
+	for attempt := 0; attempt < pipeline.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(pipeline.backoff(attempt)):
+			case <-pipeline.abort:
+			}
+		}
+		if pipeline.aborted() {
+			return batch, errTelemetryPipelineClosed
+		}
+
+		var delivered int
+		delivered, err = pipeline.deliver(batch)
+		batch = batch[delivered:]
+		if err == nil {
+			return nil, nil
+		}
+	}
+
+	return batch, err
+}
+
+// deliver returns how many events from the start of the batch reached the sink.
+func (pipeline *TelemetryPipeline) deliver(batch []*TelemetryEvent) (int, error) {
+	if batchSink, ok := pipeline.Sink.(TelemetryBatchSink); ok {
+		return batchSink.SendBatch(batch)
+	}
+
+	for i, event := range batch {
+		if err := pipeline.Sink.Send(event); err != nil {
+			return i, err
+		}
+	}
+
+	return len(batch), nil
+}
+
+// backoff returns an exponential delay for the attempt with equal jitter,
+// so agents on many runners do not retry in lockstep.
+func (pipeline *TelemetryPipeline) backoff(attempt int) time.Duration {
+	delay := pipeline.BaseBackoff << uint(attempt-1)
+	if delay <= 0 || delay > pipeline.MaxBackoff {
+		delay = pipeline.MaxBackoff
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (pipeline *TelemetryPipeline) spoolPrefix() string {
+	return fmt.Sprintf("%s-", pipeline.Name())
+}
+
+func (pipeline *TelemetryPipeline) spool(batch []*TelemetryEvent) error {
+	if err := os.MkdirAll(pipeline.SpoolDir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create spool directory")
+	}
+
+	fileName := filepath.Join(pipeline.SpoolDir, fmt.Sprintf("%s%d%s", pipeline.spoolPrefix(), time.Now().UnixNano(), telemetrySpoolFileSuffix))
+	if err := writeTelemetryBatchFile(fileName, batch); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&pipeline.spooled, uint64(len(batch)))
+	return nil
+}
+
+// replaySpool delivers spooled batches oldest first. A batch that fails is kept for the next replay,
+// so it does not hold back later batches, and discarded after maxTelemetrySpoolAttempts.
+func (pipeline *TelemetryPipeline) replaySpool() {
+	entries, err := os.ReadDir(pipeline.SpoolDir)
+	if err != nil {
+		return
+	}
+
+	fileNames := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), pipeline.spoolPrefix()) && strings.HasSuffix(entry.Name(), telemetrySpoolFileSuffix) {
+			fileNames = append(fileNames, entry.Name())
+		}
+	}
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		spoolFile := filepath.Join(pipeline.SpoolDir, fileName)
+		batch, err := readTelemetryBatchFile(spoolFile)
+		if err != nil {
+			WriteLog(fmt.Sprintf("discarding unreadable telemetry spool file %s: %v", spoolFile, err))
+			os.Remove(spoolFile)
+			continue
+		}
+
+		delivered, err := pipeline.deliver(batch)
+		atomic.AddUint64(&pipeline.sent, uint64(delivered))
+		if err != nil {
+			if pipeline.spoolAttempts == nil {
+				pipeline.spoolAttempts = make(map[string]int)
+			}
+			pipeline.spoolAttempts[fileName]++
+			if pipeline.spoolAttempts[fileName] >= maxTelemetrySpoolAttempts {
+				WriteLog(fmt.Sprintf("discarding telemetry spool file %s after %d failed replays: %v", spoolFile, pipeline.spoolAttempts[fileName], err))
+				atomic.AddUint64(&pipeline.dropped, uint64(len(batch)-delivered))
+				delete(pipeline.spoolAttempts, fileName)
+				os.Remove(spoolFile)
+			} else if delivered > 0 {
+				// keep only what is left, so replay does not duplicate events
+				os.Remove(spoolFile)
+				writeTelemetryBatchFile(spoolFile, batch[delivered:])
+			}
+			continue
+		}
+
+		delete(pipeline.spoolAttempts, fileName)
+		os.Remove(spoolFile)
+	}
+}
+
+func writeTelemetryBatchFile(fileName string, batch []*TelemetryEvent) error {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create spool file")
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	if err := json.NewEncoder(gz).Encode(batch); err != nil {
+		return errors.Wrap(err, "failed to write spool file")
+	}
+
+	return gz.Close()
+}
+
+func readTelemetryBatchFile(fileName string) ([]*TelemetryEvent, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var batch []*TelemetryEvent
+	if err := json.NewDecoder(gz).Decode(&batch); err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+)
+
+type recordingBatchSink struct {
+	batches  [][]*TelemetryEvent
+	failures int
+	mutex    sync.Mutex
+}
+
+func (sink *recordingBatchSink) Name() string { return "recording" }
+
+func (sink *recordingBatchSink) Send(event *TelemetryEvent) error {
+	_, err := sink.SendBatch([]*TelemetryEvent{event})
+	return err
+}
+
+func (sink *recordingBatchSink) SendBatch(events []*TelemetryEvent) (int, error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.failures != 0 {
+		if sink.failures > 0 {
+			sink.failures--
+		}
+		return 0, fmt.Errorf("sink unavailable")
+	}
+
+	sink.batches = append(sink.batches, events)
+	return len(events), nil
+}
+
+func (sink *recordingBatchSink) Close() error { return nil }
+
+func (sink *recordingBatchSink) eventCount() int {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	count := 0
+	for _, batch := range sink.batches {
+		count += len(batch)
+	}
+	return count
+}
+
+func newTestPipeline(sink TelemetrySink, spoolDir string) *TelemetryPipeline {
+	return &TelemetryPipeline{
+		Sink:          sink,
+		BatchSize:     3,
+		FlushInterval: time.Hour,
+		MaxRetries:    3,
+		BaseBackoff:   time.Millisecond,
+		MaxBackoff:    5 * time.Millisecond,
+		CloseTimeout:  time.Second,
+		SpoolDir:      spoolDir,
+		queue:         make(chan *TelemetryEvent, 10),
+		flushes:       make(chan chan struct{}),
+		done:          make(chan struct{}),
+		abort:         make(chan struct{}),
+	}
+}
+
+func TestTelemetryPipeline_Batches(t *testing.T) {
+	sink := &recordingBatchSink{}
+	pipeline := newTestPipeline(sink, t.TempDir())
+	go pipeline.run()
+
+	for i := 0; i < 7; i++ {
+		if err := pipeline.Send(&TelemetryEvent{Type: telemetryTypeDNS}); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	pipeline.Close()
+
+	if len(sink.batches) != 3 {
+		t.Fatalf("expected 3 batches, got %d", len(sink.batches))
+	}
+	if len(sink.batches[0]) != 3 || len(sink.batches[2]) != 1 {
+		t.Fatalf("unexpected batch sizes %d, %d", len(sink.batches[0]), len(sink.batches[2]))
+	}
+
+	stats := pipeline.Stats()
+	if stats.Enqueued != 7 || stats.Sent != 7 || stats.Dropped != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if err := pipeline.Send(&TelemetryEvent{}); err == nil {
+		t.Fatalf("expected error sending to closed pipeline")
+	}
+}
+
+func TestTelemetryPipeline_Flush(t *testing.T) {
+	sink := &recordingBatchSink{}
+	pipeline := newTestPipeline(sink, t.TempDir())
+	go pipeline.run()
+
+	for i := 0; i < 2; i++ {
+		pipeline.Send(&TelemetryEvent{Type: telemetryTypeDNS})
+	}
+	pipeline.Flush()
+
+	// delivered although the batch is not full and the flush interval has not passed
+	if sink.eventCount() != 2 {
+		t.Fatalf("expected 2 events to be flushed, got %d", sink.eventCount())
+	}
+
+	// the pipeline stays open
+	if err := pipeline.Send(&TelemetryEvent{Type: telemetryTypeDNS}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	pipeline.Close()
+	if sink.eventCount() != 3 {
+		t.Fatalf("expected 3 events, got %d", sink.eventCount())
+	}
+}
+
+func TestTelemetryPipeline_Retry(t *testing.T) {
+	sink := &recordingBatchSink{failures: 2}
+	pipeline := newTestPipeline(sink, t.TempDir())
+
+	pipeline.flush([]*TelemetryEvent{{Type: telemetryTypeDNS}})
+
+	if sink.eventCount() != 1 {
+		t.Fatalf("expected event to be delivered after retries")
+	}
+	if stats := pipeline.Stats(); stats.Failed != 0 || stats.Spooled != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTelemetryPipeline_SpoolAndReplay(t *testing.T) {
+	spoolDir := t.TempDir()
+	sink := &recordingBatchSink{failures: -1}
+	pipeline := newTestPipeline(sink, spoolDir)
+
+	pipeline.flush([]*TelemetryEvent{{Type: telemetryTypeDNS}, {Type: telemetryTypeNetworkConnection}})
+
+	entries, _ := os.ReadDir(spoolDir)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 spool file, got %d", len(entries))
+	}
+	if stats := pipeline.Stats(); stats.Spooled != 2 || stats.Failed != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// API is reachable again
+	sink.failures = 0
+	pipeline.flush([]*TelemetryEvent{{Type: telemetryTypeDNS}})
+
+	if sink.eventCount() != 3 {
+		t.Fatalf("expected spooled events to be replayed, got %d events", sink.eventCount())
+	}
+	entries, _ = os.ReadDir(spoolDir)
+	if len(entries) != 0 {
+		t.Fatalf("expected spool to be drained, got %d files", len(entries))
+	}
+}
+
+// rejectingBatchSink rejects batches with an event of a type, like an API rejecting a malformed record.
+type rejectingBatchSink struct {
+	recordingBatchSink
+	rejectedType string
+}
+
+func (sink *rejectingBatchSink) SendBatch(events []*TelemetryEvent) (int, error) {
+	for _, event := range events {
+		if event.Type == sink.rejectedType {
+			return 0, fmt.Errorf("bad request")
+		}
+	}
+	return sink.recordingBatchSink.SendBatch(events)
+}
+
+func TestTelemetryPipeline_ReplaySkipsRejectedBatch(t *testing.T) {
+	spoolDir := t.TempDir()
+	sink := &rejectingBatchSink{rejectedType: "rejected"}
+	pipeline := newTestPipeline(sink, spoolDir)
+
+	rejectedFile := filepath.Join(spoolDir, pipeline.spoolPrefix()+"1"+telemetrySpoolFileSuffix)
+	writeTelemetryBatchFile(rejectedFile, []*TelemetryEvent{{Type: "rejected"}})
+	writeTelemetryBatchFile(filepath.Join(spoolDir, pipeline.spoolPrefix()+"2"+telemetrySpoolFileSuffix), []*TelemetryEvent{{Type: telemetryTypeDNS}})
+
+	pipeline.replaySpool()
+
+	// the later batch is delivered, the rejected one is kept for another replay
+	if sink.eventCount() != 1 {
+		t.Fatalf("expected the later batch to be delivered, got %d events", sink.eventCount())
+	}
+	if _, err := os.Stat(rejectedFile); err != nil {
+		t.Fatalf("expected the rejected batch to be kept, %v", err)
+	}
+
+	for i := 1; i < maxTelemetrySpoolAttempts; i++ {
+		pipeline.replaySpool()
+	}
+
+	entries, _ := os.ReadDir(spoolDir)
+	if len(entries) != 0 || pipeline.Stats().Dropped != 1 {
+		t.Fatalf("expected the rejected batch to be discarded, got %d files, stats %+v", len(entries), pipeline.Stats())
+	}
+}
+
+func TestTelemetryPipeline_DropsWhenFull(t *testing.T) {
+	pipeline := newTestPipeline(&recordingBatchSink{}, t.TempDir())
+	pipeline.queue = make(chan *TelemetryEvent, 1)
+
+	if err := pipeline.Send(&TelemetryEvent{}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if err := pipeline.Send(&TelemetryEvent{}); err == nil {
+		t.Fatalf("expected error when queue is full")
+	}
+
+	if stats := pipeline.Stats(); stats.QueueDepth != 1 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTelemetryPipeline_backoff(t *testing.T) {
+	pipeline := &TelemetryPipeline{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		want := pipeline.BaseBackoff << uint(attempt-1)
+		if want > pipeline.MaxBackoff {
+			want = pipeline.MaxBackoff
+		}
+		got := pipeline.backoff(attempt)
+		if got < want/2 || got > want {
+			t.Fatalf("backoff(%d) = %v, want between %v and %v", attempt, got, want/2, want)
+		}
+	}
+}
+
+func TestApiTelemetrySink_SendBatch(t *testing.T) {
+	apiclient := &ApiClient{Client: &http.Client{}, TelemetryURL: agentApiBaseUrl, OneTimeKey: "key"}
+	httpmock.ActivateNonDefault(apiclient.Client)
+	defer httpmock.DeactivateAndReset()
+
+	received := make(map[string]int)
+	requests := 0
+	for _, telemetryType := range []string{telemetryTypeDNS, telemetryTypeNetworkConnection} {
+		telemetryType := telemetryType
+		httpmock.RegisterResponder("POST", fmt.Sprintf("%s/github/owner/repo/actions/jobs/123/%s", agentApiBaseUrl, telemetryType),
+			func(req *http.Request) (*http.Response, error) {
+				if req.Header.Get("Content-Encoding") != "gzip" || req.Header.Get("x-one-time-key") != "key" {
+					return httpmock.NewStringResponse(400, ""), nil
+				}
+				gz, err := gzip.NewReader(req.Body)
+				if err != nil {
+					return httpmock.NewStringResponse(400, ""), nil
+				}
+				var events []*TelemetryEvent
+				if err := json.NewDecoder(gz).Decode(&events); err != nil {
+					return httpmock.NewStringResponse(400, ""), nil
+				}
+				for _, event := range events {
+					if event.Type != telemetryType || event.Chain == nil {
+						return httpmock.NewStringResponse(400, ""), nil
+					}
+				}
+				received[telemetryType] += len(events)
+				requests++
+				return httpmock.NewStringResponse(200, ""), nil
+			})
+	}
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/github/owner/repo/actions/jobs/123/rejected", agentApiBaseUrl),
+		httpmock.NewStringResponder(503, ""))
+
+	chain := &ChainLink{Seq: 1, Hash: "hash"}
+	sink := &ApiTelemetrySink{ApiClient: apiclient}
+	delivered, err := sink.SendBatch([]*TelemetryEvent{
+		{Type: telemetryTypeDNS, CorrelationId: "123", Repo: "owner/repo", Data: &DNSRecord{DomainName: "example.com."}, Chain: chain},
+		{Type: telemetryTypeDNS, CorrelationId: "123", Repo: "owner/repo", Data: &DNSRecord{DomainName: "example.org."}, Chain: chain},
+		{Type: telemetryTypeNetworkConnection, CorrelationId: "123", Repo: "owner/repo", Data: &NetworkConnection{IPAddress: "1.2.3.4"}, Chain: chain},
+		{Type: "rejected", CorrelationId: "123", Repo: "owner/repo", Data: &NetworkConnection{IPAddress: "1.2.3.4"}, Chain: chain},
+		{Type: telemetryTypeDNS, CorrelationId: "123", Repo: "owner/repo", Data: &DNSRecord{DomainName: "example.net."}, Chain: chain},
+	})
+
+	// one request per run of events of a type, delivery stops at the first rejected request
+	if err == nil || delivered != 3 {
+		t.Fatalf("SendBatch() = %d, %v, want 3 and an error", delivered, err)
+	}
+	if received[telemetryTypeDNS] != 2 || received[telemetryTypeNetworkConnection] != 1 {
+		t.Fatalf("unexpected events per endpoint %v", received)
+	}
+	if requests != 2 {
+		t.Fatalf("expected 2 accepted requests, got %d", requests)
+	}
+}
+
+// closingBatchSink records if it was closed while the pipeline was still delivering.
+type closingBatchSink struct {
+	recordingBatchSink
+	done           chan struct{}
+	closedTooEarly bool
+}
+
+func (sink *closingBatchSink) Close() error {
+	select {
+	case <-sink.done:
+	default:
+		sink.closedTooEarly = true
+	}
+	return nil
+}
+
+func TestTelemetryPipeline_CloseTimeout(t *testing.T) {
+	spoolDir := t.TempDir()
+	sink := &closingBatchSink{recordingBatchSink: recordingBatchSink{failures: -1}}
+	pipeline := newTestPipeline(sink, spoolDir)
+	sink.done = pipeline.done
+	// delivery is still backing off when Close times out
+	pipeline.BaseBackoff = time.Hour
+	pipeline.MaxBackoff = time.Hour
+	pipeline.CloseTimeout = 50 * time.Millisecond
+	go pipeline.run()
+
+	for i := 0; i < 2; i++ {
+		pipeline.Send(&TelemetryEvent{Type: telemetryTypeDNS})
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		pipeline.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close() did not stop the delivery")
+	}
+
+	if sink.closedTooEarly {
+		t.Fatalf("expected the sink to be closed after delivery stopped")
+	}
+	entries, _ := os.ReadDir(spoolDir)
+	if stats := pipeline.Stats(); len(entries) != 1 || stats.Spooled != 2 {
+		t.Fatalf("expected the events to be spooled, got %d files, stats %+v", len(entries), stats)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+)
+
+func Test_newTelemetrySinks(t *testing.T) {
+	apiclient := &ApiClient{Client: &http.Client{}, APIURL: agentApiBaseUrl}
+
+	sinks, err := newTelemetrySinks(nil, apiclient)
+	if err != nil {
+		t.Fatalf("newTelemetrySinks() error = %v", err)
+	}
+	if len(sinks) != 1 || sinks[0].Name() != TelemetrySinkAPI {
+		t.Fatalf("expected default api sink, got %v", sinks)
+	}
+
+	filePath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+	sinks, err = newTelemetrySinks([]TelemetrySinkConfig{
+		{Type: TelemetrySinkFile, Path: filePath},
+		{Type: TelemetrySinkWebhook, URL: "https://webhook.example.com/events"},
+		{Type: "unknown"},
+	}, apiclient)
+	if err == nil {
+		t.Fatalf("expected error for unknown sink type")
+	}
+	if len(sinks) != 2 {
+		t.Fatalf("expected 2 sinks, got %d", len(sinks))
+	}
+	for _, sink := range sinks {
+		sink.Close()
+	}
+}
+
+func TestApiClient_sendTelemetry_LocalOnly(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "telemetry.jsonl")
+	fileSink, err := NewFileTelemetrySink(filePath)
+	if err != nil {
+		t.Fatalf("NewFileTelemetrySink() error = %v", err)
+	}
+
+	// block mode with telemetry disabled used to drop records entirely
+	apiclient := &ApiClient{Client: &http.Client{}, APIURL: agentApiBaseUrl, DisableTelemetry: true, EgressPolicy: EgressPolicyBlock}
+	apiclient.Sinks = []TelemetrySink{fileSink}
+
+	if err := apiclient.sendDNSRecord("123", "owner/repo", "example.com.", "1.2.3.4", "", ""); err != nil {
+		t.Fatalf("sendDNSRecord() error = %v", err)
+	}
+	if err := apiclient.sendNetConnection("123", "owner/repo", "1.2.3.4", "443", "example.com.", "Dropped", "", "", time.Now().UTC(), Tool{Name: Unknown}); err != nil {
+		t.Fatalf("sendNetConnection() error = %v", err)
+	}
+	apiclient.closeTelemetrySinks()
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		t.Fatalf("failed to open telemetry file: %v", err)
+	}
+	defer f.Close()
+
+	var types []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event TelemetryEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid json line %s: %v", scanner.Text(), err)
+		}
+		if event.CorrelationId != "123" || event.Repo != "owner/repo" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		types = append(types, event.Type)
+	}
+
+	if len(types) != 2 || types[0] != telemetryTypeDNS || types[1] != telemetryTypeNetworkConnection {
+		t.Fatalf("unexpected event types %v", types)
+	}
+}
+
+func TestApiTelemetrySink_Send(t *testing.T) {
+	client := &http.Client{}
+	httpmock.ActivateNonDefault(client)
+	defer httpmock.DeactivateAndReset()
+
+	key := deriveJobKey("one-time-key", "123")
+	apiclient := &ApiClient{Client: client, TelemetryURL: "https://apiurl/v1", OneTimeKey: "key", Chain: NewEventChain(key)}
+	event := &TelemetryEvent{Type: telemetryTypeDNS, CorrelationId: "123", Repo: "owner/repo", Data: &DNSRecord{DomainName: "example.com."}}
+	record, _ := json.Marshal(event)
+	link := apiclient.Chain.Append(record)
+	event.Chain = &link
+
+	drop := telemetryDrop{Seq: 7, Sink: "file"}
+	dropRecord, _ := json.Marshal(drop)
+	apiclient.telemetryDrops = []telemetryDropLink{{telemetryDrop: drop, ChainLink: apiclient.Chain.Append(dropRecord)}}
+
+	var drops []telemetryDropLink
+	httpmock.RegisterResponder("POST", "https://apiurl/v1/github/owner/repo/actions/jobs/123/dns",
+		func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("x-telemetry-chain-seq") != "1" || req.Header.Get("x-telemetry-chain-prev-hash") != event.Chain.PrevHash ||
+				req.Header.Get("x-telemetry-chain-hash") != event.Chain.Hash ||
+				req.Header.Get("x-telemetry-chain-signature") != event.Chain.Signature {
+				return httpmock.NewStringResponse(400, ""), nil
+			}
+			json.Unmarshal([]byte(req.Header.Get("x-telemetry-drops")), &drops)
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	sink := &ApiTelemetrySink{ApiClient: apiclient}
+	if err := sink.Send(event); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	if len(drops) != 1 || drops[0].telemetryDrop.Seq != 7 || drops[0].Sink != "file" || drops[0].ChainLink.Seq != 2 {
+		t.Fatalf("expected the drop to be reported, got %+v", drops)
+	}
+	if pending := apiclient.pendingTelemetryDrops(); len(pending) != 0 {
+		t.Fatalf("expected no pending drops after they were reported, got %+v", pending)
+	}
+}
+
+func TestApiTelemetrySink_LocalTypes(t *testing.T) {
+	client := &http.Client{}
+	httpmock.ActivateNonDefault(client)
+	defer httpmock.DeactivateAndReset()
+
+	requests := 0
+	httpmock.RegisterResponder("POST", "https://apiurl/v1/github/owner/repo/actions/jobs/123/dns",
+		func(req *http.Request) (*http.Response, error) {
+			requests++
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	apiclient := &ApiClient{Client: client, TelemetryURL: "https://apiurl/v1", Chain: NewEventChain(deriveJobKey("one-time-key", "123"))}
+	sink := &ApiTelemetrySink{ApiClient: apiclient}
+	dns := &TelemetryEvent{Type: telemetryTypeDNS, CorrelationId: "123", Repo: "owner/repo", Data: &DNSRecord{DomainName: "example.com."}}
+
+	for _, telemetryType := range []string{telemetryTypeEgressSummary, telemetryTypeRawSocket} {
+		local := &TelemetryEvent{Type: telemetryType, CorrelationId: "123", Repo: "owner/repo", Data: []string{}}
+		requests = 0
+		if err := sink.Send(local); err != nil {
+			t.Fatalf("Send(%s) error = %v", telemetryType, err)
+		}
+		if delivered, err := sink.SendBatch([]*TelemetryEvent{dns, local, dns}); err != nil || delivered != 3 {
+			t.Fatalf("SendBatch() = %d, %v", delivered, err)
+		}
+		if requests != 2 {
+			t.Fatalf("expected only the dns events to be posted, got %d requests", requests)
+		}
+
+		// local events are not linked, the API would see a gap in the chain
+		if err := apiclient.sendTelemetry(local); err != nil || local.Chain != nil {
+			t.Fatalf("expected %s not to be chained, got %+v, %v", telemetryType, local.Chain, err)
+		}
+	}
+}
+
+func TestWebhookTelemetrySink_Send(t *testing.T) {
+	client := &http.Client{}
+	httpmock.ActivateNonDefault(client)
+
+	httpmock.RegisterResponder("POST", "https://webhook.example.com/events",
+		func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("Authorization") != "Bearer token" {
+				return httpmock.NewStringResponse(401, ""), nil
+			}
+			return httpmock.NewStringResponse(204, ""), nil
+		})
+
+	sink, err := NewWebhookTelemetrySink("https://webhook.example.com/events", map[string]string{"Authorization": "Bearer token"}, client)
+	if err != nil {
+		t.Fatalf("NewWebhookTelemetrySink() error = %v", err)
+	}
+
+	if err := sink.Send(&TelemetryEvent{Type: telemetryTypeDNS, Data: &DNSRecord{DomainName: "example.com."}}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	if _, err := NewWebhookTelemetrySink("ftp://webhook.example.com", nil, client); err == nil {
+		t.Fatalf("expected error for unsupported scheme")
+	}
+}
+
+func Test_telemetrySinkEndpoints(t *testing.T) {
+	endpoints, ipAddressEndpoints := telemetrySinkEndpoints([]TelemetrySinkConfig{
+		{Type: TelemetrySinkWebhook, URL: "https://webhook.example.com/events"},
+		{Type: TelemetrySinkWebhook, URL: "http://collector.example.com:8080/"},
+		{Type: TelemetrySinkWebhook, URL: "https://10.0.0.1/events"},
+		{Type: TelemetrySinkWebhook, URL: "https://[2001:db8::1]/events"},
+		{Type: TelemetrySinkSyslog, Network: "tcp", Address: "syslog.example.com:6514"},
+		{Type: TelemetrySinkSyslog, Network: "tcp", Address: "203.0.113.5:6514"},
+		{Type: TelemetrySinkFile},
+	})
+
+	want := []Endpoint{
+		{domainName: "webhook.example.com.", port: 443},
+		{domainName: "collector.example.com.", port: 8080},
+		{domainName: "syslog.example.com.", port: 6514},
+	}
+	if !reflect.DeepEqual(endpoints, want) {
+		t.Fatalf("telemetrySinkEndpoints() = %v, want %v", endpoints, want)
+	}
+
+	wantIPAddresses := []ipAddressEndpoint{
+		{ipAddress: "10.0.0.1", port: "443"},
+		{ipAddress: "203.0.113.5", port: "6514"},
+	}
+	if !reflect.DeepEqual(ipAddressEndpoints, wantIPAddresses) {
+		t.Fatalf("telemetrySinkEndpoints() = %v, want %v", ipAddressEndpoints, wantIPAddresses)
+	}
+}